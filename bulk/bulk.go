@@ -0,0 +1,101 @@
+// Package bulk sends many messages at once, spread across workers sharing
+// pooled smtp connections within the rate limits of the servers.
+package bulk
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lifeym/she/mail"
+)
+
+// Task is a message to be sent.
+type Task struct {
+	Message *mail.Message
+	// Pool sends the message with its account.
+	Pool *mail.Pool
+	// Limits are those of the smtp server of the account, nil if none.
+	Limits *Limits
+
+	// Sent is set once the message was sent, with the reply of the
+	// server, Err when it failed.
+	Sent  bool
+	Reply string
+	Err   error
+}
+
+// Stats counts the outcome of the tasks.
+type Stats struct {
+	Total  int
+	Sent   int
+	Failed int
+}
+
+// Pending returns the number of tasks not attempted.
+func (s Stats) Pending() int {
+	return s.Total - s.Sent - s.Failed
+}
+
+// Sender sends tasks with a pool of workers.
+type Sender struct {
+	// Workers is the number of messages sent at once, 1 if not positive.
+	Workers int
+	// Progress is called after each attempted task, one call at a time.
+	Progress func(task *Task, stats Stats)
+}
+
+// Run sends the tasks and returns once they were all attempted. When ctx
+// is done no more task is started, those in flight are finished and the
+// error of ctx is returned.
+func (s *Sender) Run(ctx context.Context, tasks []*Task) (Stats, error) {
+	stats := Stats{Total: len(tasks)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	next := make(chan *Task)
+	for i := 0; i < max(s.Workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range next {
+				from, to, err := task.Message.Envelope()
+				if err == nil {
+					if err = task.Limits.Wait(ctx, len(to)); err != nil {
+						// interrupted while waiting, the task is left pending
+						continue
+					}
+
+					task.Reply, err = task.Pool.Send(from, to, task.Message)
+				}
+
+				task.Err = err
+				task.Sent = err == nil
+				mu.Lock()
+				if task.Sent {
+					stats.Sent++
+				} else {
+					stats.Failed++
+				}
+
+				if s.Progress != nil {
+					s.Progress(task, stats)
+				}
+
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, task := range tasks {
+		select {
+		case next <- task:
+			continue
+		case <-ctx.Done():
+		}
+
+		break
+	}
+
+	close(next)
+	wg.Wait()
+	return stats, ctx.Err()
+}
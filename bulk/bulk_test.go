@@ -0,0 +1,145 @@
+package bulk
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lifeym/she/mail"
+	"github.com/lifeym/she/relay"
+)
+
+// startPool serves a relay server with handler on a loopback listener,
+// and returns a pool of size connections to it, until the end of the test.
+func startPool(t *testing.T, size int, handler relay.Handler) *mail.Pool {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &relay.Server{
+		Hostname: "relay.test",
+		Handler:  handler,
+		Authenticate: func(user string, password string) bool {
+			return user == "u" && password == "p"
+		},
+	}
+
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	pool := mail.New("u", "p", "127.0.0.1", l.Addr().(*net.TCPAddr).Port, true).NewPool(size)
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+func newTasks(pool *mail.Pool, limits *Limits, n int) []*Task {
+	var tasks []*Task
+	for i := 0; i < n; i++ {
+		m := mail.NewMessage()
+		m.SetHeader("From", "me@example.com")
+		m.SetHeader("To", "you@example.com")
+		m.SetHeader("Subject", "hello")
+		m.Body = "hello\n"
+		tasks = append(tasks, &Task{Message: m, Pool: pool, Limits: limits})
+	}
+
+	return tasks
+}
+
+func TestSenderRun(t *testing.T) {
+	var inFlight, most atomic.Int32
+	pool := startPool(t, 3, func(env *relay.Envelope) error {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+
+	tasks := newTasks(pool, nil, 10)
+	// no recipient
+	tasks[4].Message.RemoveHeader("To")
+	var calls []Stats
+	sender := Sender{Workers: 3, Progress: func(task *Task, stats Stats) {
+		calls = append(calls, stats)
+	}}
+
+	stats, err := sender.Run(context.Background(), tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats != (Stats{Total: 10, Sent: 9, Failed: 1}) {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	for i, task := range tasks {
+		if task.Sent != (i != 4) || task.Sent != (task.Err == nil) {
+			t.Errorf("task %d: sent %v, err %v", i, task.Sent, task.Err)
+		}
+	}
+
+	if len(calls) != 10 || calls[9] != stats {
+		t.Errorf("progress calls = %+v", calls)
+	}
+
+	for i, call := range calls {
+		if call.Sent+call.Failed != i+1 {
+			t.Errorf("progress call %d = %+v", i, call)
+		}
+	}
+
+	if n := most.Load(); n < 2 || n > 3 {
+		t.Errorf("%d messages sent at once, want 2 to 3", n)
+	}
+}
+
+// Once ctx is done the tasks not started are left pending.
+func TestSenderRunCancel(t *testing.T) {
+	pool := startPool(t, 1, func(env *relay.Envelope) error { return nil })
+	// the second message would wait a minute
+	tasks := newTasks(pool, NewLimits(1, 0), 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var once sync.Once
+	sender := Sender{Workers: 2, Progress: func(task *Task, stats Stats) {
+		once.Do(cancel)
+	}}
+
+	start := time.Now()
+	stats, err := sender.Run(ctx, tasks)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("returned after %s", d)
+	}
+
+	if stats.Sent != 1 || stats.Failed != 0 || stats.Pending() != 3 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	for _, task := range tasks[1:] {
+		if task.Sent || task.Err != nil {
+			t.Errorf("task attempted: %+v", task)
+		}
+	}
+}
+
+func TestSenderRunCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tasks := newTasks(nil, nil, 3)
+	stats, err := (&Sender{}).Run(ctx, tasks)
+	if !errors.Is(err, context.Canceled) || stats.Pending() != 3 {
+		t.Errorf("stats = %+v, err = %v", stats, err)
+	}
+}
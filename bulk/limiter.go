@@ -0,0 +1,106 @@
+package bulk
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter allows n events per period, as a token bucket initially full
+// and refilled continuously, so that bursts up to n are allowed.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	// now is the clock of the limiter, time.Now but in tests
+	now func() time.Time
+}
+
+// NewLimiter returns a limiter of n events per period, nil (no limit)
+// when n is not positive.
+func NewLimiter(n int, per time.Duration) *Limiter {
+	if n <= 0 || per <= 0 {
+		return nil
+	}
+
+	return &Limiter{
+		rate:   float64(n) / per.Seconds(),
+		burst:  float64(n),
+		tokens: float64(n),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// reserve takes n tokens, returning how long to wait before they are
+// available. The tokens are taken even if not available yet, so that
+// reservations are served in order.
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel gives back n reserved tokens.
+func (l *Limiter) cancel(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = min(l.burst, l.tokens+float64(n))
+}
+
+// Limits are the rate limits of an smtp server.
+type Limits struct {
+	Messages   *Limiter
+	Recipients *Limiter
+}
+
+// NewLimits returns the limits of a server accepting messagesPerMinute
+// messages and recipientsPerHour recipients, 0 meaning no limit.
+func NewLimits(messagesPerMinute int, recipientsPerHour int) *Limits {
+	return &Limits{
+		Messages:   NewLimiter(messagesPerMinute, time.Minute),
+		Recipients: NewLimiter(recipientsPerHour, time.Hour),
+	}
+}
+
+// Wait blocks until a message to the given number of recipients may be
+// sent, or ctx is done.
+func (l *Limits) Wait(ctx context.Context, recipients int) error {
+	if l == nil {
+		return ctx.Err()
+	}
+
+	delay := max(l.Messages.reserve(1), l.Recipients.reserve(recipients))
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.Messages.cancel(1)
+		l.Recipients.cancel(recipients)
+		return ctx.Err()
+	}
+}
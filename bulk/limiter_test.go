@@ -0,0 +1,116 @@
+package bulk
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock sets the clock of l to a time moved by the returned function.
+func fakeClock(l *Limiter) func(d time.Duration) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.last = now
+	l.now = func() time.Time { return now }
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLimiter(t *testing.T) {
+	// a message every 20s, bursts of 3
+	l := NewLimiter(3, time.Minute)
+	advance := fakeClock(l)
+	steps := []struct {
+		advance time.Duration
+		n       int
+		want    time.Duration
+	}{
+		{0, 1, 0},
+		{0, 1, 0},
+		{0, 1, 0},
+		{0, 1, 20 * time.Second},
+		// the tokens reserved are not given back
+		{0, 1, 40 * time.Second},
+		{40 * time.Second, 1, 20 * time.Second},
+		// refilled up to the burst
+		{time.Hour, 3, 0},
+		{time.Hour, 4, 20 * time.Second},
+	}
+
+	for i, step := range steps {
+		advance(step.advance)
+		if got := l.reserve(step.n); got != step.want {
+			t.Errorf("step %d: reserve(%d) = %s, want %s", i, step.n, got, step.want)
+		}
+	}
+
+	advance(time.Hour)
+	l.reserve(3)
+	l.cancel(2)
+	if got := l.reserve(2); got != 0 {
+		t.Errorf("reserve after cancel = %s, want 0", got)
+	}
+}
+
+func TestNoLimit(t *testing.T) {
+	if l := NewLimiter(0, time.Minute); l != nil || l.reserve(100) != 0 {
+		t.Error("limiter of 0 events limits")
+	}
+
+	var limits *Limits
+	for _, l := range []*Limits{limits, NewLimits(0, 0)} {
+		for i := 0; i < 100; i++ {
+			if err := l.Wait(context.Background(), 100); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestLimitsRecipientsPerHour(t *testing.T) {
+	limits := NewLimits(0, 10)
+	advance := fakeClock(limits.Recipients)
+	if err := limits.Wait(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next recipient is in 6 minutes
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limits.Wait(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+
+	// the recipient was given back
+	advance(6 * time.Minute)
+	if got := limits.Recipients.reserve(1); got != 0 {
+		t.Errorf("reserve = %s, want 0", got)
+	}
+}
+
+func TestLimitsMessagesPerMinute(t *testing.T) {
+	// a message every 50ms
+	limits := NewLimits(1200, 0)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limits.Wait(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the burst is a minute of messages
+	if d := time.Since(start); d > 40*time.Millisecond {
+		t.Errorf("burst waited %s", d)
+	}
+
+	limits = NewLimits(1200, 0)
+	limits.Wait(context.Background(), 1)
+	limits.Messages.tokens = 0
+	start = time.Now()
+	if err := limits.Wait(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("waited %s, want 50ms", d)
+	}
+}
@@ -0,0 +1,471 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/lifeym/she/config"
+	"github.com/spf13/cobra"
+)
+
+var (
+	_recipients     []string
+	_recipientsFile string
+	_armor          bool
+	_convertTo      string
+	_convertMessage bool
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the config file",
+}
+
+var configPathCmd = &cobra.Command{
+	Use:   "path",
+	Short: "Show the config files loaded",
+	Long: `Shows the config files loaded, lowest precedence first.
+
+They are the files given by --config, else those listed in SHE_CONFIG,
+else the existing ones of /etc/she/config.yaml,
+$XDG_CONFIG_HOME/she/config.yaml and the nearest .sendmail.yaml from the
+working directory up, each of which may be .yml, .json or .toml instead.
+Each file adds its smtp configs and accounts to the previous ones,
+replacing those of the same name. Relative paths of a file, such as key
+files or file: secrets, are relative to its directory.
+
+Their fields may then be set by environment variables, such as
+SHE_SMTP_<NAME>_HOST or SHE_ACCOUNT_<NAME>_PASSWORD, NAME being the name
+in upper case and the field its key in snake case. The smtp configs and
+accounts which are not defined by any file are added, so that they may
+be defined without config file.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		files, err := config.ConfigFiles(_configFiles)
+		if err != nil {
+			return err
+		}
+
+		if len(files) == 0 {
+			return config.ErrNoConfig
+		}
+
+		for _, f := range files {
+			fmt.Println(f)
+		}
+
+		return nil
+	},
+}
+
+var configEncryptCmd = &cobra.Command{
+	Use:   "encrypt [file]",
+	Short: "Encrypt the config file with age",
+	Long: `Encrypt the config file in place with age, the one of highest
+precedence by default, to the given recipients or with a passphrase
+when none is given.
+
+Encrypted config files are decrypted when read with the identities of
+the file named by SHE_AGE_IDENTITY, $XDG_CONFIG_HOME/she/age.key by
+default, or with the passphrase of SHE_AGE_PASSPHRASE, asked when not set.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filename, err := configFileArg(args)
+		if err != nil {
+			return err
+		}
+
+		return encryptConfig(filename)
+	},
+}
+
+var configDecryptCmd = &cobra.Command{
+	Use:          "decrypt [file]",
+	Short:        "Decrypt the config file in place",
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filename, err := configFileArg(args)
+		if err != nil {
+			return err
+		}
+
+		return decryptConfig(filename)
+	},
+}
+
+var configEditCmd = &cobra.Command{
+	Use:   "edit [file]",
+	Short: "Edit the config file with $EDITOR, encrypted again when it was",
+	Long: `Edit a decrypted copy of the config file with $EDITOR, written back
+encrypted the same way once it parses.
+
+A file encrypted to several recipients, or opened with an identity other
+than an age X25519 key, is encrypted again only to the recipients given
+by --recipient or --recipients-file, as those of the file are unknown.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filename, err := configFileArg(args)
+		if err != nil {
+			return err
+		}
+
+		return editConfig(filename)
+	},
+}
+
+var configConvertCmd = &cobra.Command{
+	Use:   "convert input [output]",
+	Short: "Convert a config or message file to yaml, json or toml",
+	Long: `Convert a config file, or a message file with --message, to the format
+of the output file told by its extension: .yaml or .yml, .json or .toml.
+Without output file, the file is written to the standard output in the
+format given by --to.
+
+Encrypted config files are written encrypted the same way, except to the
+standard output, or to the recipients given by --recipient or
+--recipients-file.`,
+	Example: `  she config convert .sendmail.yaml .sendmail.toml
+  she config convert --message --to json mails.yaml`,
+	Args:         cobra.RangeArgs(1, 2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, err := config.ParseFormat(_convertTo)
+		if err != nil {
+			return err
+		}
+
+		output := ""
+		if len(args) > 1 {
+			output = args[1]
+		}
+
+		if _convertMessage {
+			return convertMessageFile(args[0], output, format)
+		}
+
+		return convertConfig(args[0], output, format)
+	},
+}
+
+func init() {
+	configConvertCmd.Flags().StringVarP(&_convertTo, "to", "t", string(config.FormatYAML), `Format written to the standard output: yaml, json or toml.`)
+	configConvertCmd.Flags().BoolVarP(&_convertMessage, "message", "m", false, `Convert a message file instead of a config file.`)
+	for _, c := range []*cobra.Command{configEncryptCmd, configEditCmd, configConvertCmd} {
+		c.Flags().StringArrayVarP(&_recipients, "recipient", "r", nil, `Encrypt to this age public key, may be repeated.`)
+		c.Flags().StringVarP(&_recipientsFile, "recipients-file", "R", "", `Encrypt to the public keys listed in this file.`)
+	}
+
+	configEncryptCmd.Flags().BoolVarP(&_armor, "armor", "a", false, `Write the encrypted file as ASCII armor.`)
+	configCmd.AddCommand(configPathCmd, configEncryptCmd, configDecryptCmd, configEditCmd, configConvertCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+// loadConfig loads and merges the config files, see she config path.
+func loadConfig() (*config.AppConfig, error) {
+	files, err := config.ConfigFiles(_configFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.LoadConfigFiles(files)
+}
+
+// configFileArg returns the config file named by args, else the one of
+// highest precedence.
+func configFileArg(args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+
+	files, err := config.ConfigFiles(_configFiles)
+	if err != nil {
+		return "", err
+	}
+
+	if len(files) == 0 {
+		return "", config.ErrNoConfig
+	}
+
+	return files[len(files)-1], nil
+}
+
+// writeConfigFile replaces filename by data, readable by its owner only
+// as it holds credentials. A symbolic link is followed.
+func writeConfigFile(filename string, data []byte) error {
+	if target, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = target
+	}
+
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// flagRecipients returns the recipients given by --recipient and
+// --recipients-file.
+func flagRecipients() ([]string, error) {
+	recipients := _recipients
+	if _recipientsFile != "" {
+		fileRecipients, err := config.ReadRecipientsFile(_recipientsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = append(recipients, fileRecipients...)
+	}
+
+	return recipients, nil
+}
+
+// reencryption returns how a file encrypted with e is encrypted again:
+// to the recipients given by the flags if any, else as it was, which
+// fails when its recipients are unknown.
+func reencryption(filename string, e *config.Encryption) (*config.Encryption, error) {
+	if e == nil {
+		return nil, nil
+	}
+
+	recipients, err := flagRecipients()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(recipients) > 0 {
+		return e.WithRecipients(recipients)
+	}
+
+	if err = e.CanEncrypt(); err != nil {
+		return nil, fmt.Errorf("%s: %w with --recipient or --recipients-file", filename, err)
+	}
+
+	return e, nil
+}
+
+func encryptConfig(filename string) error {
+	plain, e, err := config.ReadConfigFile(filename)
+	if err != nil {
+		return err
+	}
+
+	if e != nil {
+		return fmt.Errorf("%s is encrypted already", filename)
+	}
+
+	if _, err = config.ParseConfig(plain, config.FormatOf(filename)); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	recipients, err := flagRecipients()
+	if err != nil {
+		return err
+	}
+
+	if len(recipients) > 0 {
+		e, err = config.NewRecipientEncryption(recipients, _armor)
+	} else {
+		e, err = newPassphraseEncryption()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := e.Encrypt(plain)
+	if err != nil {
+		return err
+	}
+
+	return writeConfigFile(filename, encrypted)
+}
+
+// newPassphraseEncryption asks for a new passphrase twice.
+func newPassphraseEncryption() (*config.Encryption, error) {
+	passphrase, err := config.ReadPassphrase("New passphrase:")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := os.LookupEnv("SHE_AGE_PASSPHRASE"); !ok {
+		confirm, err := config.ReadPassphrase("Confirm passphrase:")
+		if err != nil {
+			return nil, err
+		}
+
+		if confirm != passphrase {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+
+	return config.NewPassphraseEncryption(passphrase, _armor)
+}
+
+func decryptConfig(filename string) error {
+	plain, e, err := config.ReadConfigFile(filename)
+	if err != nil {
+		return err
+	}
+
+	if e == nil {
+		return fmt.Errorf("%s is not encrypted", filename)
+	}
+
+	return writeConfigFile(filename, plain)
+}
+
+// editConfig edits a decrypted copy of the config file, written back
+// encrypted once it parses.
+func editConfig(filename string) error {
+	plain, e, err := config.ReadConfigFile(filename)
+	if err != nil {
+		return err
+	}
+
+	// told before the changes are made
+	if e, err = reencryption(filename, e); err != nil {
+		return err
+	}
+
+	// named as the file for the editor to tell its format
+	tmp, err := os.CreateTemp("", "she-config-*."+string(config.FormatOf(filename)))
+	if err != nil {
+		return err
+	}
+
+	// the copy is plain text, never left behind
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(plain); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	for {
+		if err = runEditor(tmp.Name()); err != nil {
+			return err
+		}
+
+		edited, err := os.ReadFile(tmp.Name())
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(edited, plain) {
+			return nil
+		}
+
+		if _, err = config.ParseConfig(edited, config.FormatOf(filename)); err != nil {
+			if !confirm(fmt.Sprintf("%s: %s\nEdit again?", filename, err)) {
+				return errors.New("changes discarded")
+			}
+
+			continue
+		}
+
+		if e != nil {
+			if edited, err = e.Encrypt(edited); err != nil {
+				return err
+			}
+		}
+
+		return writeConfigFile(filename, edited)
+	}
+}
+
+// convertConfig converts the config file alone, the values of the
+// environment variables are not written to the output.
+func convertConfig(input string, output string, format config.Format) error {
+	plain, e, err := config.ReadConfigFile(input)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.ParseConfig(plain, config.FormatOf(input))
+	if err != nil {
+		return fmt.Errorf("%s: %w", input, err)
+	}
+
+	if output != "" {
+		if e, err = reencryption(input, e); err != nil {
+			return err
+		}
+
+		cfg.SetEncryption(e)
+		return cfg.SaveToFile(output)
+	}
+
+	s, err := cfg.ToString(format)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(s)
+	return nil
+}
+
+func convertMessageFile(input string, output string, format config.Format) error {
+	mf, err := config.LoadMessageFile(input)
+	if err != nil {
+		return err
+	}
+
+	if output != "" {
+		return mf.SaveToFile(output)
+	}
+
+	s, err := mf.ToString(format)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(s)
+	return nil
+}
+
+func runEditor(filename string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// the editor may come with arguments, such as "code --wait"
+	c := exec.Command("sh", "-c", editor+` "$1"`, "sh", filename)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	return c.Run()
+}
+
+// confirm asks a yes or no question, no unless answered.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	var answer string
+	if _, err := fmt.Scanln(&answer); err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(strings.ToLower(answer), "y")
+}
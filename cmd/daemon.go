@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lifeym/she/config"
+	"github.com/lifeym/she/queue"
+	"github.com/lifeym/she/schedule"
+	"github.com/spf13/cobra"
+)
+
+var _tick time.Duration
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Send the scheduled mails when due and deliver the outbound queue",
+	Long: `Keep running until interrupted, sending the mails scheduled by send --at, --in
+or the schedule of a mail when they are due. Templates are rendered when a mail
+is sent, the resulting messages go through the outbound queue, which is
+delivered by the daemon as well.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runDaemon(_tick)
+	},
+}
+
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Manage the mails scheduled by send --at, --in or a mail schedule",
+}
+
+var scheduleListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List scheduled mails",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return listSchedule(os.Stdout)
+	},
+}
+
+var scheduleDropCmd = &cobra.Command{
+	Use:          "drop id...",
+	Short:        "Remove scheduled mails",
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return dropScheduled(args)
+	},
+}
+
+func init() {
+	daemonCmd.Flags().DurationVarP(&_tick, "interval", "i", time.Minute, `Check the schedule and the queue at least at this interval.`)
+	daemonCmd.Flags().IntVar(&_maxAttempts, "max-attempts", queue.DefaultMaxAttempts, `Attempts before a message is moved to failed.`)
+	scheduleCmd.AddCommand(scheduleListCmd, scheduleDropCmd)
+	rootCmd.AddCommand(daemonCmd, scheduleCmd)
+}
+
+func loadSchedule() (*config.AppConfig, string, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, "", err
+	}
+
+	path, err := cfg.ScheduleFile()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return cfg, path, nil
+}
+
+// scheduleMail adds the given mail to the schedule instead of sending it.
+func scheduleMail(cfg *config.AppConfig, msgFile *config.MessageFile, accountRef string, mailRef string, msgPath string, spec string) error {
+	if msgFile.GetMail(mailRef) == nil {
+		return fmt.Errorf("mail definition not found: %s", mailRef)
+	}
+
+	path, err := cfg.ScheduleFile()
+	if err != nil {
+		return err
+	}
+
+	job, err := schedule.NewJob(accountRef, msgPath, mailRef, spec, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if job.NextRun.IsZero() {
+		return fmt.Errorf("schedule: %s never runs", spec)
+	}
+
+	for _, f := range cfg.Files() {
+		if f, err = filepath.Abs(f); err != nil {
+			return err
+		}
+
+		job.ConfigFiles = append(job.ConfigFiles, f)
+	}
+
+	if err = schedule.Update(path, func(s *schedule.Store) error { return s.Add(job) }); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "scheduled %s at %s\n", job.ID, job.NextRun.Format(time.DateTime))
+	return nil
+}
+
+// runJob renders the mail of job with the config files it was scheduled
+// with, as if sent from its working directory, and adds the messages to
+// q.
+func runJob(job *schedule.Job, q *queue.Queue) error {
+	files := job.ConfigFiles
+	if len(files) == 0 {
+		// scheduled without config file, or before they were recorded
+		var err error
+		if files, err = config.ConfigFilesIn(_configFiles, job.WorkDir); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := config.LoadConfigFiles(files)
+	if err != nil {
+		return err
+	}
+
+	msgFile, err := config.LoadMessageFile(job.MessageFile)
+	if err != nil {
+		return err
+	}
+
+	msgFile.SetWorkDir(job.WorkDir)
+	return sendMail(cfg, msgFile, job.Account, []string{job.Mail}, job.MessageFile, q)
+}
+
+// runDueJobs runs the jobs due at now. Their next run is stored before
+// they run, so that the daemon stopping meanwhile does not send them
+// twice, and the errors of those which failed after.
+func runDueJobs(path string, q *queue.Queue, logger *log.Logger) error {
+	now := time.Now()
+	var due []schedule.Job
+	err := schedule.Update(path, func(s *schedule.Store) error {
+		due = s.Take(now)
+		return nil
+	})
+
+	if err != nil || len(due) == 0 {
+		return err
+	}
+
+	results := make(map[string]error)
+	for _, job := range due {
+		err := runJob(&job, q)
+		if err != nil {
+			logger.Printf("schedule: %s: %s", job.ID, err)
+			results[job.ID] = err
+		} else {
+			logger.Printf("schedule: %s: mail %s queued", job.ID, job.Mail)
+		}
+	}
+
+	if len(results) == 0 {
+		return nil
+	}
+
+	// a job which will not run again is gone, its error only logged
+	return schedule.Update(path, func(s *schedule.Store) error {
+		for id, runErr := range results {
+			if job, err := s.Get(id); err == nil {
+				job.LastError = runErr.Error()
+			}
+		}
+
+		return nil
+	})
+}
+
+func runDaemon(interval time.Duration) error {
+	cfg, path, err := loadSchedule()
+	if err != nil {
+		return err
+	}
+
+	q, err := openQueue(cfg)
+	if err != nil {
+		return err
+	}
+
+	j, err := openJournal(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer j.Close()
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	runner := newRunner(cfg, q, j, logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for {
+		if err = runDueJobs(path, q, logger); err != nil {
+			logger.Printf("schedule: %s", err)
+		}
+
+		if _, err = runner.Run(ctx); err != nil && ctx.Err() == nil {
+			logger.Printf("queue: %s", err)
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		wait := interval
+		if store, err := schedule.Load(path); err == nil {
+			if next := store.NextRun(); !next.IsZero() {
+				wait = min(wait, max(time.Until(next), 0))
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func listSchedule(w io.Writer) error {
+	_, path, err := loadSchedule()
+	if err != nil {
+		return err
+	}
+
+	store, err := schedule.Load(path)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNEXT RUN\tCRON\tACCOUNT\tMAIL\tMESSAGE FILE\tLAST ERROR")
+	for _, job := range store.Jobs {
+		cron := job.Cron
+		if cron == "" {
+			cron = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", job.ID, job.NextRun.Format(time.DateTime), cron,
+			job.Account, job.Mail, job.MessageFile, firstLine(job.LastError))
+	}
+
+	return tw.Flush()
+}
+
+func dropScheduled(ids []string) error {
+	_, path, err := loadSchedule()
+	if err != nil {
+		return err
+	}
+
+	return schedule.Update(path, func(s *schedule.Store) error {
+		for _, id := range ids {
+			if err := s.Remove(id); err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lifeym/she/journal"
+	"github.com/spf13/cobra"
+)
+
+var (
+	_historyMail  string
+	_historyTo    string
+	_historySince time.Duration
+	_historyLast  int
+	_historyJSON  bool
+)
+
+var historyCmd = &cobra.Command{
+	Use:          "history",
+	Short:        "Show the messages recorded as sent in the journal",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return showHistory(os.Stdout)
+	},
+}
+
+func init() {
+	historyCmd.Flags().StringVarP(&_historyMail, "message", "m", "", `Only show the messages of this mail.`)
+	historyCmd.Flags().StringVar(&_historyTo, "to", "", `Only show the messages to recipients containing this.`)
+	historyCmd.Flags().DurationVar(&_historySince, "since", 0, `Only show the messages sent within this duration.`)
+	historyCmd.Flags().IntVarP(&_historyLast, "last", "n", 0, `Only show this many most recent messages.`)
+	historyCmd.Flags().BoolVar(&_historyJSON, "json", false, `Print the entries as JSON lines.`)
+	rootCmd.AddCommand(historyCmd)
+}
+
+func historyMatches(e *journal.Entry, since time.Time) bool {
+	if _historyMail != "" && e.Mail != _historyMail {
+		return false
+	}
+
+	if !since.IsZero() && e.SentAt.Before(since) {
+		return false
+	}
+
+	if _historyTo == "" {
+		return true
+	}
+
+	for _, to := range e.To {
+		if strings.Contains(strings.ToLower(to), strings.ToLower(_historyTo)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func showHistory(w io.Writer) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	path, err := cfg.JournalFile()
+	if err != nil {
+		return err
+	}
+
+	entries, err := journal.Read(path)
+	if err != nil {
+		return err
+	}
+
+	var since time.Time
+	if _historySince > 0 {
+		since = time.Now().Add(-_historySince)
+	}
+
+	var result []*journal.Entry
+	for _, e := range entries {
+		if historyMatches(e, since) {
+			result = append(result, e)
+		}
+	}
+
+	if _historyLast > 0 && len(result) > _historyLast {
+		result = result[len(result)-_historyLast:]
+	}
+
+	if _historyJSON {
+		enc := json.NewEncoder(w)
+		for _, e := range result {
+			if err = enc.Encode(e); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SENT AT\tACCOUNT\tMAIL\tKEY\tTO\tSUBJECT\tMESSAGE-ID\tREPLY")
+	for _, e := range result {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.SentAt.Format(time.DateTime), e.Account, e.Mail,
+			e.Key, strings.Join(e.To, ","), e.Subject, e.MessageID, e.Reply)
+	}
+
+	return tw.Flush()
+}
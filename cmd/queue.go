@@ -0,0 +1,359 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lifeym/she/config"
+	"github.com/lifeym/she/journal"
+	"github.com/lifeym/she/queue"
+	"github.com/spf13/cobra"
+)
+
+var (
+	_interval    time.Duration
+	_maxAttempts int
+	_withFailed  bool
+)
+
+var queueCmd = &cobra.Command{
+	Use:   "queue",
+	Short: "Manage the outbound queue filled by send --queue",
+}
+
+var queueRunCmd = &cobra.Command{
+	Use:          "run",
+	Short:        "Deliver the queued messages which are due",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runQueue(false, _interval)
+	},
+}
+
+var queueFlushCmd = &cobra.Command{
+	Use:          "flush",
+	Short:        "Deliver every queued message now, ignoring retry delays",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _withFailed {
+			if err := requeueFailed(); err != nil {
+				return err
+			}
+		}
+
+		return runQueue(true, 0)
+	},
+}
+
+var queueListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List queued messages",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return listQueue(os.Stdout)
+	},
+}
+
+var queueShowCmd = &cobra.Command{
+	Use:          "show id",
+	Short:        "Show a queued message with its delivery state",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return showQueueItem(os.Stdout, args[0])
+	},
+}
+
+var queueDropCmd = &cobra.Command{
+	Use:          "drop id...",
+	Short:        "Remove messages from the queue",
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return dropQueueItems(args)
+	},
+}
+
+func init() {
+	queueRunCmd.Flags().DurationVarP(&_interval, "interval", "i", 0, `Keep running, checking the queue at this interval, until interrupted.`)
+	for _, c := range []*cobra.Command{queueRunCmd, queueFlushCmd} {
+		c.Flags().IntVar(&_maxAttempts, "max-attempts", queue.DefaultMaxAttempts, `Attempts before a message is moved to failed.`)
+	}
+
+	queueFlushCmd.Flags().BoolVar(&_withFailed, "failed", false, `Retry failed messages too.`)
+	queueCmd.AddCommand(queueRunCmd, queueFlushCmd, queueListCmd, queueShowCmd, queueDropCmd)
+	rootCmd.AddCommand(queueCmd)
+}
+
+func openQueue(cfg *config.AppConfig) (*queue.Queue, error) {
+	dir, err := cfg.QueueDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	return queue.Open(dir)
+}
+
+func loadQueue() (*config.AppConfig, *queue.Queue, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	q, err := openQueue(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cfg, q, nil
+}
+
+// enqueueMessage renders the message of o into q, to be delivered with
+// the account named accountRef.
+func enqueueMessage(q *queue.Queue, accountRef string, msgPath string, o *outgoing) error {
+	from, to, err := o.msg.Envelope()
+	if err != nil {
+		return err
+	}
+
+	item := queue.Item{
+		Account:     accountRef,
+		From:        from,
+		To:          to,
+		Subject:     o.msg.GetHeader("subject"),
+		MessageID:   o.msg.GetHeader("message-id"),
+		MessageFile: msgPath,
+		Mail:        o.mail,
+		Key:         o.key,
+	}
+
+	if err = q.Enqueue(&item, o.msg); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "queued %s\n", item.ID)
+	return nil
+}
+
+// accountCache compiles each account once for a queue run.
+type accountCache struct {
+	cfg      *config.AppConfig
+	mu       sync.Mutex
+	accounts map[string]*config.CompiledMail
+}
+
+func (ac *accountCache) get(name string) (*config.CompiledMail, error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if cm, ok := ac.accounts[name]; ok {
+		return cm, nil
+	}
+
+	cm, err := config.CompileAccount(ac.cfg, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ac.accounts[name] = cm
+	return cm, nil
+}
+
+// newRunner returns a runner delivering the items of q with the accounts
+// of cfg, recording them in the journal j.
+func newRunner(cfg *config.AppConfig, q *queue.Queue, j *journal.Journal, logger *log.Logger) *queue.Runner {
+	accounts := accountCache{cfg: cfg, accounts: make(map[string]*config.CompiledMail)}
+	return &queue.Runner{
+		Queue: q,
+		Deliver: func(item *queue.Item, msg io.WriterTo) error {
+			cm, err := accounts.get(item.Account)
+			if err != nil {
+				return err
+			}
+
+			reply, err := cm.NewSmtpAuth().SendRaw(item.From, item.To, msg)
+			if err != nil {
+				return err
+			}
+
+			// delivered, failing to record it must not deliver it again
+			err = j.Add(&journal.Entry{
+				MessageFile: item.MessageFile,
+				Mail:        item.Mail,
+				Key:         item.Key,
+				Account:     item.Account,
+				MessageID:   item.MessageID,
+				From:        item.From,
+				To:          item.To,
+				Subject:     item.Subject,
+				SentAt:      time.Now(),
+				Reply:       reply,
+			})
+
+			if err != nil {
+				logger.Printf("queue: cannot record %s in the journal: %s", item.ID, err)
+			}
+
+			return nil
+		},
+		Concurrency: func(account string) int {
+			cm, err := accounts.get(account)
+			if err != nil {
+				return 1
+			}
+
+			return cm.Concurrency
+		},
+		MaxAttempts: _maxAttempts,
+		Logger:      logger,
+	}
+}
+
+func runQueue(force bool, interval time.Duration) error {
+	cfg, q, err := loadQueue()
+	if err != nil {
+		return err
+	}
+
+	j, err := openJournal(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer j.Close()
+	runner := newRunner(cfg, q, j, log.New(os.Stderr, "", log.LstdFlags))
+	runner.Force = force
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for {
+		stats, err := runner.Run(ctx)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "delivered %d, deferred %d, failed %d\n", stats.Delivered, stats.Deferred, stats.Failed)
+		if interval <= 0 || ctx.Err() != nil {
+			return nil
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func requeueFailed() error {
+	_, q, err := loadQueue()
+	if err != nil {
+		return err
+	}
+
+	items, err := q.List(queue.StateFailed)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err = q.Requeue(item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func listQueue(w io.Writer) error {
+	_, q, err := loadQueue()
+	if err != nil {
+		return err
+	}
+
+	items, err := q.List()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tATTEMPTS\tNEXT ATTEMPT\tACCOUNT\tTO\tSUBJECT\tLAST ERROR")
+	for _, item := range items {
+		next := "-"
+		if item.State == queue.StatePending {
+			next = item.NextAttempt.Format(time.DateTime)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", item.ID, item.State, item.Attempts, next,
+			item.Account, strings.Join(item.To, ","), item.Subject, firstLine(item.LastError))
+	}
+
+	return tw.Flush()
+}
+
+func showQueueItem(w io.Writer, id string) error {
+	_, q, err := loadQueue()
+	if err != nil {
+		return err
+	}
+
+	item, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(struct {
+		*queue.Item
+		State string `json:"state"`
+	}{item, item.State}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s\n\n", b)
+	f, err := q.OpenMessage(item)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func dropQueueItems(ids []string) error {
+	_, q, err := loadQueue()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		item, err := q.Get(id)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+
+		if err = q.Drop(item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
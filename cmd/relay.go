@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/lifeym/she/config"
+	"github.com/lifeym/she/journal"
+	shemail "github.com/lifeym/she/mail"
+	"github.com/lifeym/she/relay"
+	"github.com/spf13/cobra"
+)
+
+const defaultRelayListen = "127.0.0.1:2525"
+
+var _listen string
+
+var relayCmd = &cobra.Command{
+	Use:     "relay",
+	Aliases: []string{"serve"},
+	Short:   "Listen for smtp clients and relay their mails through configured accounts",
+	Long: `Runs a local smtp server, messages received are relayed through
+the account mapped to their envelope sender by the relay section of
+the config, the account whose default from address is the sender,
+or the fallback account of the relay section. Messages of other
+senders are rejected.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return serveRelay(_listen)
+	},
+}
+
+func init() {
+	relayCmd.Flags().StringVarP(&_listen, "listen", "l", "", `Address to listen on, overrides relay.listen of config file.`)
+	rootCmd.AddCommand(relayCmd)
+}
+
+func serveRelay(listen string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	rc := cfg.Relay
+	if rc == nil {
+		rc = &config.RelayConfig{}
+	}
+
+	srv := relay.Server{Addr: defaultRelayListen}
+	if rc.Listen != "" {
+		srv.Addr = rc.Listen
+	}
+
+	if listen != "" {
+		srv.Addr = listen
+	}
+
+	if srv.AllowNetworks, err = relay.ParseNetworks(rc.AllowNetworks); err != nil {
+		return err
+	}
+
+	if srv.MaxMessageSize, err = rc.MaxSize(); err != nil {
+		return err
+	}
+
+	if rc.CertFile != "" || rc.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(rc.CertFile, rc.KeyFile)
+		if err != nil {
+			return fmt.Errorf("cannot load relay certificate: %w", err)
+		}
+
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if len(rc.Users) > 0 {
+		users := rc.Users
+		srv.Authenticate = func(user string, password string) bool {
+			for _, u := range users {
+				if u.User == user && subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1 {
+					return true
+				}
+			}
+
+			return false
+		}
+	}
+
+	j, err := openJournal(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer j.Close()
+	srv.Handler = func(env *relay.Envelope) error {
+		return relayEnvelope(cfg, j, env)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Printf("relay: listening on %s", srv.Addr)
+	err = srv.ListenAndServe()
+	if errors.Is(err, relay.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// relayEnvelope forwards a received message through the account mapped
+// to its envelope sender, and records it in the journal j.
+func relayEnvelope(cfg *config.AppConfig, j *journal.Journal, env *relay.Envelope) error {
+	accountName := cfg.RelayAccount(env.From)
+	if accountName == "" {
+		return &relay.Error{Code: 550, Message: "5.7.1 No account to relay mails of " + env.From}
+	}
+
+	compiledMail, err := config.CompileAccount(cfg, accountName)
+	if err != nil {
+		return err
+	}
+
+	msg, err := shemail.ReadRawMessage(bytes.NewReader(env.Data))
+	if err != nil {
+		return &relay.Error{Code: 554, Message: "5.6.0 " + err.Error()}
+	}
+
+	// bounces have a null sender, the account address is used instead
+	sender := env.From
+	if sender == "" {
+		from, err := mail.ParseAddress(compiledMail.DefaultFrom)
+		if err != nil {
+			return fmt.Errorf("invalid default from of account %s: %w", accountName, err)
+		}
+
+		sender = from.Address
+	}
+
+	smtp := compiledMail.NewSmtpAuth()
+	reply, err := smtp.SendRaw(sender, env.To, msg)
+	if err != nil {
+		return err
+	}
+
+	if err = j.Add(rawEntry(accountName, sender, env.To, msg, reply)); err != nil {
+		log.Printf("relay: cannot record the message in the journal: %s", err)
+	}
+
+	log.Printf("relay: %s -> %v relayed through account %s", sender, env.To, accountName)
+	return nil
+}
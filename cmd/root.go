@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"os"
+	"path/filepath"
+
 	"github.com/spf13/cobra"
 )
 
@@ -19,7 +22,10 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+var _configFiles []string
+
 func init() {
+	rootCmd.PersistentFlags().StringArrayVar(&_configFiles, "config", nil, `Config file to use instead of the discovered ones, may be repeated to merge several, see she config path.`)
 	// rootCmd.PersistentFlags().StringVarP(&_driverName, "driver", "d", "", `database type to be connected, run hare -h database for more details.`)
 	// rootCmd.PersistentFlags().StringVarP(&_dsn, "datasource", "s", "", `datasource url for connecting to a database, run hare -h database for more  details.`)
 	// rootCmd.Flags().StringVarP(&_output, "output", "o", "", `output file name of generated results(use standard output by default)`)
@@ -29,8 +35,13 @@ func init() {
 	// rootCmd.PersistentFlags().StringArrayVarP(&_var, "var", "v", nil, `var=value`)
 }
 
-// Execute cmd.
+// Execute cmd, the sendmail command is run when the binary is invoked
+// as sendmail.
 func Execute() error {
+	if filepath.Base(os.Args[0]) == "sendmail" {
+		rootCmd.SetArgs(append([]string{sendmailCmd.Name()}, os.Args[1:]...))
+	}
+
 	return rootCmd.Execute()
 }
 
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/lifeym/she/config"
+	"github.com/spf13/cobra"
+)
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema config|message",
+	Short: "Print the JSON Schema of config or message files",
+	Long: `Prints the JSON Schema of config files or of message files, for
+editors to complete and check them, such as VS Code with the YAML
+extension:
+
+  she schema config > she-config.schema.json
+
+and in .vscode/settings.json:
+
+  "yaml.schemas": {"./she-config.schema.json": ".sendmail.yaml"}
+
+she validate checks the files against the same schemas.`,
+	Args:         cobra.ExactArgs(1),
+	ValidArgs:    []string{"config", "message"},
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var schema *config.Schema
+		switch args[0] {
+		case "config":
+			schema = config.ConfigSchema()
+		case "message":
+			schema = config.MessageSchema()
+		default:
+			return fmt.Errorf("unknown schema: %s, expecting config or message", args[0])
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(schema)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+}
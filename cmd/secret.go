@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/lifeym/she/config"
+	"github.com/spf13/cobra"
+)
+
+var secretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Manage the keyring holding the secrets referred to as keyring:name",
+}
+
+var secretSetCmd = &cobra.Command{
+	Use:          "set name",
+	Short:        "Store a secret read from stdin",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setSecret(os.Stdin, args[0])
+	},
+}
+
+var secretDeleteCmd = &cobra.Command{
+	Use:          "delete name...",
+	Short:        "Remove secrets from the keyring",
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyring, err := config.OpenKeyring()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range args {
+			if err = keyring.Delete(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
+
+var secretListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List the names of the stored secrets",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyring, err := config.OpenKeyring()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range keyring.Names() {
+			fmt.Println(name)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	secretCmd.AddCommand(secretSetCmd, secretDeleteCmd, secretListCmd)
+	rootCmd.AddCommand(secretCmd)
+}
+
+// setSecret stores the first line read from r as name, so that the
+// secret is neither an argument nor in the shell history.
+func setSecret(r io.Reader, name string) error {
+	keyring, err := config.OpenKeyring()
+	if err != nil {
+		return err
+	}
+
+	if f, ok := r.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			fmt.Fprintf(os.Stderr, "Secret for %s: ", name)
+		}
+	}
+
+	secret, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	secret = strings.TrimRight(secret, "\r\n")
+	if secret == "" {
+		return fmt.Errorf("empty secret for %s", name)
+	}
+
+	return keyring.Set(name, secret)
+}
@@ -1,11 +1,21 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/lifeym/she/bulk"
 	"github.com/lifeym/she/config"
+	"github.com/lifeym/she/journal"
 	"github.com/lifeym/she/mail"
+	"github.com/lifeym/she/queue"
 	"github.com/spf13/cobra"
 )
 
@@ -14,6 +24,11 @@ var (
 	_mail    string
 	_config  string
 	_print   bool
+	_queue   bool
+	_at      string
+	_in      time.Duration
+	_workers int
+	_resume  bool
 )
 
 var sendCmd = &cobra.Command{
@@ -37,6 +52,12 @@ func init() {
 	sendCmd.Flags().StringVarP(&_mail, "message", "m", "", `Message names in message file to be sent, default to all.`)
 	sendCmd.Flags().StringVarP(&_config, "message-file", "f", "", `Mail message config file.`)
 	sendCmd.Flags().BoolVarP(&_print, "print", "p", false, `Print mail message content to stdout.`)
+	sendCmd.Flags().BoolVarP(&_queue, "queue", "q", false, `Add messages to the outbound queue instead of sending them, see she queue.`)
+	sendCmd.Flags().StringVar(&_at, "at", "", `Schedule the message at this time ("2024-05-01 08:30", "08:30") or cron expression instead of sending it now, see she daemon.`)
+	sendCmd.Flags().DurationVar(&_in, "in", 0, `Schedule the message after this delay instead of sending it now, see she daemon.`)
+	sendCmd.Flags().IntVarP(&_workers, "workers", "w", 0, `Messages sent at once, default to the account concurrency.`)
+	sendCmd.Flags().BoolVar(&_resume, "resume", false, `Skip the messages recorded as sent in the journal, see she history.`)
+	sendCmd.MarkFlagsMutuallyExclusive("at", "in")
 	sendCmd.MarkFlagRequired("account")
 	// sendCmd.MarkFlagRequired("mail")
 	sendCmd.MarkFlagRequired("config")
@@ -50,48 +71,339 @@ func init() {
 }
 
 func send(accountRef string, mailRef string, cfgPath string) error {
-	cfg, err := config.LoadConfigFile(".sendmail.yaml")
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
 
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+
 	msgFile, err := config.LoadMessageFile(cfgPath)
 	if err != nil {
 		return err
 	}
 
-	var compiledMail *config.CompiledMail
-	if compiledMail, err = config.CompileMail(cfg, msgFile, accountRef, mailRef); err != nil {
+	if err = msgFile.Validate(); err != nil {
 		return err
 	}
 
-	if compiledMail.Message.GetHeader("from") == "" {
-		return fmt.Errorf("mail: header missing or empty -- %s", "from")
+	at := _at
+	if _in > 0 {
+		at = time.Now().Add(_in).Format(time.RFC3339)
 	}
 
-	if compiledMail.Message.GetHeader("to") == "" {
-		return fmt.Errorf("mail: header missing or empty -- %s", "to")
+	// the mails with a schedule are scheduled, the others sent now
+	var names []string
+	for _, name := range mailNames(msgFile, mailRef) {
+		spec := at
+		if mc := msgFile.GetMail(name); spec == "" && mc != nil {
+			spec = mc.Schedule
+		}
+
+		if spec == "" {
+			names = append(names, name)
+			continue
+		}
+
+		if err = scheduleMail(cfg, msgFile, accountRef, name, cfgPath, spec); err != nil {
+			return err
+		}
 	}
 
-	// date
-	if compiledMail.Message.GetHeader("date") == "" {
-		compiledMail.Message.SetHeader("date", time.Now().Format(time.RFC1123Z))
+	if len(names) == 0 {
+		return nil
 	}
 
-	if _print {
-		msgData, err := compiledMail.Message.ToBytes()
+	var q *queue.Queue
+	if _queue {
+		if q, err = openQueue(cfg); err != nil {
+			return err
+		}
+	}
+
+	return sendMail(cfg, msgFile, accountRef, names, cfgPath, q)
+}
+
+// mailNames returns the mails of msgFile named by mailRef, all of them
+// when empty.
+func mailNames(msgFile *config.MessageFile, mailRef string) []string {
+	if mailRef != "" {
+		return []string{mailRef}
+	}
+
+	var result []string
+	for _, mc := range msgFile.Mails {
+		result = append(result, mc.Name)
+	}
+
+	return result
+}
+
+// outgoing is a compiled message with what identifies it in the journal.
+type outgoing struct {
+	mail string
+	key  string
+	msg  *mail.Message
+}
+
+// sendMail compiles and sends the mails of the message file at msgPath
+// named names, or adds them to q when set.
+func sendMail(cfg *config.AppConfig, msgFile *config.MessageFile, accountRef string, names []string, msgPath string, q *queue.Queue) error {
+	j, err := openJournal(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer j.Close()
+	if msgPath, err = filepath.Abs(msgPath); err != nil {
+		return err
+	}
+
+	// messages queued but not delivered yet may start a thread
+	var queued []*queue.Item
+	if q != nil {
+		if queued, err = q.List(queue.StatePending, queue.StateSending); err != nil {
+			return err
+		}
+	}
+
+	var account *config.CompiledMail
+	var msgs []*outgoing
+	for _, name := range names {
+		compiledMail, err := config.CompileMail(cfg, msgFile, accountRef, name)
 		if err != nil {
-			return nil
+			return err
+		}
+
+		roots := threadRoots{journal: j, msgPath: msgPath, key: compiledMail.Key, msgs: msgs, queued: queued}
+		inReplyTo, err := roots.id(compiledMail.InReplyTo)
+		if err != nil {
+			return err
+		}
+
+		var references []string
+		for _, ref := range compiledMail.References {
+			id, err := roots.id(ref)
+			if err != nil {
+				return err
+			}
+
+			references = append(references, id)
 		}
 
-		fmt.Println(string(msgData))
+		parts := compiledMail.Messages()
+		for i, msg := range parts {
+			msg.SetThread(inReplyTo, references)
+			if err = msg.SetMessageID(compiledMail.MessageIDDomain); err != nil {
+				return err
+			}
+
+			if err = prepareMessage(msg); err != nil {
+				return err
+			}
+
+			if err = compiledMail.CheckSize(msg); err != nil {
+				return err
+			}
+
+			key := compiledMail.Key
+			if len(parts) > 1 {
+				key = fmt.Sprintf("%s#%d", key, i+1)
+			}
+
+			msgs = append(msgs, &outgoing{mail: name, key: key, msg: msg})
+		}
+
+		account = compiledMail
 	}
 
-	smtp := mail.New(compiledMail.LoginUser, compiledMail.Password, compiledMail.Smtp.Host, compiledMail.Smtp.Port, compiledMail.Smtp.StartTLS)
-	err = smtp.Send(compiledMail.Message)
+	if _resume {
+		msgs = slices.DeleteFunc(msgs, func(o *outgoing) bool {
+			if j.Sent(msgPath, o.key) {
+				fmt.Fprintf(os.Stderr, "skipped %s, already sent\n", o.key)
+				return true
+			}
+
+			return false
+		})
+	}
+
+	if q != nil {
+		for _, o := range msgs {
+			if err := enqueueMessage(q, accountRef, msgPath, o); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return sendBulk(account, accountRef, msgPath, j, msgs)
+}
+
+// threadRoots resolves the thread references of the mails of the
+// message file at msgPath.
+type threadRoots struct {
+	journal *journal.Journal
+	msgPath string
+	// key of the mail resolved, which starts the thread it refers to
+	// when none was sent yet
+	key string
+	// msgs are the messages compiled before in the same run
+	msgs   []*outgoing
+	queued []*queue.Item
+}
+
+// id returns the message id referred to by ref: a message id is kept, a
+// mail key stands for the first message sent with it, or with the first
+// part of it when it was split. The message may have been delivered,
+// queued, or compiled before in the same run, an error is returned if it
+// is none of those but for the key of the mail itself.
+func (tr *threadRoots) id(ref string) (string, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "<") {
+		return ref, nil
+	}
+
+	if root := tr.journal.Root(tr.msgPath, ref); root != nil {
+		return root.MessageID, nil
+	}
+
+	keys := []string{ref, ref + "#1"}
+	for _, item := range tr.queued {
+		if item.MessageFile == tr.msgPath && slices.Contains(keys, item.Key) {
+			return item.MessageID, nil
+		}
+	}
+
+	for _, o := range tr.msgs {
+		if slices.Contains(keys, o.key) {
+			return o.msg.GetHeader("message-id"), nil
+		}
+	}
+
+	if ref == tr.key {
+		return "", nil
+	}
+
+	return "", fmt.Errorf("thread: no message sent with key %s yet", ref)
+}
+
+// sendBulk sends msgs with the account compiled in cm, spread across
+// workers sharing pooled connections, within the smtp rate limits, and
+// records them in j. On interrupt the messages being sent are finished,
+// the others are not.
+func sendBulk(cm *config.CompiledMail, accountRef string, msgPath string, j *journal.Journal, msgs []*outgoing) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	workers := _workers
+	if workers <= 0 {
+		workers = cm.Concurrency
+	}
+
+	pool := cm.NewSmtpAuth().NewPool(workers)
+	defer pool.Close()
+	limits := bulk.NewLimits(cm.Smtp.MessagesPerMinute, cm.Smtp.RecipientsPerHour)
+	tasks := make([]*bulk.Task, len(msgs))
+	byTask := make(map[*bulk.Task]*outgoing, len(msgs))
+	for i, o := range msgs {
+		tasks[i] = &bulk.Task{Message: o.msg, Pool: pool, Limits: limits}
+		byTask[tasks[i]] = o
+	}
+
+	sender := bulk.Sender{Workers: workers}
+	sender.Progress = func(task *bulk.Task, stats bulk.Stats) {
+		if task.Sent {
+			if err := recordSent(j, accountRef, msgPath, byTask[task], task.Reply); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot record %s in the journal: %s\n", byTask[task].key, err)
+			}
+		}
+
+		if stats.Total == 1 {
+			return
+		}
+
+		status := "sent"
+		if task.Err != nil {
+			status = fmt.Sprintf("failed: %s", task.Err)
+		}
+
+		fmt.Fprintf(os.Stderr, "[%d/%d] %s to %s: %s\n", stats.Sent+stats.Failed, stats.Total,
+			task.Message.GetHeader("subject"), task.Message.GetHeader("to"), status)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stats, err := sender.Run(ctx, tasks)
+	if len(tasks) == 1 && tasks[0].Err != nil {
+		return tasks[0].Err
+	}
+
+	if stats.Failed > 0 || err != nil {
+		fmt.Fprintf(os.Stderr, "sent %d, failed %d, not sent %d\n", stats.Sent, stats.Failed, stats.Pending())
+		return fmt.Errorf("%d of %d messages not sent, run again with --resume to send them only", stats.Total-stats.Sent, stats.Total)
+	}
+
+	return nil
+}
+
+// openJournal opens the send journal of cfg.
+func openJournal(cfg *config.AppConfig) (*journal.Journal, error) {
+	path, err := cfg.JournalFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return journal.Open(path)
+}
+
+func recordSent(j *journal.Journal, accountRef string, msgPath string, o *outgoing, reply string) error {
+	from, to, err := o.msg.Envelope()
 	if err != nil {
 		return err
 	}
 
+	return j.Add(&journal.Entry{
+		MessageFile: msgPath,
+		Mail:        o.mail,
+		Key:         o.key,
+		Account:     accountRef,
+		MessageID:   o.msg.GetHeader("message-id"),
+		From:        from,
+		To:          to,
+		Subject:     o.msg.GetHeader("subject"),
+		SentAt:      time.Now(),
+		Reply:       reply,
+	})
+}
+
+// prepareMessage checks the headers of msg, setting its date, and prints
+// it when asked to.
+func prepareMessage(msg *mail.Message) error {
+	if msg.GetHeader("from") == "" {
+		return fmt.Errorf("mail: header missing or empty -- %s", "from")
+	}
+
+	if msg.GetHeader("to") == "" {
+		return fmt.Errorf("mail: header missing or empty -- %s", "to")
+	}
+
+	// date
+	if msg.GetHeader("date") == "" {
+		msg.SetHeader("date", time.Now().Format(time.RFC1123Z))
+	}
+
+	if _print {
+		if _, err := msg.WriteTo(os.Stdout); err != nil {
+			return err
+		}
+
+		fmt.Println()
+	}
+
 	return nil
 }
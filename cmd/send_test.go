@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/lifeym/she/journal"
+	"github.com/lifeym/she/mail"
+	"github.com/lifeym/she/queue"
+)
+
+func TestThreadRoots(t *testing.T) {
+	j, err := journal.Open(filepath.Join(t.TempDir(), "journal.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer j.Close()
+	for _, e := range []*journal.Entry{
+		{MessageFile: "/m.yaml", Key: "sent", MessageID: "<sent@x>"},
+		{MessageFile: "/m.yaml", Key: "sent", MessageID: "<sent-again@x>"},
+		{MessageFile: "/m.yaml", Key: "split#1", MessageID: "<split-1@x>"},
+		{MessageFile: "/m.yaml", Key: "split#2", MessageID: "<split-2@x>"},
+		{MessageFile: "/other.yaml", Key: "other", MessageID: "<other@x>"},
+	} {
+		if err = j.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	compiled := mail.NewMessage()
+	compiled.SetHeader("Message-ID", "<compiled@x>")
+	roots := threadRoots{
+		journal: j,
+		msgPath: "/m.yaml",
+		key:     "weekly",
+		msgs:    []*outgoing{{mail: "first", key: "first", msg: compiled}},
+		queued: []*queue.Item{
+			{MessageFile: "/m.yaml", Key: "queued#1", MessageID: "<queued@x>"},
+			{MessageFile: "/other.yaml", Key: "elsewhere", MessageID: "<elsewhere@x>"},
+		},
+	}
+
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"", ""},
+		{" <id@example.com> ", "<id@example.com>"},
+		{"sent", "<sent@x>"},
+		{"split", "<split-1@x>"},
+		{"queued", "<queued@x>"},
+		{"first", "<compiled@x>"},
+		// the first message sent with its own key starts the thread
+		{"weekly", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := roots.id(tt.ref)
+		if err != nil || got != tt.want {
+			t.Errorf("id(%q) = %q, %v, want %q", tt.ref, got, err, tt.want)
+		}
+	}
+
+	// keys of other message files are not resolved
+	for _, ref := range []string{"other", "elsewhere", "unknown"} {
+		if got, err := roots.id(ref); err == nil {
+			t.Errorf("id(%q) = %q, want an error", ref, got)
+		}
+	}
+
+	// once sent, later mails with the key reply to its first message
+	if err = j.Add(&journal.Entry{MessageFile: "/m.yaml", Key: "weekly", MessageID: "<weekly@x>"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := roots.id("weekly"); err != nil || got != "<weekly@x>" {
+		t.Errorf("id(weekly) = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lifeym/she/config"
+	"github.com/lifeym/she/journal"
+	shemail "github.com/lifeym/she/mail"
+	"github.com/spf13/cobra"
+)
+
+// sendmailArgOptions are sendmail options taking an argument, attached
+// or separate, which are accepted and ignored.
+const sendmailArgOptions = "BCLNORVXh"
+
+// sendmailAttachedOptions are sendmail options whose value is the rest
+// of their argument, such as -bm or -oi.
+const sendmailAttachedOptions = "bdoq"
+
+type sendmailOptions struct {
+	readRecipients bool
+	ignoreDots     bool
+	sender         string
+	fullName       string
+	recipients     []string
+}
+
+var sendmailCmd = &cobra.Command{
+	Use:   "sendmail [options] [recipient ...]",
+	Short: "sendmail compatible mode reading a message from stdin",
+	Long: `Reads a whole message from stdin and delivers it with the default
+account of the config, as /usr/sbin/sendmail does.
+The same happens when the binary is invoked as sendmail, the config
+files are then only given by SHE_CONFIG.
+
+Supported options:
+  -t         read recipients from the To, Cc and Bcc headers
+  -i, -oi    a line with a single dot does not end the message
+  -f sender  envelope sender address
+  -F name    full name of the sender, used when From is missing
+Options may be grouped, as in -ti or -toi. Other sendmail options are
+accepted and ignored.`,
+	DisableFlagParsing: true,
+	SilenceUsage:       true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, arg := range args {
+			if arg == "--help" {
+				return cmd.Help()
+			}
+		}
+
+		opts, err := parseSendmailArgs(args)
+		if err != nil {
+			return err
+		}
+
+		return sendmail(opts, os.Stdin)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sendmailCmd)
+}
+
+// parseSendmailArgs parses sendmail style options, which pflag cannot
+// handle because of multi letter options with a single dash such as -oi.
+func parseSendmailArgs(args []string) (*sendmailOptions, error) {
+	opts := sendmailOptions{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			opts.recipients = append(opts.recipients, args[i+1:]...)
+			break
+		}
+
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			opts.recipients = append(opts.recipients, arg)
+			continue
+		}
+
+		// options without value are grouped, the first one taking a value
+		// ends the group
+		for j := 1; j < len(arg); j++ {
+			opt, rest := arg[j], arg[j+1:]
+			// value of the option, attached or as the next argument
+			value := func() (string, error) {
+				if rest != "" {
+					return rest, nil
+				}
+
+				if i+1 >= len(args) {
+					return "", fmt.Errorf("sendmail: option requires an argument -- %c", opt)
+				}
+
+				i++
+				return args[i], nil
+			}
+
+			var err error
+			switch {
+			case opt == 't':
+				opts.readRecipients = true
+				continue
+			case opt == 'i':
+				opts.ignoreDots = true
+				continue
+			case opt == 'o' && rest == "i":
+				opts.ignoreDots = true
+			case opt == 'f' || opt == 'r':
+				opts.sender, err = value()
+			case opt == 'F':
+				opts.fullName, err = value()
+			case strings.IndexByte(sendmailArgOptions, opt) >= 0:
+				_, err = value()
+			case strings.IndexByte(sendmailAttachedOptions, opt) >= 0:
+			default:
+				continue
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			break
+		}
+	}
+
+	return &opts, nil
+}
+
+// readSendmailInput reads the message from r, which ends at a line
+// holding a single dot unless ignoreDots is set.
+func readSendmailInput(r io.Reader, ignoreDots bool) ([]byte, error) {
+	if ignoreDots {
+		return io.ReadAll(r)
+	}
+
+	var buf bytes.Buffer
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "." {
+			break
+		}
+
+		buf.WriteString(line)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func sendmail(opts *sendmailOptions, stdin io.Reader) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	accountName := cfg.DefaultAccountName()
+	if accountName == "" {
+		return errors.New("sendmail: no default account, set defaultAccount in config file")
+	}
+
+	// read before the account is compiled, which may run commands
+	input, err := readSendmailInput(stdin, opts.ignoreDots)
+	if err != nil {
+		return err
+	}
+
+	compiledMail, err := config.CompileAccount(cfg, accountName)
+	if err != nil {
+		return err
+	}
+
+	msg, err := shemail.ReadRawMessage(bytes.NewReader(input))
+	if err != nil {
+		return err
+	}
+
+	var recipients []string
+	for _, r := range opts.recipients {
+		addrs, err := mail.ParseAddressList(r)
+		if err != nil {
+			return fmt.Errorf("sendmail: invalid recipient %s: %w", r, err)
+		}
+
+		for _, a := range addrs {
+			recipients = append(recipients, a.Address)
+		}
+	}
+
+	if opts.readRecipients {
+		for _, field := range []string{"to", "cc", "bcc"} {
+			addrs, err := msg.AddressList(field)
+			if err != nil {
+				return fmt.Errorf("sendmail: invalid %s header: %w", field, err)
+			}
+
+			for _, a := range addrs {
+				recipients = append(recipients, a.Address)
+			}
+		}
+	}
+
+	if len(recipients) == 0 {
+		return errors.New("sendmail: no recipients")
+	}
+
+	// blind copies must not be seen by the recipients
+	msg.Del("bcc")
+	if msg.Get("from") == "" {
+		from, err := mail.ParseAddress(compiledMail.DefaultFrom)
+		if err != nil {
+			return fmt.Errorf("sendmail: no From header and invalid default from: %w", err)
+		}
+
+		if opts.fullName != "" {
+			from.Name = opts.fullName
+		}
+
+		msg.Add("from", from.String())
+	}
+
+	if msg.Get("date") == "" {
+		msg.Add("date", time.Now().Format(time.RFC1123Z))
+	}
+
+	if msg.Get("message-id") == "" {
+		domain := compiledMail.MessageIDDomain
+		if domain == "" {
+			domain = shemail.AddressDomain(msg.Get("from"))
+		}
+
+		id, err := shemail.GenerateMessageID(domain)
+		if err != nil {
+			return err
+		}
+
+		msg.Add("message-id", id)
+	}
+
+	sender := opts.sender
+	if sender == "" {
+		from, err := mail.ParseAddress(msg.Get("from"))
+		if err != nil {
+			return fmt.Errorf("sendmail: invalid From header: %w", err)
+		}
+
+		sender = from.Address
+	}
+
+	smtp := compiledMail.NewSmtpAuth()
+	reply, err := smtp.SendRaw(sender, recipients, msg)
+	if err != nil {
+		return err
+	}
+
+	if err = recordRaw(cfg, accountName, sender, recipients, msg, reply); err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: cannot record the message in the journal: %s\n", err)
+	}
+
+	return nil
+}
+
+// recordRaw records msg delivered with the account named accountName in
+// the journal of cfg.
+func recordRaw(cfg *config.AppConfig, accountName string, from string, to []string, msg *shemail.RawMessage, reply string) error {
+	j, err := openJournal(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer j.Close()
+	return j.Add(rawEntry(accountName, from, to, msg, reply))
+}
+
+// rawEntry returns the journal entry of a raw message, which belongs to
+// no message file.
+func rawEntry(accountName string, from string, to []string, msg *shemail.RawMessage, reply string) *journal.Entry {
+	return &journal.Entry{
+		Account:   accountName,
+		MessageID: msg.Get("message-id"),
+		From:      from,
+		To:        to,
+		Subject:   msg.Get("subject"),
+		SentAt:    time.Now(),
+		Reply:     reply,
+	}
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSendmailArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want sendmailOptions
+	}{
+		{"recipients", []string{"a@example.com", "b@example.com"},
+			sendmailOptions{recipients: []string{"a@example.com", "b@example.com"}}},
+		{"-t", []string{"-t"}, sendmailOptions{readRecipients: true}},
+		{"-i", []string{"-i"}, sendmailOptions{ignoreDots: true}},
+		{"-oi", []string{"-oi", "a@example.com"}, sendmailOptions{ignoreDots: true, recipients: []string{"a@example.com"}}},
+		{"-oi and -t", []string{"-oi", "-t"}, sendmailOptions{readRecipients: true, ignoreDots: true}},
+		{"-ti", []string{"-ti"}, sendmailOptions{readRecipients: true, ignoreDots: true}},
+		{"-it", []string{"-it"}, sendmailOptions{readRecipients: true, ignoreDots: true}},
+		{"-toi", []string{"-toi"}, sendmailOptions{readRecipients: true, ignoreDots: true}},
+		{"other -o option", []string{"-oem", "-t"}, sendmailOptions{readRecipients: true}},
+		{"-f", []string{"-f", "me@example.com"}, sendmailOptions{sender: "me@example.com"}},
+		{"-f attached", []string{"-fme@example.com"}, sendmailOptions{sender: "me@example.com"}},
+		{"-r", []string{"-r", "me@example.com"}, sendmailOptions{sender: "me@example.com"}},
+		{"-tif", []string{"-tif", "me@example.com", "a@example.com"},
+			sendmailOptions{readRecipients: true, ignoreDots: true, sender: "me@example.com", recipients: []string{"a@example.com"}}},
+		{"-F", []string{"-F", "Me Myself", "-t"}, sendmailOptions{fullName: "Me Myself", readRecipients: true}},
+		{"-F attached", []string{"-FMe"}, sendmailOptions{fullName: "Me"}},
+		{"--", []string{"-t", "--", "-i", "a@example.com"},
+			sendmailOptions{readRecipients: true, recipients: []string{"-i", "a@example.com"}}},
+		{"ignored options", []string{"-bm", "-v", "-N", "never", "-q1h", "-odi", "a@example.com"},
+			sendmailOptions{recipients: []string{"a@example.com"}}},
+		// the value of an option is not a group of options
+		{"-N value", []string{"-Nti"}, sendmailOptions{}},
+		{"-", []string{"-"}, sendmailOptions{recipients: []string{"-"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSendmailArgs(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSendmailArgsMissingValue(t *testing.T) {
+	for _, args := range [][]string{{"-f"}, {"-t", "-F"}, {"-tif"}, {"-N"}} {
+		if _, err := parseSendmailArgs(args); err == nil {
+			t.Errorf("%q parsed", args)
+		}
+	}
+}
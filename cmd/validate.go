@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lifeym/she/config"
+	"github.com/spf13/cobra"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate [message-file...]",
+	Short: "Check the config files and message files",
+	Long: `Checks the config files, see she config path, and the given message
+files against their JSON Schema, see she schema, then for duplicate
+names, references to undefined smtp configs, accounts or templates, and
+invalid settings, reporting each problem at its line and column. Smtp
+configs and accounts are checked as merged with the environment
+variables, such as SHE_SMTP_<NAME>_PORT, a problem of a value they set
+being reported at the variable. The same checks run before send.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return validate(os.Stdout, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+func validate(w io.Writer, msgFiles []string) error {
+	var problems int
+	report := func(err error) {
+		var errs config.ValidationErrors
+		if !errors.As(err, &errs) {
+			fmt.Fprintln(w, err)
+			problems++
+			return
+		}
+
+		for _, e := range errs {
+			fmt.Fprintln(w, e)
+		}
+
+		problems += len(errs)
+	}
+
+	if cfg, err := loadConfig(); err != nil {
+		report(err)
+	} else if err = cfg.Validate(); err != nil {
+		report(err)
+	}
+
+	for _, f := range msgFiles {
+		if msgFile, err := config.LoadMessageFile(f); err != nil {
+			report(err)
+		} else if err = msgFile.Validate(); err != nil {
+			report(err)
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found", problems)
+	}
+
+	return nil
+}
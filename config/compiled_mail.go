@@ -1,18 +1,31 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"slices"
 	"strconv"
 
 	"github.com/lifeym/she/mail"
 )
 
+// defaultAttachmentName names attachments not read from a file.
+const defaultAttachmentName = "attachment"
+
 type CompiledSmtpConfig struct {
-	Name     string
-	Host     string
-	Port     int
-	StartTLS bool
+	Name           string
+	Host           string
+	Port           int
+	StartTLS       bool
+	MaxMessageSize int64
+	OversizePolicy string
+	// 0 when not limited
+	MessagesPerMinute int
+	RecipientsPerHour int
 }
 
 func compileSmtpConfig(t *SheTemplate, sc *SmtpConfig) (*CompiledSmtpConfig, error) {
@@ -58,19 +71,104 @@ func compileSmtpConfig(t *SheTemplate, sc *SmtpConfig) (*CompiledSmtpConfig, err
 	}
 
 	result.StartTLS = b
+
+	// max message size
+	s, err = t.Execute(sc.MaxMessageSize, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.MaxMessageSize, err = parseSize(s); err != nil {
+		return nil, err
+	}
+
+	if result.OversizePolicy, err = t.Execute(sc.OversizePolicy, nil); err != nil {
+		return nil, err
+	}
+
+	// rate limits
+	if result.MessagesPerMinute, err = compileRate(t, sc.MessagesPerMinute); err != nil {
+		return nil, err
+	}
+
+	if result.RecipientsPerHour, err = compileRate(t, sc.RecipientsPerHour); err != nil {
+		return nil, err
+	}
+
 	return &result, nil
 }
 
+func compileRate(t *SheTemplate, rate string) (int, error) {
+	s, err := t.Execute(rate, nil)
+	if err != nil || s == "" {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("invalid rate limit: %s", s)
+	}
+
+	return n, nil
+}
+
 type CompiledMail struct {
-	LoginUser string
-	Password  string
-	Smtp      *CompiledSmtpConfig
-	Message   *mail.Message
+	LoginUser      string
+	Password       string
+	DefaultFrom    string
+	Smtp           *CompiledSmtpConfig
+	Message        *mail.Message
+	MaxMessageSize int64
+	OversizePolicy string
+	Concurrency    int
+	// Key identifies the message in the send journal.
+	Key string
+	// MessageIDDomain is the domain of generated Message-IDs, empty for
+	// that of the From address.
+	MessageIDDomain string
+	// DKIM signs the messages when set.
+	DKIM *mail.DKIMSigner
+	// InReplyTo and References are message ids or mail keys to be
+	// resolved with the send journal.
+	InReplyTo  string
+	References []string
+
+	// S/MIME settings of the account, nil when not configured
+	smime *compiledSMIME
+	// PGP settings of the account, nil when not configured
+	pgp *compiledPGP
+	// set when Message was split to stay within MaxMessageSize
+	parts []*mail.Message
 }
 
-func CompileMail(appCfg *AppConfig, mf *MessageFile, accountName string, mailName string) (*CompiledMail, error) {
-	// data := make(map[string]any)
-	t := NewTemplate()
+// Messages returns the messages to be sent, which is Message itself
+// unless it had to be split.
+func (cm *CompiledMail) Messages() []*mail.Message {
+	if cm.parts != nil {
+		return cm.parts
+	}
+
+	return []*mail.Message{cm.Message}
+}
+
+// NewSmtpAuth returns the client sending mails with the compiled account.
+func (cm *CompiledMail) NewSmtpAuth() *mail.SmtpAuth {
+	result := mail.New(cm.LoginUser, cm.Password, cm.Smtp.Host, cm.Smtp.Port, cm.Smtp.StartTLS)
+	result.SetDKIM(cm.DKIM)
+	return result
+}
+
+// CompileAccount compiles the account named accountName of appCfg
+// together with its smtp config, the result carries no message.
+func CompileAccount(appCfg *AppConfig, accountName string) (*CompiledMail, error) {
+	return compileAccount(NewTemplate(), appCfg, accountName)
+}
+
+func compileAccount(t *SheTemplate, appCfg *AppConfig, accountName string) (*CompiledMail, error) {
 	var err error
 	result := CompiledMail{}
 	account := appCfg.GetAccount(accountName)
@@ -82,7 +180,11 @@ func CompileMail(appCfg *AppConfig, mf *MessageFile, accountName string, mailNam
 		return nil, err
 	}
 
-	if result.Password, err = t.Execute(account.Password, nil); err != nil {
+	if result.Password, err = compileSecret(t, account.Password); err != nil {
+		return nil, err
+	}
+
+	if result.DefaultFrom, err = t.Execute(account.DefaultFrom, nil); err != nil {
 		return nil, err
 	}
 
@@ -102,6 +204,73 @@ func CompileMail(appCfg *AppConfig, mf *MessageFile, accountName string, mailNam
 		return nil, err
 	}
 
+	// message size limit, the account may override the smtp one
+	result.MaxMessageSize = result.Smtp.MaxMessageSize
+	result.OversizePolicy = result.Smtp.OversizePolicy
+	var cv string
+	if cv, err = t.Execute(account.MaxMessageSize, nil); err != nil {
+		return nil, err
+	}
+
+	if cv != "" {
+		if result.MaxMessageSize, err = parseSize(cv); err != nil {
+			return nil, err
+		}
+	}
+
+	if cv, err = t.Execute(account.OversizePolicy, nil); err != nil {
+		return nil, err
+	}
+
+	if cv != "" {
+		result.OversizePolicy = cv
+	}
+
+	if result.MessageIDDomain, err = t.Execute(account.MessageIDDomain, nil); err != nil {
+		return nil, err
+	}
+
+	if account.DKIM != nil {
+		if result.DKIM, err = compileDKIM(t, account.DKIM, result.DefaultFrom); err != nil {
+			return nil, err
+		}
+	}
+
+	if account.SMIME != nil {
+		if result.smime, err = compileSMIME(t, account.SMIME); err != nil {
+			return nil, err
+		}
+	}
+
+	if account.PGP != nil {
+		if result.pgp, err = compilePGP(t, account.PGP, result.DefaultFrom); err != nil {
+			return nil, err
+		}
+	}
+
+	// concurrency
+	if cv, err = t.Execute(account.Concurrency, nil); err != nil {
+		return nil, err
+	}
+
+	result.Concurrency = 1
+	if cv != "" {
+		if result.Concurrency, err = strconv.Atoi(cv); err != nil {
+			return nil, err
+		}
+	}
+
+	return &result, nil
+}
+
+func CompileMail(appCfg *AppConfig, mf *MessageFile, accountName string, mailName string) (*CompiledMail, error) {
+	// data := make(map[string]any)
+	t := NewTemplate()
+	result, err := compileAccount(t, appCfg, accountName)
+	if err != nil {
+		return nil, err
+	}
+
 	mc := mf.GetMail(mailName)
 	if mc == nil {
 		return nil, fmt.Errorf("mail definition not found: %s", mailName)
@@ -112,6 +281,28 @@ func CompileMail(appCfg *AppConfig, mf *MessageFile, accountName string, mailNam
 		return nil, fmt.Errorf("message definition not found: %s", mc.Template)
 	}
 
+	if result.Key, err = t.Execute(mc.Key, nil); err != nil {
+		return nil, err
+	}
+
+	if result.Key == "" {
+		result.Key = mc.Name
+	}
+
+	// threading
+	if result.InReplyTo, err = t.Execute(mc.Spec.InReplyTo, nil); err != nil {
+		return nil, err
+	}
+
+	for _, ref := range mc.Spec.References {
+		cv, err := t.Execute(ref, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		result.References = append(result.References, cv)
+	}
+
 	msg := mail.NewMessage()
 
 	// construct message header
@@ -142,12 +333,7 @@ func CompileMail(appCfg *AppConfig, mf *MessageFile, accountName string, mailNam
 	}
 
 	if msg.GetHeader("from") == "" {
-		cv, err := t.Execute(account.DefaultFrom, nil)
-		if err != nil {
-			return nil, err
-		}
-
-		msg.SetHeader("from", cv)
+		msg.SetHeader("from", result.DefaultFrom)
 	}
 
 	// body
@@ -173,19 +359,38 @@ func CompileMail(appCfg *AppConfig, mf *MessageFile, accountName string, mailNam
 			return nil, err
 		}
 
-		err = msg.AttachFile(compiledAtt.Path, compiledAtt.Name, compiledAtt.Header.ToMIMEHeader())
-		if err != nil {
-			return nil, fmt.Errorf("cannot attach file: %s. Err: %s", att.Path, err)
+		if err = attach(msg, compiledAtt, mf.workDir); err != nil {
+			return nil, fmt.Errorf("cannot attach %s: %w", compiledAtt.describe(), err)
+		}
+	}
+
+	if result.smime != nil {
+		if err = result.smime.apply(msg, mc.Spec.SMIME); err != nil {
+			return nil, err
 		}
+	} else if mc.Spec.SMIME.requested() {
+		return nil, fmt.Errorf("smime: not configured for account %s", accountName)
+	}
+
+	if result.pgp != nil {
+		if err = result.pgp.apply(t, msg, mc.Spec.PGP); err != nil {
+			return nil, err
+		}
+	} else if mc.Spec.PGP.requested() {
+		return nil, fmt.Errorf("pgp: not configured for account %s", accountName)
 	}
 
 	result.Message = msg
-	return &result, nil
+	if err = result.applySizeLimit(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
 
 func compileAttachment(att *messageAttachment, t *SheTemplate) (*messageAttachment, error) {
 	var err error
-	compiledAtt := messageAttachment{}
+	compiledAtt := messageAttachment{Header: make(mailHeaderData)}
 	if compiledAtt.Name, err = t.Execute(att.Name, nil); err != nil {
 		return nil, err
 	}
@@ -194,6 +399,30 @@ func compileAttachment(att *messageAttachment, t *SheTemplate) (*messageAttachme
 		return nil, err
 	}
 
+	if compiledAtt.ContentType, err = t.Execute(att.ContentType, nil); err != nil {
+		return nil, err
+	}
+
+	if compiledAtt.Archive, err = t.Execute(att.Archive, nil); err != nil {
+		return nil, err
+	}
+
+	compiledAtt.Required = att.Required
+	compiledAtt.Message = att.Message
+	if compiledAtt.Content, err = t.Execute(att.Content, nil); err != nil {
+		return nil, err
+	}
+
+	compiledAtt.Stdin = att.Stdin
+	for _, arg := range att.Command {
+		carg, err := t.Execute(arg, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		compiledAtt.Command = append(compiledAtt.Command, carg)
+	}
+
 	for k := range att.Header {
 		for _, v := range att.Header[k] {
 			cv, err := t.Execute(v, nil)
@@ -207,3 +436,97 @@ func compileAttachment(att *messageAttachment, t *SheTemplate) (*messageAttachme
 
 	return &compiledAtt, nil
 }
+
+// attach adds the compiled attachment att to msg, relative paths and
+// commands resolving from dir, the working directory when empty.
+func attach(msg *mail.Message, att *messageAttachment, dir string) error {
+	sources := 0
+	for _, set := range []bool{att.Path != "", att.Content != "", att.Stdin, len(att.Command) > 0} {
+		if set {
+			sources++
+		}
+	}
+
+	if sources != 1 {
+		return errors.New("exactly one of path, content, stdin or command must be given")
+	}
+
+	header := att.mimeHeader()
+	name := att.Name
+	if name == "" {
+		name = defaultAttachmentName
+	}
+
+	switch {
+	case att.Content != "":
+		msg.AttachContent(name, []byte(att.Content), header)
+		return nil
+	case att.Stdin:
+		return msg.AttachReader(os.Stdin, name, header)
+	case len(att.Command) > 0:
+		cmd := attachmentCommand(att.Command)
+		cmd.Dir = dir
+		return msg.AttachCommandOutput(cmd, name, header)
+	}
+
+	return attachFiles(msg, att, dir)
+}
+
+// attachmentCommand returns the command producing an attachment,
+// a single string is run by the shell.
+func attachmentCommand(args StringArray) *exec.Cmd {
+	if len(args) == 1 {
+		return exec.Command("sh", "-c", args[0])
+	}
+
+	return exec.Command(args[0], args[1:]...)
+}
+
+// attachFiles adds the files matched by the compiled attachment att to msg,
+// directories are attached as a single archive each.
+func attachFiles(msg *mail.Message, att *messageAttachment, dir string) error {
+	pattern := att.Path
+	if dir != "" && !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+
+	if len(matches) == 0 {
+		if !att.IsRequired() {
+			return nil
+		}
+
+		return fs.ErrNotExist
+	}
+
+	for _, path := range matches {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		header := att.mimeHeader()
+		// a name can only be given to a single attachment,
+		// files matched by a pattern keep their own.
+		name := att.Name
+		if len(matches) > 1 {
+			name = ""
+		}
+
+		if fi.IsDir() {
+			err = msg.AttachDir(path, name, att.Archive, header)
+		} else {
+			err = msg.AttachFile(path, name, header)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lifeym/she/mail"
+)
+
+// attachmentNames returns the names of the attachments of msg, and
+// whether each is archived on the fly.
+func attachmentNames(msg *mail.Message) ([]string, []bool) {
+	var names []string
+	var archived []bool
+	for _, att := range msg.Attachments {
+		names = append(names, att.Name)
+		archived = append(archived, att.Source != nil)
+	}
+
+	return names, archived
+}
+
+func TestAttachFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"reports/a.csv", "reports/b.csv", "reports/notes.txt", "logs/a.log", "logs/old/b.log"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	optional := false
+	tests := []struct {
+		name     string
+		att      messageAttachment
+		want     []string
+		archived []bool
+	}{
+		{"glob", messageAttachment{Path: "reports/*.csv", Name: "ignored.csv"}, []string{"a.csv", "b.csv"}, []bool{false, false}},
+		{"single file renamed", messageAttachment{Path: "reports/notes.txt", Name: "readme.txt"}, []string{"readme.txt"}, []bool{false}},
+		{"absolute path", messageAttachment{Path: filepath.Join(dir, "reports", "a.csv")}, []string{"a.csv"}, []bool{false}},
+		{"optional missing", messageAttachment{Path: "reports/*.pdf", Required: &optional}, nil, nil},
+		{"directory", messageAttachment{Path: "logs"}, []string{"logs.zip"}, []bool{true}},
+		{"directory as tar.gz", messageAttachment{Path: "logs", Archive: "tar.gz"}, []string{"logs.tar.gz"}, []bool{true}},
+		{"directories and files", messageAttachment{Path: "logs/*"}, []string{"a.log", "old.zip"}, []bool{false, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := mail.NewMessage()
+			if err := attach(msg, &tt.att, dir); err != nil {
+				t.Fatal(err)
+			}
+
+			names, archived := attachmentNames(msg)
+			if !reflect.DeepEqual(names, tt.want) || !reflect.DeepEqual(archived, tt.archived) {
+				t.Errorf("attached %v archived %v, want %v archived %v", names, archived, tt.want, tt.archived)
+			}
+		})
+	}
+
+	for _, path := range []string{"reports/*.pdf", "missing.txt"} {
+		err := attach(mail.NewMessage(), &messageAttachment{Path: path}, dir)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: err = %v, want not exist", path, err)
+		}
+	}
+
+	if err := attach(mail.NewMessage(), &messageAttachment{Path: "logs", Archive: "rar"}, dir); err == nil {
+		t.Error("unsupported archive format accepted")
+	}
+}
+
+func TestCompileMailAttachments(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`smtp:
+  - name: main
+    host: smtp.example.com
+    port: 587
+    starttls: true
+accounts:
+  - name: me
+    smtpRef: main
+    defaultFrom: me@example.com
+`), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mf := loadTestMessageFile(t, FormatYAML, `templates:
+  - name: t
+    header:
+      To: you@example.com
+      Subject: report
+mails:
+  - name: generated
+    template: t
+    spec:
+      body: hello
+      attachments:
+        - name: notes.txt
+          content: '{{ printf "%d notes" 3 }}'
+        - content: unnamed
+        - name: dir.txt
+          command: pwd
+        - name: args.txt
+          command: [printf, "%s|%s", "a b", c]
+  - name: failing
+    template: t
+    spec:
+      attachments:
+        - command: exit 3
+  - name: ambiguous
+    template: t
+    spec:
+      attachments:
+        - content: hello
+          command: echo hello
+`)
+	// commands run from the work directory
+	dir := t.TempDir()
+	mf.SetWorkDir(dir)
+	cm, err := CompileMail(cfg, mf, "me", "generated")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"notes.txt":           "3 notes",
+		defaultAttachmentName: "unnamed",
+		"dir.txt":             wantDir + "\n",
+		"args.txt":            "a b|c",
+	}
+
+	got := make(map[string]string)
+	for _, att := range cm.Message.Attachments {
+		got[att.Name] = string(att.Content)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("attachments = %q, want %q", got, want)
+	}
+
+	_, err = CompileMail(cfg, mf, "me", "failing")
+	// the shell path depends on the system
+	sh := attachmentCommand(StringArray{"exit 3"}).Path
+	if want := "cannot attach command output: exit 3: command " + sh + " -c exit 3: exit status 3"; err == nil || err.Error() != want {
+		t.Errorf("err = %v, want %s", err, want)
+	}
+
+	_, err = CompileMail(cfg, mf, "me", "ambiguous")
+	if want := "cannot attach command output: echo hello: exactly one of path, content, stdin or command must be given"; err == nil || err.Error() != want {
+		t.Errorf("err = %v, want %s", err, want)
+	}
+}
+
+func TestCompileMailMessageIDDomain(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`smtp:
+  - name: main
+    host: smtp.example.com
+    port: 587
+    starttls: true
+accounts:
+  - name: me
+    smtpRef: main
+    defaultFrom: me@example.com
+  - name: ids
+    smtpRef: main
+    defaultFrom: me@example.com
+    messageIdDomain: ids.example.net
+`), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mf := loadTestMessageFile(t, FormatYAML, `templates:
+  - name: t
+    header:
+      To: you@example.com
+mails:
+  - name: hello
+    template: t
+    spec:
+      body: hello
+`)
+	for account, want := range map[string]string{"me": "@example.com>", "ids": "@ids.example.net>"} {
+		cm, err := CompileMail(cfg, mf, account, "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = cm.Message.SetMessageID(cm.MessageIDDomain); err != nil {
+			t.Fatal(err)
+		}
+
+		if id := cm.Message.GetHeader("Message-ID"); !strings.HasSuffix(id, want) {
+			t.Errorf("%s: Message-ID = %q, want domain %s", account, id, want)
+		}
+	}
+}
@@ -2,16 +2,33 @@ package config
 
 import (
 	"os"
-
-	"gopkg.in/yaml.v3"
+	"path/filepath"
 )
 
 type AccountConfig struct {
-	Name        string
-	SmtpRef     string `yaml:"smtpRef"`
-	LoginUser   string `yaml:"loginUser"`
-	Password    string
-	DefaultFrom string `yaml:"defaultFrom"`
+	Name      string
+	SmtpRef   string `yaml:"smtpRef"`
+	LoginUser string `yaml:"loginUser,omitempty"`
+	// Password is either the password, or a secret reference such as
+	// env:SMTP_PASSWORD resolved when the account is compiled.
+	Password    string `yaml:",omitempty"`
+	DefaultFrom string `yaml:"defaultFrom,omitempty"`
+	// MaxMessageSize and OversizePolicy override those of the smtp config.
+	MaxMessageSize string `yaml:"maxMessageSize,omitempty"`
+	OversizePolicy string `yaml:"oversizePolicy,omitempty"`
+	// Concurrency is how many queued messages of the account may be
+	// delivered at once, 1 by default.
+	Concurrency string `yaml:"concurrency,omitempty"`
+	// MessageIDDomain is the domain of generated Message-IDs, the domain
+	// of the From address by default.
+	MessageIDDomain string `yaml:"messageIdDomain,omitempty"`
+	// DKIM signs the messages sent with the account when set.
+	DKIM *DKIMConfig `yaml:"dkim,omitempty"`
+	// SMIME signs or encrypts the messages sent with the account when set.
+	SMIME *SMIMEConfig `yaml:"smime,omitempty"`
+	// PGP signs or encrypts the messages sent with the account as
+	// PGP/MIME when set.
+	PGP *PGPConfig `yaml:"pgp,omitempty"`
 }
 
 type SmtpConfig struct {
@@ -19,41 +36,118 @@ type SmtpConfig struct {
 	Host     string
 	Port     string
 	StartTLS string `yaml:"starttls"`
+	// MaxMessageSize is the largest message accepted by the server,
+	// such as "25MB", empty for no limit.
+	MaxMessageSize string `yaml:"maxMessageSize,omitempty"`
+	// OversizePolicy tells what to do with larger messages:
+	// fail (default), compress or split.
+	OversizePolicy string `yaml:"oversizePolicy,omitempty"`
+	// MessagesPerMinute and RecipientsPerHour limit the rate of bulk
+	// sending through the server, shared by all its accounts, empty or 0
+	// for no limit.
+	MessagesPerMinute string `yaml:"messagesPerMinute,omitempty"`
+	RecipientsPerHour string `yaml:"recipientsPerHour,omitempty"`
 }
 
 type AppConfig struct {
 	Smtp     []SmtpConfig
 	Accounts []AccountConfig
+	// DefaultAccount is used when no account is given, such as in
+	// sendmail mode, it may be omitted when a single account is defined.
+	DefaultAccount string       `yaml:"defaultAccount,omitempty"`
+	Relay          *RelayConfig `yaml:"relay,omitempty"`
+	// QueueDir is the spool directory of queued messages,
+	// $XDG_STATE_HOME/she/queue by default.
+	QueueDir string `yaml:"queueDir,omitempty"`
+	// ScheduleFilename is the file holding the scheduled mails,
+	// $XDG_STATE_HOME/she/schedule.json by default.
+	ScheduleFilename string `yaml:"scheduleFile,omitempty"`
+	// JournalFilename is the file recording the sent messages,
+	// $XDG_STATE_HOME/she/journal.jsonl by default.
+	JournalFilename string `yaml:"journalFile,omitempty"`
 
 	smtpMap    map[string]*SmtpConfig
 	accountMap map[string]*AccountConfig
+	// set when read from an encrypted file
+	encryption *Encryption
+	// the files read, see LoadConfigFiles
+	files []string
+	// the parsed files, see Validate
+	sources []*source
+	// the environment variables applied, see applyEnv
+	env []envVar
 }
 
+// LoadConfigFile reads the config file, decrypting it when encrypted with
+// age, then sets the smtp configs and accounts of the environment
+// variables, see SHE_SMTP_<NAME>_<FIELD>.
 func LoadConfigFile(filename string) (*AppConfig, error) {
-	bs, err := os.ReadFile(filename)
+	appConfig, err := loadConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = appConfig.applyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+
+	return appConfig, nil
+}
+
+func loadConfigFile(filename string) (*AppConfig, error) {
+	bs, encryption, err := ReadConfigFile(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	appConfig := AppConfig{}
-	err = yaml.Unmarshal(bs, &appConfig)
+	appConfig, err := parseConfig(filename, FormatOf(filename), bs)
 	if err != nil {
 		return nil, err
 	}
 
-	appConfig.smtpMap = make(map[string]*SmtpConfig)
-	for _, ss := range appConfig.Smtp {
-		appConfig.smtpMap[ss.Name] = &ss
+	dir, err := filepath.Abs(filepath.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	appConfig.resolvePaths(dir)
+	appConfig.encryption = encryption
+	appConfig.files = []string{filename}
+	return appConfig, nil
+}
+
+// ParseConfig parses the content of a config file of format.
+func ParseConfig(bs []byte, format Format) (*AppConfig, error) {
+	return parseConfig("", format, bs)
+}
+
+func parseConfig(filename string, format Format, bs []byte) (*AppConfig, error) {
+	src, err := parseSource(filename, format, bs)
+	if err != nil {
+		return nil, err
 	}
 
-	appConfig.accountMap = make(map[string]*AccountConfig)
-	for _, ps := range appConfig.Accounts {
-		appConfig.accountMap[ps.Name] = &ps
+	appConfig := AppConfig{sources: []*source{src}}
+	if err = src.decode(&appConfig, ConfigSchema()); err != nil {
+		return nil, err
 	}
 
+	appConfig.index()
 	return &appConfig, nil
 }
 
+func (c *AppConfig) index() {
+	c.smtpMap = make(map[string]*SmtpConfig)
+	for _, ss := range c.Smtp {
+		c.smtpMap[ss.Name] = &ss
+	}
+
+	c.accountMap = make(map[string]*AccountConfig)
+	for _, ps := range c.Accounts {
+		c.accountMap[ps.Name] = &ps
+	}
+}
+
 func (c *AppConfig) GetSmtp(name string) *SmtpConfig {
 	return c.smtpMap[name]
 }
@@ -62,17 +156,138 @@ func (c *AppConfig) GetAccount(name string) *AccountConfig {
 	return c.accountMap[name]
 }
 
+// DefaultAccountName returns the name of the account to use when none is
+// given, or an empty string if it cannot be told.
+func (c *AppConfig) DefaultAccountName() string {
+	if c.DefaultAccount != "" {
+		return c.DefaultAccount
+	}
+
+	if len(c.Accounts) == 1 {
+		return c.Accounts[0].Name
+	}
+
+	return ""
+}
+
+// stateDirectory returns the directory holding the state of she,
+// $XDG_STATE_HOME/she by default.
+func stateDirectory() (string, error) {
+	stateDir := os.Getenv("XDG_STATE_HOME")
+	if stateDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+
+		stateDir = filepath.Join(home, ".local", "state")
+	}
+
+	return filepath.Join(stateDir, "she"), nil
+}
+
+// configDirectory returns the directory holding the user config of she,
+// $XDG_CONFIG_HOME/she by default.
+func configDirectory() (string, error) {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+
+		configDir = filepath.Join(home, ".config")
+	}
+
+	return filepath.Join(configDir, "she"), nil
+}
+
+// QueueDirectory returns the spool directory of queued messages.
+func (c *AppConfig) QueueDirectory() (string, error) {
+	if c.QueueDir != "" {
+		return c.QueueDir, nil
+	}
+
+	stateDir, err := stateDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(stateDir, "queue"), nil
+}
+
+// ScheduleFile returns the file holding the scheduled mails.
+func (c *AppConfig) ScheduleFile() (string, error) {
+	if c.ScheduleFilename != "" {
+		return c.ScheduleFilename, nil
+	}
+
+	stateDir, err := stateDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(stateDir, "schedule.json"), nil
+}
+
+// JournalFile returns the file recording the sent messages.
+func (c *AppConfig) JournalFile() (string, error) {
+	if c.JournalFilename != "" {
+		return c.JournalFilename, nil
+	}
+
+	stateDir, err := stateDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(stateDir, "journal.jsonl"), nil
+}
+
+// Encryption returns how the config file was encrypted, nil if it was not.
+func (c *AppConfig) Encryption() *Encryption {
+	return c.encryption
+}
+
+// SetEncryption sets how SaveToFile encrypts the config, nil to write it
+// as plain text.
+func (c *AppConfig) SetEncryption(e *Encryption) {
+	c.encryption = e
+}
+
+// SaveToFile writes the config in the format of filename, encrypted as
+// it was read.
 func (c *AppConfig) SaveToFile(filename string) error {
-	bs, err := yaml.Marshal(c)
+	bs, err := marshal(c, FormatOf(filename))
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(filename, bs, 0644)
+	perm := os.FileMode(0644)
+	if c.encryption != nil {
+		if bs, err = c.encryption.Encrypt(bs); err != nil {
+			return err
+		}
+
+		perm = 0600
+	}
+
+	tmp := filename + ".tmp"
+	if err = os.WriteFile(tmp, bs, perm); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
 }
 
-func (c *AppConfig) ToString() (string, error) {
-	bs, err := yaml.Marshal(c)
+// ToString returns the config written in format.
+func (c *AppConfig) ToString(format Format) (string, error) {
+	bs, err := marshal(c, format)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/lifeym/she/mail"
+)
+
+// DKIMConfig configures the DKIM signing of the messages of an account.
+type DKIMConfig struct {
+	// Domain is the signing domain, that of the default from address of
+	// the account by default.
+	Domain   string `yaml:",omitempty"`
+	Selector string
+	// PrivateKeyFile is a PEM encoded RSA or Ed25519 private key.
+	PrivateKeyFile string `yaml:"privateKeyFile"`
+	// Headers are the signed header fields, the common ones by default.
+	Headers StringArray `yaml:",omitempty"`
+}
+
+func compileDKIM(t *SheTemplate, dc *DKIMConfig, defaultFrom string) (*mail.DKIMSigner, error) {
+	var err error
+	result := mail.DKIMSigner{}
+	if result.Domain, err = t.Execute(dc.Domain, nil); err != nil {
+		return nil, err
+	}
+
+	if result.Domain == "" {
+		result.Domain = mail.AddressDomain(defaultFrom)
+	}
+
+	if result.Selector, err = t.Execute(dc.Selector, nil); err != nil {
+		return nil, err
+	}
+
+	if result.Domain == "" || result.Selector == "" {
+		return nil, fmt.Errorf("dkim: domain and selector are required")
+	}
+
+	keyFile, err := t.Execute(dc.PrivateKeyFile, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Key, err = mail.LoadDKIMKey(keyFile); err != nil {
+		return nil, err
+	}
+
+	for _, h := range dc.Headers {
+		ch, err := t.Execute(h, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Headers = append(result.Headers, ch)
+	}
+
+	return &result, nil
+}
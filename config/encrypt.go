@@ -0,0 +1,334 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"golang.org/x/term"
+)
+
+// Config files may be encrypted with age, with a passphrase or to the
+// recipients of age identities. They are decrypted with the identities
+// of the file named by SHE_AGE_IDENTITY, $XDG_CONFIG_HOME/she/age.key by
+// default, or with the passphrase of SHE_AGE_PASSPHRASE, asked on the
+// terminal when not set.
+const (
+	ageIdentityEnv   = "SHE_AGE_IDENTITY"
+	agePassphraseEnv = "SHE_AGE_PASSPHRASE"
+	ageMagic         = "age-encryption.org/v1\n"
+)
+
+// ErrUnknownRecipients is returned when encrypting again a file whose
+// recipients are not all known, see Encryption.WithRecipients.
+var ErrUnknownRecipients = errors.New("age: recipients unknown, give them again")
+
+// Encryption is how a config file is encrypted, kept to write it back
+// the same way.
+type Encryption struct {
+	passphrase string
+	recipients []age.Recipient
+	armored    bool
+	// unknown is set for a file decrypted with an identity whose
+	// recipients cannot be told: a file encrypted to several recipients,
+	// only one of which is known, or to an identity which is not X25519.
+	unknown bool
+}
+
+// NewPassphraseEncryption encrypts with passphrase, as ASCII armor when
+// armored.
+func NewPassphraseEncryption(passphrase string, armored bool) (*Encryption, error) {
+	if passphrase == "" {
+		return nil, errors.New("age: empty passphrase")
+	}
+
+	return &Encryption{passphrase: passphrase, armored: armored}, nil
+}
+
+// NewRecipientEncryption encrypts to recipients, age1... public keys, as
+// ASCII armor when armored.
+func NewRecipientEncryption(recipients []string, armored bool) (*Encryption, error) {
+	result := Encryption{armored: armored}
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, err
+		}
+
+		result.recipients = append(result.recipients, recipient)
+	}
+
+	if len(result.recipients) == 0 {
+		return nil, errors.New("age: no recipient")
+	}
+
+	return &result, nil
+}
+
+// WithRecipients returns the encryption to recipients, age1... public
+// keys, written as ASCII armor when e is.
+func (e *Encryption) WithRecipients(recipients []string) (*Encryption, error) {
+	return NewRecipientEncryption(recipients, e.armored)
+}
+
+// CanEncrypt returns ErrUnknownRecipients if Encrypt would not encrypt
+// to all the recipients the file was encrypted to.
+func (e *Encryption) CanEncrypt() error {
+	if e.unknown {
+		return ErrUnknownRecipients
+	}
+
+	return nil
+}
+
+// ReadRecipientsFile returns the recipients of an age recipients file, one
+// public key per line.
+func ReadRecipientsFile(filename string) ([]string, error) {
+	bs, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, line := range strings.Split(string(bs), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			result = append(result, line)
+		}
+	}
+
+	return result, nil
+}
+
+// Encrypt returns plain encrypted.
+func (e *Encryption) Encrypt(plain []byte) ([]byte, error) {
+	if err := e.CanEncrypt(); err != nil {
+		return nil, err
+	}
+
+	recipients := e.recipients
+	if e.passphrase != "" {
+		r, err := age.NewScryptRecipient(e.passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		recipients = []age.Recipient{r}
+	}
+
+	var buf bytes.Buffer
+	var dst io.Writer = &buf
+	var aw io.WriteCloser
+	if e.armored {
+		aw = armor.NewWriter(&buf)
+		dst = aw
+	}
+
+	w, err := age.Encrypt(dst, recipients...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = w.Write(plain); err != nil {
+		return nil, err
+	}
+
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	if aw != nil {
+		if err = aw.Close(); err != nil {
+			return nil, err
+		}
+
+		buf.WriteString("\n")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// IsEncrypted tells whether data is encrypted with age.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageMagic)) ||
+		bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(armor.Header))
+}
+
+// ReadConfigFile returns the content of a config file, decrypted when
+// encrypted, in which case its encryption is returned as well.
+func ReadConfigFile(filename string) ([]byte, *Encryption, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !IsEncrypted(data) {
+		return data, nil, nil
+	}
+
+	plain, e, err := decrypt(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return plain, e, nil
+}
+
+func decrypt(data []byte) ([]byte, *Encryption, error) {
+	var src io.Reader = bytes.NewReader(data)
+	armored := !bytes.HasPrefix(data, []byte(ageMagic))
+	if armored {
+		src = armor.NewReader(bytes.NewReader(bytes.TrimLeft(data, " \t\r\n")))
+	}
+
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var used []*recordingIdentity
+	var ids []age.Identity
+	for _, id := range identities {
+		r := &recordingIdentity{Identity: id}
+		used = append(used, r)
+		ids = append(ids, r)
+	}
+
+	passphrase := passphraseIdentity{}
+	r, err := age.Decrypt(src, append(ids, &passphrase)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// written back with the same passphrase, or to the identity which
+	// opened it when it is the only recipient
+	e := Encryption{passphrase: passphrase.passphrase, armored: armored}
+	for _, id := range used {
+		if !id.used {
+			continue
+		}
+
+		x, ok := id.Identity.(*age.X25519Identity)
+		if !ok || id.stanzas != 1 {
+			e.unknown = true
+			break
+		}
+
+		e.recipients = append(e.recipients, x.Recipient())
+	}
+
+	return plain, &e, nil
+}
+
+// ageIdentities returns the identities of the identity file, none when
+// the default one does not exist.
+func ageIdentities() ([]age.Identity, error) {
+	filename := os.Getenv(ageIdentityEnv)
+	if filename == "" {
+		configDir, err := configDirectory()
+		if err != nil {
+			return nil, err
+		}
+
+		filename = filepath.Join(configDir, "age.key")
+		if _, err = os.Stat(filename); errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return ids, nil
+}
+
+// recordingIdentity records whether it opened the file, and the number
+// of its recipients.
+type recordingIdentity struct {
+	age.Identity
+	used    bool
+	stanzas int
+}
+
+func (r *recordingIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	key, err := r.Identity.Unwrap(stanzas)
+	r.used = err == nil
+	r.stanzas = len(stanzas)
+	return key, err
+}
+
+// passphraseIdentity only asks for the passphrase of files encrypted
+// with one.
+type passphraseIdentity struct {
+	passphrase string
+}
+
+func (p *passphraseIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	if len(stanzas) != 1 || stanzas[0].Type != "scrypt" {
+		return nil, age.ErrIncorrectIdentity
+	}
+
+	passphrase, err := ReadPassphrase("Config passphrase:")
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := id.Unwrap(stanzas)
+	if errors.Is(err, age.ErrIncorrectIdentity) {
+		return nil, errors.New("age: incorrect passphrase")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.passphrase = passphrase
+	return key, nil
+}
+
+// ReadPassphrase returns SHE_AGE_PASSPHRASE, or the passphrase typed on
+// the terminal after prompt.
+func ReadPassphrase(prompt string) (string, error) {
+	if v, ok := os.LookupEnv(agePassphraseEnv); ok {
+		return v, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("age: passphrase required, set %s", agePassphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, prompt+" ")
+	bs, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bs), nil
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// writeIdentity writes a new identity file named by SHE_AGE_IDENTITY,
+// returning its recipient.
+func writeIdentity(t *testing.T) string {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "age.key")
+	if err = os.WriteFile(filename, []byte(id.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(ageIdentityEnv, filename)
+	return id.Recipient().String()
+}
+
+func TestReencrypt(t *testing.T) {
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		recipients func(own string) []string
+		known      bool
+	}{
+		{"only recipient", func(own string) []string { return []string{own} }, true},
+		{"several recipients", func(own string) []string { return []string{own, other.Recipient().String()} }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			own := writeIdentity(t)
+			e, err := NewRecipientEncryption(tt.recipients(own), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			encrypted, err := e.Encrypt([]byte("smtp: []\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plain, e, err := decrypt(encrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(plain) != "smtp: []\n" {
+				t.Errorf("plain = %q", plain)
+			}
+
+			_, err = e.Encrypt(plain)
+			if tt.known && err != nil {
+				t.Errorf("Encrypt: %v", err)
+			}
+
+			if !tt.known && !errors.Is(err, ErrUnknownRecipients) {
+				t.Errorf("Encrypt = %v, want ErrUnknownRecipients", err)
+			}
+
+			// given again, the recipients are known
+			if e, err = e.WithRecipients(tt.recipients(own)); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = e.Encrypt(plain); err != nil {
+				t.Errorf("Encrypt to the recipients given again: %v", err)
+			}
+		})
+	}
+}
+
+func TestReencryptPassphrase(t *testing.T) {
+	// no identity file
+	t.Setenv(ageIdentityEnv, "")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv(agePassphraseEnv, "secret")
+	e, err := NewPassphraseEncryption("secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := e.Encrypt([]byte("smtp: []\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, e, err := decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = e.Encrypt(plain); err != nil {
+		t.Errorf("Encrypt: %v", err)
+	}
+}
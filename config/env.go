@@ -0,0 +1,218 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// The fields of smtp configs and accounts may be set by environment
+// variables, such as in containers without config file:
+//
+//	SHE_SMTP_<NAME>_HOST=smtp.example.com
+//	SHE_ACCOUNT_<NAME>_PASSWORD=env:SMTP_PASSWORD
+//	SHE_ACCOUNT_<NAME>_DKIM_SELECTOR=mail
+//
+// NAME is the name of the smtp config or account in upper case, other
+// characters than letters and digits replaced by _, and the field is its
+// key in snake case. A list such as DKIM_HEADERS is separated by commas.
+// An smtp config or account not defined by the config files is added,
+// named NAME in lower case.
+const (
+	smtpEnvPrefix    = "SHE_SMTP_"
+	accountEnvPrefix = "SHE_ACCOUNT_"
+)
+
+// envField is a field set by the environment variables ending with
+// suffix, index leading to it through structs and pointers to structs.
+type envField struct {
+	suffix string
+	index  []int
+}
+
+// envFields returns the fields of the struct type t but its name, the
+// longest suffixes first for a name ending with the suffix of a field to
+// be told apart.
+func envFields(t reflect.Type) []envField {
+	var result []envField
+	var walk func(t reflect.Type, prefix string, index []int)
+	walk = func(t reflect.Type, prefix string, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() || prefix == "" && f.Name == "Name" {
+				continue
+			}
+
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "" {
+				name = f.Name
+			}
+
+			suffix := prefix + envKey(name)
+			fi := append(slices.Clone(index), i)
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+
+			if ft.Kind() == reflect.Struct {
+				walk(ft, suffix+"_", fi)
+				continue
+			}
+
+			result = append(result, envField{suffix: suffix, index: fi})
+		}
+	}
+
+	walk(t, "", nil)
+	slices.SortStableFunc(result, func(a, b envField) int {
+		return len(b.suffix) - len(a.suffix)
+	})
+
+	return result
+}
+
+// envName returns the name of an smtp config or account as in
+// environment variables, such as WORK_MAIL for work-mail.
+func envName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+
+		return '_'
+	}, s)
+}
+
+// envKey returns the key of a field in upper snake case, such as SMTP_REF
+// for smtpRef.
+func envKey(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		switch {
+		case unicode.IsUpper(r):
+			// a new word, but within an acronym such as DKIM
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+				b.WriteRune('_')
+			}
+
+			b.WriteRune(r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToUpper(r))
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	return b.String()
+}
+
+// setEnvField sets the field f of the struct v points to, allocating the
+// structs on the way.
+func setEnvField(v reflect.Value, f envField, value string) {
+	v = v.Elem()
+	for _, i := range f.index {
+		v = v.Field(i)
+		if v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+
+			v = v.Elem()
+		}
+	}
+
+	if v.Kind() == reflect.Slice {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+
+		v.Set(reflect.ValueOf(items).Convert(v.Type()))
+		return
+	}
+
+	v.SetString(value)
+}
+
+// envVar is a variable setting the field of an entry.
+type envVar struct {
+	key   string
+	name  string
+	field envField
+	value string
+}
+
+// parseEnv returns the variables of environ starting with prefix which
+// are not empty, sorted by key.
+func parseEnv(environ []string, prefix string, fields []envField) ([]envVar, error) {
+	var result []envVar
+	for _, kv := range environ {
+		key, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, prefix) || value == "" {
+			continue
+		}
+
+		rest := strings.TrimPrefix(key, prefix)
+		i := slices.IndexFunc(fields, func(f envField) bool {
+			return len(rest) > len(f.suffix)+1 && strings.HasSuffix(rest, "_"+f.suffix)
+		})
+
+		if i < 0 {
+			return nil, fmt.Errorf("%s: unknown field", key)
+		}
+
+		name := strings.TrimSuffix(rest, "_"+fields[i].suffix)
+		result = append(result, envVar{key: key, name: name, field: fields[i], value: value})
+	}
+
+	slices.SortFunc(result, func(a, b envVar) int {
+		return strings.Compare(a.key, b.key)
+	})
+
+	return result, nil
+}
+
+// applyEnv sets the fields of smtp configs and accounts from the
+// environment variables environ, adding those not defined.
+func (c *AppConfig) applyEnv(environ []string) error {
+	smtpVars, err := parseEnv(environ, smtpEnvPrefix, envFields(reflect.TypeOf(SmtpConfig{})))
+	if err != nil {
+		return err
+	}
+
+	for _, ev := range smtpVars {
+		i := slices.IndexFunc(c.Smtp, func(s SmtpConfig) bool { return envName(s.Name) == ev.name })
+		if i < 0 {
+			c.Smtp = append(c.Smtp, SmtpConfig{Name: strings.ToLower(ev.name)})
+			i = len(c.Smtp) - 1
+		}
+
+		setEnvField(reflect.ValueOf(&c.Smtp[i]), ev.field, ev.value)
+	}
+
+	accountVars, err := parseEnv(environ, accountEnvPrefix, envFields(reflect.TypeOf(AccountConfig{})))
+	if err != nil {
+		return err
+	}
+
+	for _, ev := range accountVars {
+		i := slices.IndexFunc(c.Accounts, func(a AccountConfig) bool { return envName(a.Name) == ev.name })
+		if i < 0 {
+			c.Accounts = append(c.Accounts, AccountConfig{Name: strings.ToLower(ev.name)})
+			i = len(c.Accounts) - 1
+		}
+
+		setEnvField(reflect.ValueOf(&c.Accounts[i]), ev.field, ev.value)
+	}
+
+	c.env = append(c.env, smtpVars...)
+	c.env = append(c.env, accountVars...)
+	c.index()
+	return nil
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestEnvKey(t *testing.T) {
+	for s, want := range map[string]string{
+		"host":            "HOST",
+		"smtpRef":         "SMTP_REF",
+		"DKIM":            "DKIM",
+		"privateKeyFile":  "PRIVATE_KEY_FILE",
+		"messageIdDomain": "MESSAGE_ID_DOMAIN",
+		"starttls":        "STARTTLS",
+	} {
+		if got := envKey(s); got != want {
+			t.Errorf("envKey(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for s, want := range map[string]string{"main": "MAIN", "work-mail": "WORK_MAIL", "a.b2": "A_B2"} {
+		if got := envName(s); got != want {
+			t.Errorf("envName(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestEnvFields(t *testing.T) {
+	fields := envFields(reflect.TypeOf(AccountConfig{}))
+	var suffixes []string
+	for _, f := range fields {
+		suffixes = append(suffixes, f.suffix)
+	}
+
+	for _, want := range []string{"SMTP_REF", "PASSWORD", "DKIM_SELECTOR", "DKIM_HEADERS", "SMIME_CERT_FILE", "PGP_SECRET_KEYRING"} {
+		if !slices.Contains(suffixes, want) {
+			t.Errorf("no field %s in %v", want, suffixes)
+		}
+	}
+
+	if slices.Contains(suffixes, "NAME") {
+		t.Error("the name is a field")
+	}
+
+	// the longest first, for DKIM_DOMAIN not to be read as the field
+	// DOMAIN of an account named ..._DKIM
+	for i := 1; i < len(fields); i++ {
+		if len(fields[i].suffix) > len(fields[i-1].suffix) {
+			t.Fatalf("%s after %s", fields[i].suffix, fields[i-1].suffix)
+		}
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	fields := envFields(reflect.TypeOf(AccountConfig{}))
+	environ := []string{
+		"SHE_ACCOUNT_WORK_MAIL_DKIM_SELECTOR=mail",
+		"SHE_ACCOUNT_ME_SMTP_REF=main",
+		"SHE_ACCOUNT_ME_PASSWORD=",
+		"SHE_SMTP_MAIN_HOST=smtp.example.com",
+		"PATH=/usr/bin",
+	}
+
+	vars, err := parseEnv(environ, accountEnvPrefix, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type match struct{ name, suffix, value string }
+	var got []match
+	for _, ev := range vars {
+		got = append(got, match{ev.name, ev.field.suffix, ev.value})
+	}
+
+	want := []match{{"ME", "SMTP_REF", "main"}, {"WORK_MAIL", "DKIM_SELECTOR", "mail"}}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, kv := range []string{"SHE_ACCOUNT_ME_COLOR=red", "SHE_ACCOUNT_PASSWORD=x"} {
+		if _, err = parseEnv([]string{kv}, accountEnvPrefix, fields); err == nil {
+			t.Errorf("%s: no error", kv)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	cfg, err := ParseConfig([]byte(testConfig), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cfg.applyEnv([]string{
+		"SHE_SMTP_MAIN_PORT=465",
+		"SHE_ACCOUNT_ME_DKIM_HEADERS=From, Subject",
+		"SHE_ACCOUNT_WORK_MAIL_SMTP_REF=main",
+		"SHE_ACCOUNT_WORK_MAIL_SMIME_CERT_FILE=me.pem",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := cfg.GetSmtp("main").Port; got != "465" {
+		t.Errorf("port = %q", got)
+	}
+
+	if got := cfg.GetAccount("me").DKIM.Headers; !slices.Equal(got, StringArray{"From", "Subject"}) {
+		t.Errorf("dkim headers = %q", got)
+	}
+
+	// the other fields are kept
+	if got := cfg.GetAccount("me").DKIM.Selector; got != "mail" {
+		t.Errorf("dkim selector = %q", got)
+	}
+
+	a := cfg.GetAccount("work_mail")
+	if a == nil || a.SmtpRef != "main" || a.SMIME == nil || a.SMIME.CertFile != "me.pem" {
+		t.Errorf("added account = %+v", a)
+	}
+}
@@ -0,0 +1,450 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is the format of a config or message file, told by its
+// extension.
+type Format string
+
+const (
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+	FormatTOML Format = "toml"
+)
+
+// Formats are the supported formats, the default one first.
+var Formats = []Format{FormatYAML, FormatJSON, FormatTOML}
+
+// FormatOf returns the format of filename by its extension, yaml when it
+// has none or another one.
+func FormatOf(filename string) Format {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	}
+
+	return FormatYAML
+}
+
+// ParseFormat returns the format named s, such as toml, yml being yaml.
+func ParseFormat(s string) (Format, error) {
+	s = strings.ToLower(s)
+	if s == "yml" {
+		return FormatYAML, nil
+	}
+
+	if f := Format(s); slices.Contains(Formats, f) {
+		return f, nil
+	}
+
+	return "", fmt.Errorf("unknown format %q, expecting yaml, json or toml", s)
+}
+
+// Files of any format are parsed into yaml nodes, which are decoded the
+// same whatever the format: a string or a list of strings for a
+// StringArray, a table or a mapping for a header.
+
+// parseJSON parses bs as a json document, as yaml is a superset of json
+// which keeps the positions of the values, after checking it is json.
+func parseJSON(filename string, bs []byte) (*yaml.Node, error) {
+	var v any
+	if err := json.Unmarshal(bs, &v); err != nil {
+		var se *json.SyntaxError
+		if errors.As(err, &se) {
+			line, col := position(bs, int(se.Offset))
+			return nil, &ValidationError{File: filename, Line: line, Column: col, Message: se.Error()}
+		}
+
+		return nil, (&source{filename: filename}).wrap(err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return nil, (&source{filename: filename}).wrap(err)
+	}
+
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	return doc.Content[0], nil
+}
+
+// position returns the line and column of offset in bs.
+func position(bs []byte, offset int) (int, int) {
+	offset = min(offset, len(bs))
+	before := bs[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	return line, offset - bytes.LastIndexByte(before, '\n')
+}
+
+// parseTOML parses bs as a toml document. The values of toml documents
+// have no position, their keys keep the order of the file.
+func parseTOML(filename string, bs []byte) (*yaml.Node, error) {
+	var v map[string]any
+	md, err := toml.Decode(string(bs), &v)
+	if err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			return nil, &ValidationError{File: filename, Line: pe.Position.Line, Column: pe.Position.Col, Message: pe.Message}
+		}
+
+		return nil, (&source{filename: filename}).wrap(err)
+	}
+
+	order := make(map[string]int)
+	for i, key := range md.Keys() {
+		if _, ok := order[key.String()]; !ok {
+			order[key.String()] = i
+		}
+	}
+
+	return tomlNode(v, "", order), nil
+}
+
+// tomlNode returns the yaml node of the toml value v at key.
+func tomlNode(v any, key string, order map[string]int) *yaml.Node {
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		slices.SortFunc(keys, func(a, b string) int {
+			return order[joinKey(key, a)] - order[joinKey(key, b)]
+		})
+
+		n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, k := range keys {
+			n.Content = append(n.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k},
+				tomlNode(v[k], joinKey(key, k), order))
+		}
+
+		return n
+	case []map[string]any:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range v {
+			n.Content = append(n.Content, tomlNode(item, key, order))
+		}
+
+		return n
+	case []any:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range v {
+			n.Content = append(n.Content, tomlNode(item, key, order))
+		}
+
+		return n
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v)}
+	case int64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(v, 10)}
+	case float64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: strconv.FormatFloat(v, 'g', -1, 64)}
+	case time.Time:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v.Format(time.RFC3339Nano)}
+	}
+
+	// local dates and times
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: fmt.Sprint(v)}
+}
+
+// joinKey returns the toml key k of the table at key, as in MetaData.Keys.
+func joinKey(key string, k string) string {
+	if key == "" {
+		return toml.Key{k}.String()
+	}
+
+	return key + "." + toml.Key{k}.String()
+}
+
+// marshal returns v written in format.
+func marshal(v any, format Format) ([]byte, error) {
+	bs, err := yaml.Marshal(v)
+	if err != nil || format == FormatYAML {
+		return bs, err
+	}
+
+	// written from the yaml nodes, which keep the order of the fields
+	var doc yaml.Node
+	if err = yaml.Unmarshal(bs, &doc); err != nil {
+		return nil, err
+	}
+
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+
+	if format == FormatTOML {
+		var buf bytes.Buffer
+		if err = writeTOML(&buf, root, ""); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	var buf bytes.Buffer
+	if err = writeJSON(&buf, root); err != nil {
+		return nil, err
+	}
+
+	var result bytes.Buffer
+	if err = json.Indent(&result, buf.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+
+	result.WriteString("\n")
+	return result.Bytes(), nil
+}
+
+// writeJSON writes the yaml node n as json, the keys of mappings in
+// order.
+func writeJSON(buf *bytes.Buffer, n *yaml.Node) error {
+	n = resolveAlias(n)
+	switch n.Kind {
+	case yaml.MappingNode:
+		buf.WriteString("{")
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+
+			key, err := json.Marshal(n.Content[i].Value)
+			if err != nil {
+				return err
+			}
+
+			buf.Write(key)
+			buf.WriteString(":")
+			if err = writeJSON(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+
+		buf.WriteString("}")
+	case yaml.SequenceNode:
+		buf.WriteString("[")
+		for i, item := range n.Content {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+
+			if err := writeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+
+		buf.WriteString("]")
+	default:
+		var v any
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		buf.Write(bs)
+	}
+
+	return nil
+}
+
+// writeTOML writes the mapping node n as the toml table at key, its
+// values first as toml requires, then its tables, each in order. Toml
+// has no null: null values are left out.
+func writeTOML(buf *bytes.Buffer, n *yaml.Node, key string) error {
+	var tables []int
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		v := resolveAlias(n.Content[i+1])
+		if isNull(v) {
+			continue
+		}
+
+		if v.Kind == yaml.MappingNode || isTableArray(v) {
+			tables = append(tables, i)
+			continue
+		}
+
+		buf.WriteString(toml.Key{n.Content[i].Value}.String())
+		buf.WriteString(" = ")
+		if err := writeTOMLValue(buf, v); err != nil {
+			return err
+		}
+
+		buf.WriteString("\n")
+	}
+
+	for _, i := range tables {
+		k := joinKey(key, n.Content[i].Value)
+		v := resolveAlias(n.Content[i+1])
+		items := []*yaml.Node{v}
+		header := "[" + k + "]"
+		if v.Kind == yaml.SequenceNode {
+			items = v.Content
+			header = "[[" + k + "]]"
+		}
+
+		for _, item := range items {
+			if buf.Len() > 0 {
+				buf.WriteString("\n")
+			}
+
+			buf.WriteString(header + "\n")
+			if err := writeTOML(buf, resolveAlias(item), k); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeTOMLValue writes the yaml node n as an inline toml value.
+func writeTOMLValue(buf *bytes.Buffer, n *yaml.Node) error {
+	n = resolveAlias(n)
+	switch n.Kind {
+	case yaml.MappingNode:
+		buf.WriteString("{")
+		first := true
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if isNull(resolveAlias(n.Content[i+1])) {
+				continue
+			}
+
+			if !first {
+				buf.WriteString(",")
+			}
+
+			first = false
+			buf.WriteString(" " + toml.Key{n.Content[i].Value}.String() + " = ")
+			if err := writeTOMLValue(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+
+		if !first {
+			buf.WriteString(" ")
+		}
+
+		buf.WriteString("}")
+		return nil
+	case yaml.SequenceNode:
+		buf.WriteString("[")
+		first := true
+		for _, item := range n.Content {
+			if isNull(resolveAlias(item)) {
+				continue
+			}
+
+			if !first {
+				buf.WriteString(", ")
+			}
+
+			first = false
+			if err := writeTOMLValue(buf, item); err != nil {
+				return err
+			}
+		}
+
+		buf.WriteString("]")
+		return nil
+	}
+
+	var v any
+	if err := n.Decode(&v); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case int:
+		buf.WriteString(strconv.Itoa(v))
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+	case uint64:
+		buf.WriteString(strconv.FormatUint(v, 10))
+	case float64:
+		buf.WriteString(tomlFloat(v))
+	case string:
+		// json strings are toml basic strings
+		var s bytes.Buffer
+		enc := json.NewEncoder(&s)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+
+		buf.Write(bytes.TrimSuffix(s.Bytes(), []byte("\n")))
+	default:
+		return fmt.Errorf("%d:%d: %T cannot be written as toml", n.Line, n.Column, v)
+	}
+
+	return nil
+}
+
+// tomlFloat returns f as a toml float, which has a fraction or an
+// exponent to be told from an integer.
+func tomlFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+
+	return s
+}
+
+// isNull reports whether the yaml node n is null.
+func isNull(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.Tag == "!!null"
+}
+
+// isTableArray reports whether the yaml node n is a list of mappings,
+// written as an array of tables.
+func isTableArray(n *yaml.Node) bool {
+	if n.Kind != yaml.SequenceNode || len(n.Content) == 0 {
+		return false
+	}
+
+	for _, item := range n.Content {
+		if resolveAlias(item).Kind != yaml.MappingNode {
+			return false
+		}
+	}
+
+	return true
+}
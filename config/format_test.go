@@ -0,0 +1,165 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `smtp:
+  - name: main
+    host: smtp.example.com
+    port: 587
+    starttls: true
+accounts:
+  - name: me
+    smtpRef: main
+    defaultFrom: Me <me@example.com>
+    dkim:
+      selector: mail
+      privateKeyFile: dkim.pem
+      headers: [From, To, Subject]
+  - name: you
+    smtpRef: main
+    loginUser: you
+    password: env:YOU_PASSWORD
+defaultAccount: me
+queueDir: /var/spool/she
+`
+
+func TestConvertConfig(t *testing.T) {
+	want, err := ParseConfig([]byte(testConfig), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range Formats {
+		t.Run(string(format), func(t *testing.T) {
+			s, err := want.ToString(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ParseConfig([]byte(s), format)
+			if err != nil {
+				t.Fatalf("%v\n%s", err, s)
+			}
+
+			if !reflect.DeepEqual(got.Smtp, want.Smtp) || !reflect.DeepEqual(got.Accounts, want.Accounts) ||
+				got.DefaultAccount != want.DefaultAccount || got.QueueDir != want.QueueDir {
+				t.Errorf("converted config differs:\n%s", s)
+			}
+		})
+	}
+}
+
+func TestMarshalTOML(t *testing.T) {
+	cfg, err := ParseConfig([]byte(testConfig), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := cfg.ToString(FormatTOML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `defaultAccount = "me"
+queueDir = "/var/spool/she"
+
+[[smtp]]
+name = "main"
+host = "smtp.example.com"
+port = "587"
+starttls = "true"
+
+[[accounts]]
+name = "me"
+smtpRef = "main"
+defaultFrom = "Me <me@example.com>"
+
+[accounts.dkim]
+selector = "mail"
+privateKeyFile = "dkim.pem"
+headers = ["From", "To", "Subject"]
+
+[[accounts]]
+name = "you"
+smtpRef = "main"
+loginUser = "you"
+password = "env:YOU_PASSWORD"
+`
+	if s != want {
+		t.Errorf("got:\n%s\nwant:\n%s", s, want)
+	}
+}
+
+// loadTestMessageFile loads content written to a message file of format.
+func loadTestMessageFile(t *testing.T, format Format, content string) *MessageFile {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "mails."+string(format))
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mf, err := LoadMessageFile(filename)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, content)
+	}
+
+	return mf
+}
+
+func TestConvertMessageFile(t *testing.T) {
+	content := `templates:
+  - name: base
+    header:
+      From: me@example.com
+mails:
+  - name: weekly
+    template: base
+    schedule: "0 9 * * 1"
+    spec:
+      header:
+        To: [a@example.com, b@example.com]
+        Subject: weekly
+      body: "hello\n"
+      attachments:
+        - path: report.pdf
+        - name: notes.txt
+          content: some notes
+`
+	want := loadTestMessageFile(t, FormatYAML, content)
+
+	for _, format := range Formats {
+		t.Run(string(format), func(t *testing.T) {
+			s, err := want.ToString(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Contains(s, "stdin") || strings.Contains(s, "contentType") {
+				t.Errorf("empty fields written:\n%s", s)
+			}
+
+			got := loadTestMessageFile(t, format, s)
+			if !reflect.DeepEqual(got.Templates, want.Templates) || !reflect.DeepEqual(got.Mails, want.Mails) {
+				t.Errorf("converted message file differs:\n%s", s)
+			}
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for s, want := range map[string]Format{"yaml": FormatYAML, "YML": FormatYAML, "json": FormatJSON, "toml": FormatTOML} {
+		if got, err := ParseFormat(s); err != nil || got != want {
+			t.Errorf("ParseFormat(%q) = %q, %v, want %q", s, got, err, want)
+		}
+	}
+
+	if _, err := ParseFormat("ini"); err == nil {
+		t.Error("ParseFormat(ini) succeeded")
+	}
+}
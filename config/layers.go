@@ -0,0 +1,258 @@
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// ProjectConfigName is the config file of a project, searched from the
+	// working directory up.
+	ProjectConfigName = ".sendmail.yaml"
+	// SystemConfigFile is the config file shared by the users of a host.
+	SystemConfigFile = "/etc/she/config.yaml"
+	// ConfigEnv names the config files to load instead of the discovered
+	// ones, separated as in PATH.
+	ConfigEnv = "SHE_CONFIG"
+)
+
+// ErrNoConfig is returned when no config file is found.
+var ErrNoConfig = errors.New("no config file found")
+
+// ConfigFiles returns the config files to load, lowest precedence first:
+// files when given, else those of SHE_CONFIG, else the existing ones of
+// /etc/she/config.yaml, $XDG_CONFIG_HOME/she/config.yaml and the nearest
+// .sendmail.yaml from the working directory up, each of which may be
+// .yml, .json or .toml instead.
+func ConfigFiles(files []string) ([]string, error) {
+	return ConfigFilesIn(files, ".")
+}
+
+// ConfigFilesIn is like ConfigFiles run from dir: relative files resolve
+// from it, and the project config is searched from it up.
+func ConfigFilesIn(files []string, dir string) ([]string, error) {
+	if len(files) == 0 {
+		if v := os.Getenv(ConfigEnv); v != "" {
+			files = filepath.SplitList(v)
+		}
+	}
+
+	if len(files) > 0 {
+		var result []string
+		for _, f := range files {
+			if f == "" {
+				continue
+			}
+
+			if !filepath.IsAbs(f) {
+				f = filepath.Join(dir, f)
+			}
+
+			result = append(result, f)
+		}
+
+		return result, nil
+	}
+
+	configDir, err := configDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, f := range []string{SystemConfigFile, filepath.Join(configDir, "config.yaml")} {
+		if f = existingConfigFile(f); f != "" {
+			result = append(result, f)
+		}
+	}
+
+	project, err := findProjectConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if project != "" && !slices.Contains(result, project) {
+		result = append(result, project)
+	}
+
+	return result, nil
+}
+
+// findProjectConfig returns the nearest .sendmail.yaml from dir up, empty
+// if there is none.
+func findProjectConfig(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		if f := existingConfigFile(filepath.Join(dir, ProjectConfigName)); f != "" {
+			return f, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+
+		dir = parent
+	}
+}
+
+// existingConfigFile returns filename, or filename with the extension of
+// another format such as config.toml for config.yaml, the first which
+// exists, empty if none does.
+func existingConfigFile(filename string) string {
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	for _, ext := range []string{".yaml", ".yml", ".json", ".toml"} {
+		if f := base + ext; exists(f) {
+			return f
+		}
+	}
+
+	return ""
+}
+
+func exists(filename string) bool {
+	_, err := os.Stat(filename)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// LoadConfigFiles reads and merges the config files, each adding to or
+// overriding the previous ones: smtp configs and accounts replace those
+// of the same name, other settings replace those set before. The
+// environment variables are applied last, and may define the accounts
+// without any file.
+func LoadConfigFiles(files []string) (*AppConfig, error) {
+	result := &AppConfig{}
+	for i, f := range files {
+		c, err := loadConfigFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			result = c
+		} else {
+			result.merge(c)
+		}
+	}
+
+	if err := result.applyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 && len(result.Accounts) == 0 {
+		return nil, ErrNoConfig
+	}
+
+	return result, nil
+}
+
+// merge adds the settings of o to c.
+func (c *AppConfig) merge(o *AppConfig) {
+	for _, s := range o.Smtp {
+		if i := slices.IndexFunc(c.Smtp, func(cs SmtpConfig) bool { return cs.Name == s.Name }); i >= 0 {
+			c.Smtp[i] = s
+		} else {
+			c.Smtp = append(c.Smtp, s)
+		}
+	}
+
+	for _, a := range o.Accounts {
+		if i := slices.IndexFunc(c.Accounts, func(ca AccountConfig) bool { return ca.Name == a.Name }); i >= 0 {
+			c.Accounts[i] = a
+		} else {
+			c.Accounts = append(c.Accounts, a)
+		}
+	}
+
+	if o.DefaultAccount != "" {
+		c.DefaultAccount = o.DefaultAccount
+	}
+
+	if o.Relay != nil {
+		c.Relay = o.Relay
+	}
+
+	if o.QueueDir != "" {
+		c.QueueDir = o.QueueDir
+	}
+
+	if o.ScheduleFilename != "" {
+		c.ScheduleFilename = o.ScheduleFilename
+	}
+
+	if o.JournalFilename != "" {
+		c.JournalFilename = o.JournalFilename
+	}
+
+	c.files = append(c.files, o.files...)
+	c.sources = append(c.sources, o.sources...)
+	// a merged config is not written back to a single file
+	c.encryption = nil
+	c.index()
+}
+
+// Files returns the files the config was read from, lowest precedence
+// first.
+func (c *AppConfig) Files() []string {
+	return c.files
+}
+
+// resolvePaths makes the relative paths of the config, those of files
+// and of file: secrets, relative to dir, the directory of the file
+// defining them rather than the working directory.
+func (c *AppConfig) resolvePaths(dir string) {
+	c.QueueDir = resolvePath(dir, c.QueueDir)
+	c.ScheduleFilename = resolvePath(dir, c.ScheduleFilename)
+	c.JournalFilename = resolvePath(dir, c.JournalFilename)
+	if c.Relay != nil {
+		c.Relay.CertFile = resolvePath(dir, c.Relay.CertFile)
+		c.Relay.KeyFile = resolvePath(dir, c.Relay.KeyFile)
+	}
+
+	for i := range c.Accounts {
+		a := &c.Accounts[i]
+		a.Password = resolveSecretPath(dir, a.Password)
+		if a.DKIM != nil {
+			a.DKIM.PrivateKeyFile = resolvePath(dir, a.DKIM.PrivateKeyFile)
+		}
+
+		if a.SMIME != nil {
+			a.SMIME.CertFile = resolvePath(dir, a.SMIME.CertFile)
+			a.SMIME.KeyFile = resolvePath(dir, a.SMIME.KeyFile)
+			a.SMIME.RecipientCertDir = resolvePath(dir, a.SMIME.RecipientCertDir)
+		}
+
+		if a.PGP != nil {
+			a.PGP.Keyring = resolvePath(dir, a.PGP.Keyring)
+			a.PGP.SecretKeyring = resolvePath(dir, a.PGP.SecretKeyring)
+			a.PGP.Passphrase = resolveSecretPath(dir, a.PGP.Passphrase)
+		}
+	}
+}
+
+// resolvePath returns path joined to dir when relative. Paths from the
+// home directory and templates, only known once executed, are kept.
+func resolvePath(dir string, path string) string {
+	if path == "" || filepath.IsAbs(path) || path == "~" || strings.HasPrefix(path, "~/") || strings.Contains(path, "{{") {
+		return path
+	}
+
+	return filepath.Join(dir, path)
+}
+
+// resolveSecretPath resolves the path of a file: secret reference.
+func resolveSecretPath(dir string, s string) string {
+	if !strings.HasPrefix(s, secretFile) {
+		return s
+	}
+
+	return secretFile + resolvePath(dir, strings.TrimPrefix(s, secretFile))
+}
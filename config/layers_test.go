@@ -0,0 +1,62 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigFilesResolvesPaths(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.yaml")
+	content := `smtp:
+  - name: main
+    host: smtp.example.com
+    port: 587
+accounts:
+  - name: me
+    smtpRef: main
+    password: file:secrets/smtp
+    defaultFrom: me@example.com
+    dkim:
+      selector: mail
+      privateKeyFile: keys/dkim.pem
+    smime:
+      certFile: /etc/ssl/me.pem
+      keyFile: ~/me.key
+    pgp:
+      keyring: '{{ env "KEYRING" }}'
+queueDir: queue
+journalFile: ../journal.jsonl
+`
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfigFiles([]string{filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := cfg.GetAccount("me")
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"queueDir", cfg.QueueDir, filepath.Join(dir, "queue")},
+		{"journalFile", cfg.JournalFilename, filepath.Join(filepath.Dir(dir), "journal.jsonl")},
+		{"scheduleFile", cfg.ScheduleFilename, ""},
+		{"password", a.Password, "file:" + filepath.Join(dir, "secrets/smtp")},
+		{"privateKeyFile", a.DKIM.PrivateKeyFile, filepath.Join(dir, "keys/dkim.pem")},
+		{"certFile", a.SMIME.CertFile, "/etc/ssl/me.pem"},
+		{"keyFile", a.SMIME.KeyFile, "~/me.key"},
+		{"keyring", a.PGP.Keyring, `{{ env "KEYRING" }}`},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
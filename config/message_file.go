@@ -3,8 +3,9 @@ package config
 import (
 	"net/textproto"
 	"os"
+	"strings"
 
-	"gopkg.in/yaml.v3"
+	"github.com/lifeym/she/mail"
 )
 
 type mailHeaderData map[string]StringArray
@@ -25,29 +26,96 @@ func (h mailHeaderData) ToMIMEHeader() textproto.MIMEHeader {
 }
 
 type messageAttachment struct {
-	Name   string
-	Path   string
-	Header mailHeaderData
+	Name string `yaml:",omitempty"`
+	// Path of the file to attach, may be a glob pattern matching several
+	// files, a directory is attached as an archive.
+	Path        string `yaml:",omitempty"`
+	ContentType string `yaml:"contentType,omitempty"`
+	// Archive format of an attached directory, zip (default) or tar.gz.
+	Archive string `yaml:",omitempty"`
+	// Required defaults to true, when false a path matching nothing
+	// is skipped instead of failing.
+	Required *bool `yaml:",omitempty"`
+	// Message marks the attachment as an embedded mail (message/rfc822),
+	// which .eml files are by default.
+	Message bool `yaml:",omitempty"`
+	// Content, Stdin and Command are alternatives to Path: inline text
+	// rendered as a template, the standard input of the process, or the
+	// output of a command (a single entry is run by the shell, several
+	// entries are run directly).
+	Content string         `yaml:",omitempty"`
+	Stdin   bool           `yaml:",omitempty"`
+	Command StringArray    `yaml:",omitempty"`
+	Header  mailHeaderData `yaml:",omitempty"`
+}
+
+func (a *messageAttachment) IsRequired() bool {
+	return a.Required == nil || *a.Required
+}
+
+// describe names the source of the attachment in error messages.
+func (a *messageAttachment) describe() string {
+	switch {
+	case a.Stdin:
+		return "stdin"
+	case len(a.Command) > 0:
+		return "command output: " + strings.Join(a.Command, " ")
+	case a.Content != "":
+		return "content"
+	default:
+		return "file: " + a.Path
+	}
+}
+
+func (a *messageAttachment) mimeHeader() textproto.MIMEHeader {
+	header := a.Header.ToMIMEHeader()
+	// an explicit content type takes precedence over detection
+	if a.ContentType != "" {
+		header.Set("Content-Type", a.ContentType)
+	} else if a.Message {
+		header.Set("Content-Type", mail.MessageContentType)
+	}
+
+	return header
 }
 
 // Message file
 type messageTemplate struct {
 	Name        string
-	Header      mailHeaderData
-	Body        string
-	Attachments []messageAttachment
+	Header      mailHeaderData      `yaml:",omitempty"`
+	Body        string              `yaml:",omitempty"`
+	Attachments []messageAttachment `yaml:",omitempty"`
 }
 
 type messageSpec struct {
-	Header      mailHeaderData
-	Body        string
-	Attachments []messageAttachment
+	Header      mailHeaderData      `yaml:",omitempty"`
+	Body        string              `yaml:",omitempty"`
+	Attachments []messageAttachment `yaml:",omitempty"`
+	// InReplyTo and References thread the message, each is either a
+	// Message-ID such as <id@example.com>, or the key of a mail of the
+	// message file standing for the first message sent or queued with
+	// it. Sending fails while there is none, unless the key is the one of
+	// the mail itself, whose first message then starts the thread.
+	InReplyTo  string      `yaml:"inReplyTo,omitempty"`
+	References StringArray `yaml:"references,omitempty"`
+	// SMIME overrides whether the message is signed or encrypted with
+	// the S/MIME settings of the account.
+	SMIME *smimeSpec `yaml:"smime,omitempty"`
+	// PGP overrides whether the message is signed with the PGP settings
+	// of the account, and encrypts it to keys of the account keyring.
+	PGP *pgpSpec `yaml:"pgp,omitempty"`
 }
 
 type mailConfig struct {
 	Name     string
 	Template string
-	Spec     messageSpec
+	// Schedule defers the mail when sent, either an absolute time or a
+	// cron expression repeating it, see she daemon.
+	Schedule string `yaml:",omitempty"`
+	// Key identifies the message in the send journal, so that send
+	// --resume skips it once delivered, the mail name by default.
+	Key  string `yaml:",omitempty"`
+	Spec messageSpec
 }
 
 type MessageFile struct {
@@ -55,6 +123,10 @@ type MessageFile struct {
 	Mails              []mailConfig
 	messageTemplateMap map[string]*messageTemplate
 	mailMap            map[string]*mailConfig
+	// the parsed file, see Validate
+	source *source
+	// workDir is where relative paths of attachments resolve from
+	workDir string
 }
 
 func LoadMessageFile(filename string) (*MessageFile, error) {
@@ -63,12 +135,16 @@ func LoadMessageFile(filename string) (*MessageFile, error) {
 		return nil, err
 	}
 
-	mf := MessageFile{}
-	err = yaml.Unmarshal(bs, &mf)
+	src, err := parseSource(filename, FormatOf(filename), bs)
 	if err != nil {
 		return nil, err
 	}
 
+	mf := MessageFile{source: src}
+	if err = src.decode(&mf, MessageSchema()); err != nil {
+		return nil, err
+	}
+
 	mf.messageTemplateMap = make(map[string]*messageTemplate)
 	for _, ts := range mf.Templates {
 		mf.messageTemplateMap[ts.Name] = &ts
@@ -82,6 +158,12 @@ func LoadMessageFile(filename string) (*MessageFile, error) {
 	return &mf, nil
 }
 
+// SetWorkDir sets the directory the paths of attachments and their
+// commands resolve from, instead of the working directory.
+func (mf *MessageFile) SetWorkDir(dir string) {
+	mf.workDir = dir
+}
+
 func (mf *MessageFile) GetTemplate(name string) *messageTemplate {
 	return mf.messageTemplateMap[name]
 }
@@ -90,8 +172,19 @@ func (mf *MessageFile) GetMail(name string) *mailConfig {
 	return mf.mailMap[name]
 }
 
-func (mf *MessageFile) ToString() (string, error) {
-	bs, err := yaml.Marshal(mf)
+// SaveToFile writes the message file in the format of filename.
+func (mf *MessageFile) SaveToFile(filename string) error {
+	bs, err := marshal(mf, FormatOf(filename))
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, bs, 0644)
+}
+
+// ToString returns the message file written in format.
+func (mf *MessageFile) ToString(format Format) (string, error) {
+	bs, err := marshal(mf, format)
 	if err != nil {
 		return "", err
 	}
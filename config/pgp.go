@@ -0,0 +1,170 @@
+package config
+
+import (
+	"fmt"
+	netmail "net/mail"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/lifeym/she/mail"
+)
+
+// PGPConfig configures the PGP/MIME signing and encryption of the
+// messages of an account, keys are read from local keyring files.
+type PGPConfig struct {
+	// Keyring holds the public keys of the recipients.
+	Keyring string `yaml:",omitempty"`
+	// SecretKeyring holds the signing key, Keyring by default.
+	SecretKeyring string `yaml:"secretKeyring,omitempty"`
+	// SigningKey is the email, key id or fingerprint of the signing key,
+	// the default from address by default.
+	SigningKey string `yaml:"signingKey,omitempty"`
+	Passphrase string `yaml:",omitempty"`
+	// Sign and AttachPublicKey are the defaults of the mails of the
+	// account, Sign defaults to true.
+	Sign            string `yaml:",omitempty"`
+	AttachPublicKey string `yaml:"attachPublicKey,omitempty"`
+}
+
+// pgpSpec overrides the PGP defaults of the account for a mail.
+type pgpSpec struct {
+	Sign *bool `yaml:",omitempty"`
+	// EncryptTo encrypts the message to the keys of the keyring matching
+	// these emails, key ids or fingerprints.
+	EncryptTo       StringArray `yaml:"encryptTo,omitempty"`
+	AttachPublicKey *bool       `yaml:"attachPublicKey,omitempty"`
+}
+
+func (s *pgpSpec) requested() bool {
+	return s != nil && (s.Sign != nil && *s.Sign || len(s.EncryptTo) > 0 || s.AttachPublicKey != nil && *s.AttachPublicKey)
+}
+
+type compiledPGP struct {
+	keyring         openpgp.EntityList
+	signer          *openpgp.Entity
+	sign            bool
+	attachPublicKey bool
+}
+
+func compilePGP(t *SheTemplate, pc *PGPConfig, defaultFrom string) (*compiledPGP, error) {
+	result := compiledPGP{}
+	keyring, err := t.Execute(pc.Keyring, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyring != "" {
+		if result.keyring, err = mail.ReadKeyRing(keyring); err != nil {
+			return nil, err
+		}
+	}
+
+	secretKeyring, err := t.Execute(pc.SecretKeyring, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	secretKeys := result.keyring
+	if secretKeyring != "" {
+		if secretKeys, err = mail.ReadKeyRing(secretKeyring); err != nil {
+			return nil, err
+		}
+	}
+
+	signingKey, err := t.Execute(pc.SigningKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key of the from address is only used when there is one, the
+	// account can still encrypt without it
+	explicit := signingKey != ""
+	if !explicit {
+		if from, err := netmail.ParseAddress(defaultFrom); err == nil {
+			signingKey = from.Address
+		}
+	}
+
+	signer, err := mail.FindKey(secretKeys, signingKey)
+	switch {
+	case err == nil && signer.PrivateKey != nil:
+		passphrase, err := compileSecret(t, pc.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = mail.DecryptKey(signer, []byte(passphrase)); err != nil {
+			return nil, err
+		}
+
+		result.signer = signer
+	case explicit && err != nil:
+		return nil, err
+	case explicit:
+		return nil, fmt.Errorf("pgp: no private key for %s", signingKey)
+	}
+
+	if result.sign, err = compileBool(t, pc.Sign, result.signer != nil); err != nil {
+		return nil, err
+	}
+
+	if result.attachPublicKey, err = compileBool(t, pc.AttachPublicKey, false); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// apply sets up the PGP protection of msg, spec overriding the defaults
+// of the account.
+func (cp *compiledPGP) apply(t *SheTemplate, msg *mail.Message, spec *pgpSpec) error {
+	sign, attachPublicKey := cp.sign, cp.attachPublicKey
+	var encryptTo []string
+	if spec != nil {
+		if spec.Sign != nil {
+			sign = *spec.Sign
+		}
+
+		if spec.AttachPublicKey != nil {
+			attachPublicKey = *spec.AttachPublicKey
+		}
+
+		for _, to := range spec.EncryptTo {
+			cto, err := t.Execute(to, nil)
+			if err != nil {
+				return err
+			}
+
+			encryptTo = append(encryptTo, cto)
+		}
+	}
+
+	if !sign && len(encryptTo) == 0 {
+		return nil
+	}
+
+	result := mail.PGP{AttachPublicKey: attachPublicKey}
+	if sign {
+		if cp.signer == nil {
+			return fmt.Errorf("pgp: no private key to sign with")
+		}
+
+		result.Signer = cp.signer
+	}
+
+	for _, to := range encryptTo {
+		key, err := mail.FindKey(cp.keyring, to)
+		if err != nil {
+			return err
+		}
+
+		result.Recipients = append(result.Recipients, key)
+	}
+
+	// the sender can read the message it sent as well
+	if len(result.Recipients) > 0 && cp.signer != nil {
+		result.Recipients = append(result.Recipients, cp.signer)
+	}
+
+	msg.PGP = &result
+	return nil
+}
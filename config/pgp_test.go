@@ -0,0 +1,203 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// writeKeyring writes a keyring holding the private key of me, encrypted
+// with passphrase, and the public key of you. It returns its path.
+func writeKeyring(t *testing.T, passphrase string) string {
+	t.Helper()
+	config := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+	me, err := openpgp.NewEntity("", "", "me@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	you, err := openpgp.NewEntity("", "", "you@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf strings.Builder
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = me.EncryptPrivateKeys([]byte(passphrase), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = me.SerializePrivateWithoutSigning(w, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = you.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "keyring.asc")
+	if err = os.WriteFile(filename, []byte(buf.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+func TestCompileMailPGP(t *testing.T) {
+	t.Setenv("SHE_TEST_KEYRING", writeKeyring(t, "secret"))
+	t.Setenv("SHE_TEST_PASSPHRASE", "secret")
+	cfg, err := ParseConfig([]byte(`smtp:
+  - name: main
+    host: smtp.example.com
+    port: 587
+    starttls: true
+accounts:
+  - name: me
+    smtpRef: main
+    defaultFrom: Me <me@example.com>
+    pgp:
+      keyring: '{{ env "SHE_TEST_KEYRING" }}'
+      passphrase: env:SHE_TEST_PASSPHRASE
+  - name: unsigned
+    smtpRef: main
+    defaultFrom: me@example.com
+    pgp:
+      keyring: '{{ env "SHE_TEST_KEYRING" }}'
+      passphrase: env:SHE_TEST_PASSPHRASE
+      sign: "false"
+  - name: wrong passphrase
+    smtpRef: main
+    defaultFrom: me@example.com
+    pgp:
+      keyring: '{{ env "SHE_TEST_KEYRING" }}'
+      passphrase: wrong
+  - name: other key
+    smtpRef: main
+    defaultFrom: me@example.com
+    pgp:
+      keyring: '{{ env "SHE_TEST_KEYRING" }}'
+      signingKey: other@example.com
+  - name: public key
+    smtpRef: main
+    defaultFrom: me@example.com
+    pgp:
+      keyring: '{{ env "SHE_TEST_KEYRING" }}'
+      signingKey: you@example.com
+  - name: none
+    smtpRef: main
+    defaultFrom: me@example.com
+`), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mf := loadTestMessageFile(t, FormatYAML, `templates:
+  - name: t
+    header:
+      From: me@example.com
+      To: you@example.com
+      Subject: hello
+    body: hello
+mails:
+  - name: default
+    template: t
+  - name: encrypted
+    template: t
+    spec:
+      pgp:
+        encryptTo: you@example.com
+        attachPublicKey: true
+  - name: unknown recipient
+    template: t
+    spec:
+      pgp:
+        encryptTo: other@example.com
+  - name: unsigned
+    template: t
+    spec:
+      pgp:
+        sign: false
+`)
+	tests := []struct {
+		account    string
+		mail       string
+		signed     bool
+		recipients []string
+		err        string
+	}{
+		{"me", "default", true, nil, ""},
+		// the sender can decrypt the message
+		{"me", "encrypted", true, []string{"you@example.com", "me@example.com"}, ""},
+		{"me", "unknown recipient", false, nil, "pgp: no key found for other@example.com"},
+		{"me", "unsigned", false, nil, ""},
+		{"unsigned", "default", false, nil, ""},
+		{"unsigned", "encrypted", false, []string{"you@example.com", "me@example.com"}, ""},
+		{"wrong passphrase", "default", false, nil, "pgp:"},
+		{"other key", "default", false, nil, "pgp: no key found for other@example.com"},
+		{"public key", "default", false, nil, "pgp: no private key for you@example.com"},
+		{"none", "default", false, nil, ""},
+		{"none", "encrypted", false, nil, "pgp: not configured for account none"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.account+"/"+tt.mail, func(t *testing.T) {
+			cm, err := CompileMail(cfg, mf, tt.account, tt.mail)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %s", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := cm.Message.PGP
+			if !tt.signed && tt.recipients == nil {
+				if p != nil {
+					t.Errorf("PGP = %+v, want none", p)
+				}
+
+				return
+			}
+
+			if (p.Signer != nil) != tt.signed {
+				t.Errorf("signer = %v", p.Signer)
+			}
+
+			if p.Signer != nil && p.Signer.PrivateKey.Encrypted {
+				t.Error("private key not decrypted")
+			}
+
+			var recipients []string
+			for _, e := range p.Recipients {
+				for _, id := range e.Identities {
+					recipients = append(recipients, id.UserId.Email)
+				}
+			}
+
+			if strings.Join(recipients, ",") != strings.Join(tt.recipients, ",") {
+				t.Errorf("recipients = %v, want %v", recipients, tt.recipients)
+			}
+
+			if p.AttachPublicKey != (tt.mail == "encrypted") {
+				t.Errorf("attach public key = %v", p.AttachPublicKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"net/mail"
+	"path"
+	"strings"
+)
+
+// RelayUser is a client allowed to authenticate to the relay.
+type RelayUser struct {
+	User     string
+	Password string
+}
+
+// RelaySender maps envelope senders matching Sender, a pattern such as
+// "*@example.com", to the account relaying their messages.
+type RelaySender struct {
+	Sender  string
+	Account string
+}
+
+// RelayConfig configures the local smtp relay.
+type RelayConfig struct {
+	// Listen is the address to listen on, 127.0.0.1:2525 by default.
+	Listen string
+	// AllowNetworks lists the networks clients may connect from,
+	// loopback only by default.
+	AllowNetworks StringArray `yaml:"allowNetworks,omitempty"`
+	// Users requires clients to authenticate when not empty.
+	Users   []RelayUser   `yaml:"users,omitempty"`
+	Senders []RelaySender `yaml:"senders,omitempty"`
+	// FallbackAccount relays the messages of senders matching no rule nor
+	// default from address, which are rejected when empty.
+	FallbackAccount string `yaml:"fallbackAccount,omitempty"`
+	// MaxMessageSize limits the size of accepted messages, such as "25MB".
+	MaxMessageSize string `yaml:"maxMessageSize,omitempty"`
+	// CertFile and KeyFile enable STARTTLS, clients from other hosts
+	// may only authenticate over TLS.
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+}
+
+// RelayAccount returns the name of the account relaying messages of the
+// envelope sender: the first matching sender rule, else the account whose
+// default from address is sender, else the fallback account of the relay.
+// It returns "" when no account relays the messages of sender.
+func (c *AppConfig) RelayAccount(sender string) string {
+	sender = strings.ToLower(sender)
+	if c.Relay != nil {
+		for _, rs := range c.Relay.Senders {
+			if ok, _ := path.Match(strings.ToLower(rs.Sender), sender); ok {
+				return rs.Account
+			}
+		}
+	}
+
+	for _, account := range c.Accounts {
+		from, err := mail.ParseAddress(account.DefaultFrom)
+		if err == nil && strings.EqualFold(from.Address, sender) {
+			return account.Name
+		}
+	}
+
+	if c.Relay != nil {
+		return c.Relay.FallbackAccount
+	}
+
+	return ""
+}
+
+// MaxSize returns the size limit of relayed messages in bytes.
+func (rc *RelayConfig) MaxSize() (int64, error) {
+	return parseSize(rc.MaxMessageSize)
+}
@@ -0,0 +1,35 @@
+package config
+
+import "testing"
+
+func TestRelayAccount(t *testing.T) {
+	cfg, err := ParseConfig([]byte(testConfig+`relay:
+  senders:
+    - sender: "*@lists.example.com"
+      account: you
+`), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sender   string
+		fallback string
+		want     string
+	}{
+		{"news@lists.example.com", "", "you"},
+		{"News@Lists.Example.com", "", "you"},
+		{"ME@example.com", "", "me"},
+		// not the default account
+		{"other@example.com", "", ""},
+		{"", "", ""},
+		{"other@example.com", "me", "me"},
+	}
+
+	for _, tt := range tests {
+		cfg.Relay.FallbackAccount = tt.fallback
+		if got := cfg.RelayAccount(tt.sender); got != tt.want {
+			t.Errorf("RelayAccount(%q) with fallback %q = %q, want %q", tt.sender, tt.fallback, got, tt.want)
+		}
+	}
+}
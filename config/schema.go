@@ -0,0 +1,377 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Schema is a JSON Schema (draft-07) of config and message files, as used
+// by editors to complete and check them.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 any                `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	Definitions          map[string]*Schema `json:"definitions,omitempty"`
+}
+
+const schemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// Values decoded into strings may be written as numbers or booleans, such
+// as port: 25, they are converted when read.
+var scalarTypes = []string{"string", "number", "boolean"}
+
+// schemaRequired are the fields without which a mail cannot be compiled.
+// Those of smtp configs and accounts but their names may be set by
+// another config file or environment variables, see AppConfig.Validate.
+var schemaRequired = map[reflect.Type][]string{
+	reflect.TypeOf(SmtpConfig{}):      {"name"},
+	reflect.TypeOf(AccountConfig{}):   {"name"},
+	reflect.TypeOf(RelaySender{}):     {"sender", "account"},
+	reflect.TypeOf(messageTemplate{}): {"name"},
+	reflect.TypeOf(mailConfig{}):      {"name", "template"},
+}
+
+// ConfigSchema returns the schema of config files.
+func ConfigSchema() *Schema {
+	return newSchema("she config", reflect.TypeOf(AppConfig{}))
+}
+
+// MessageSchema returns the schema of message files.
+func MessageSchema() *Schema {
+	return newSchema("she message file", reflect.TypeOf(MessageFile{}))
+}
+
+func newSchema(title string, t reflect.Type) *Schema {
+	definitions := make(map[string]*Schema)
+	root := schemaOf(t, definitions)
+	return &Schema{
+		Schema:      schemaDraft,
+		Title:       title,
+		Ref:         root.Ref,
+		Definitions: definitions,
+	}
+}
+
+// definitionName names the definition of the type t, unexported types
+// such as messageSpec being capitalized.
+func definitionName(t reflect.Type) string {
+	return strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+}
+
+// schemaOf returns the schema of values decoded into t, the named struct
+// types being added to definitions and referred to.
+func schemaOf(t reflect.Type, definitions map[string]*Schema) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeOf(StringArray{}) {
+		name := definitionName(t)
+		definitions[name] = &Schema{OneOf: []*Schema{
+			{Type: scalarTypes},
+			{Type: "array", Items: &Schema{Type: scalarTypes}},
+		}}
+
+		return &Schema{Ref: "#/definitions/" + name}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		name := definitionName(t)
+		if _, ok := definitions[name]; !ok {
+			result := &Schema{
+				Type:                 "object",
+				Properties:           make(map[string]*Schema),
+				AdditionalProperties: false,
+				Required:             schemaRequired[t],
+			}
+
+			// added first, the struct may refer to itself
+			definitions[name] = result
+			for key, ft := range yamlFields(t) {
+				result.Properties[key] = schemaOf(ft, definitions)
+			}
+		}
+
+		return &Schema{Ref: "#/definitions/" + name}
+	case reflect.Slice:
+		return &Schema{Type: "array", Items: schemaOf(t.Elem(), definitions)}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOf(t.Elem(), definitions)}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int64:
+		return &Schema{Type: "integer"}
+	}
+
+	return &Schema{Type: scalarTypes}
+}
+
+// yamlFields returns the fields of the struct type t by key, those of
+// inlined structs included.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	result := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+
+		if strings.Contains(opts, "inline") {
+			for k, ft := range yamlFields(f.Type) {
+				result[k] = ft
+			}
+
+			continue
+		}
+
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+
+		result[name] = f.Type
+	}
+
+	return result
+}
+
+// nodeType returns the JSON type of the yaml node n.
+func nodeType(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "object"
+	case yaml.SequenceNode:
+		return "array"
+	}
+
+	switch n.ShortTag() {
+	case "!!null":
+		return "null"
+	case "!!bool":
+		return "boolean"
+	case "!!int":
+		return "integer"
+	case "!!float":
+		return "number"
+	}
+
+	return "string"
+}
+
+func typeMatches(types any, actual string) bool {
+	var names []string
+	switch ts := types.(type) {
+	case string:
+		names = []string{ts}
+	case []string:
+		names = ts
+	default:
+		return true
+	}
+
+	return slices.Contains(names, actual) || actual == "integer" && slices.Contains(names, "number")
+}
+
+// describeType names types in messages, such as "a string or a list".
+func describeType(types any) string {
+	names := map[string]string{
+		"object":  "a mapping",
+		"array":   "a list",
+		"string":  "a string",
+		"number":  "a number",
+		"integer": "an integer",
+		"boolean": "true or false",
+	}
+
+	var result []string
+	switch ts := types.(type) {
+	case string:
+		result = append(result, names[ts])
+	case []string:
+		if slices.Equal(ts, scalarTypes) {
+			return names["string"]
+		}
+
+		for _, t := range ts {
+			result = append(result, names[t])
+		}
+	}
+
+	return strings.Join(result, " or ")
+}
+
+// schemaValidator checks yaml nodes against a schema, reporting problems
+// at the position of the nodes.
+type schemaValidator struct {
+	*validator
+	definitions map[string]*Schema
+}
+
+func (sv *schemaValidator) resolve(s *Schema) *Schema {
+	for s != nil && s.Ref != "" {
+		s = sv.definitions[strings.TrimPrefix(s.Ref, "#/definitions/")]
+	}
+
+	return s
+}
+
+// matches tells whether n is valid, without reporting anything.
+func (sv *schemaValidator) matches(n *yaml.Node, s *Schema) bool {
+	probe := schemaValidator{&validator{src: sv.src}, sv.definitions}
+	probe.check(n, s, "")
+	return len(probe.errs) == 0
+}
+
+// check reports the problems of n against s, path naming n in messages.
+func (sv *schemaValidator) check(n *yaml.Node, s *Schema, path string) {
+	n = resolveAlias(n)
+	s = sv.resolve(s)
+	if n == nil || s == nil {
+		return
+	}
+
+	at := path
+	if at != "" {
+		at += ": "
+	}
+
+	// an empty value is decoded as the zero value of any type
+	actual := nodeType(n)
+	if actual == "null" {
+		return
+	}
+
+	if s.OneOf != nil {
+		var alternatives []string
+		for _, alt := range s.OneOf {
+			if sv.matches(n, alt) {
+				return
+			}
+
+			alternatives = append(alternatives, describeType(sv.resolve(alt).Type))
+		}
+
+		sv.add(n, "%sexpecting %s", at, strings.Join(alternatives, " or "))
+		return
+	}
+
+	if s.Type != nil && !typeMatches(s.Type, actual) {
+		sv.add(n, "%sexpecting %s", at, describeType(s.Type))
+		return
+	}
+
+	switch actual {
+	case "object":
+		sv.checkObject(n, s, path)
+	case "array":
+		for i, item := range n.Content {
+			sv.check(item, s.Items, itemPath(path, i, item))
+		}
+	}
+}
+
+func (sv *schemaValidator) checkObject(n *yaml.Node, s *Schema, path string) {
+	at := path
+	if at != "" {
+		at += ": "
+	}
+
+	present := make(map[string]bool)
+	for _, pair := range mappingPairs(n) {
+		key, value := pair[0], pair[1]
+		present[key.Value] = nodeType(resolveAlias(value)) != "null"
+		keyPath := key.Value
+		if path != "" {
+			keyPath = path + "." + key.Value
+		}
+
+		if ps, ok := s.Properties[key.Value]; ok {
+			sv.check(value, ps, keyPath)
+			continue
+		}
+
+		switch ap := s.AdditionalProperties.(type) {
+		case *Schema:
+			sv.check(value, ap, keyPath)
+		case bool:
+			if !ap {
+				sv.add(key, "%sunknown field %s%s", at, key.Value, suggestField(key.Value, s.Properties))
+			}
+		}
+	}
+
+	for _, required := range s.Required {
+		if !present[required] {
+			sv.add(n, "%s%s is required", at, required)
+		}
+	}
+}
+
+// mappingPairs returns the keys and values of the mapping n, those of the
+// mappings merged with << included.
+func mappingPairs(n *yaml.Node) [][2]*yaml.Node {
+	var result [][2]*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], resolveAlias(n.Content[i+1])
+		if key.Value != "<<" {
+			result = append(result, [2]*yaml.Node{key, value})
+			continue
+		}
+
+		merged := []*yaml.Node{value}
+		if value.Kind == yaml.SequenceNode {
+			merged = value.Content
+		}
+
+		for _, m := range merged {
+			if m = resolveAlias(m); m.Kind == yaml.MappingNode {
+				result = append(result, mappingPairs(m)...)
+			}
+		}
+	}
+
+	return result
+}
+
+// itemPath names the item i of the list at path, by its name when it has
+// one.
+func itemPath(path string, i int, item *yaml.Node) string {
+	if name, _, _ := scalar(item, "name"); name != "" {
+		return fmt.Sprintf("%s[%s]", path, name)
+	}
+
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+// suggestField returns a hint for a key differing from a field only by
+// case, such as smtpref for smtpRef.
+func suggestField(key string, properties map[string]*Schema) string {
+	for name := range properties {
+		if strings.EqualFold(name, key) {
+			return fmt.Sprintf(", did you mean %s?", name)
+		}
+	}
+
+	return ""
+}
+
+// checkSchema reports the problems of the root node of v against schema.
+func (v *validator) checkSchema(schema *Schema) {
+	sv := schemaValidator{v, schema.Definitions}
+	sv.check(v.src.root, schema, "")
+}
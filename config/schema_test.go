@@ -0,0 +1,124 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigSchema(t *testing.T) {
+	schema := ConfigSchema()
+	if schema.Schema != schemaDraft || schema.Ref != "#/definitions/AppConfig" {
+		t.Errorf("root = %s %s", schema.Schema, schema.Ref)
+	}
+
+	tests := []struct {
+		definition string
+		required   []string
+		properties []string
+	}{
+		{"AppConfig", nil, []string{"smtp", "accounts", "defaultAccount", "relay"}},
+		{"SmtpConfig", []string{"name"}, []string{"host", "port", "starttls", "maxMessageSize"}},
+		{"AccountConfig", []string{"name"}, []string{"smtpRef", "messageIdDomain", "dkim"}},
+		{"RelaySender", []string{"sender", "account"}, []string{"sender", "account"}},
+	}
+
+	for _, tt := range tests {
+		d := schema.Definitions[tt.definition]
+		if d == nil {
+			t.Errorf("no definition of %s", tt.definition)
+			continue
+		}
+
+		if d.Type != "object" || d.AdditionalProperties != false {
+			t.Errorf("%s: type %v, additionalProperties %v", tt.definition, d.Type, d.AdditionalProperties)
+		}
+
+		if !reflect.DeepEqual(d.Required, tt.required) {
+			t.Errorf("%s: required %v, want %v", tt.definition, d.Required, tt.required)
+		}
+
+		for _, p := range tt.properties {
+			if d.Properties[p] == nil {
+				t.Errorf("%s: no property %s", tt.definition, p)
+			}
+		}
+	}
+
+	b, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// false is kept, not omitted as empty
+	if !strings.Contains(string(b), `"additionalProperties":false`) {
+		t.Errorf("additionalProperties not written:\n%s", b)
+	}
+}
+
+func TestMessageSchema(t *testing.T) {
+	schema := MessageSchema()
+	mail := schema.Definitions["MailConfig"]
+	if mail == nil || !reflect.DeepEqual(mail.Required, []string{"name", "template"}) {
+		t.Fatalf("MailConfig = %+v", mail)
+	}
+
+	// headers are a mapping of any field to a string or a list
+	header := schema.Definitions["MessageTemplate"].Properties["header"]
+	values, ok := header.AdditionalProperties.(*Schema)
+	if header.Type != "object" || !ok || values.Ref != "#/definitions/StringArray" {
+		t.Errorf("header = %+v", header)
+	}
+
+	oneOf := schema.Definitions["StringArray"].OneOf
+	if len(oneOf) != 2 || oneOf[1].Type != "array" {
+		t.Errorf("StringArray = %+v", oneOf)
+	}
+}
+
+func TestSuggestField(t *testing.T) {
+	properties := ConfigSchema().Definitions["AccountConfig"].Properties
+	for key, want := range map[string]string{
+		"smtpref":         ", did you mean smtpRef?",
+		"SMTPREF":         ", did you mean smtpRef?",
+		"messageIDDomain": ", did you mean messageIdDomain?",
+		"smtp":            "",
+		"smtpRefs":        "",
+	} {
+		if got := suggestField(key, properties); got != want {
+			t.Errorf("suggestField(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestSchemaStringArray(t *testing.T) {
+	const mails = `templates:
+  - name: t
+    header:
+      To: %s
+    attachments:
+      - command: %s
+`
+	tests := []struct {
+		name   string
+		header string
+		cmd    string
+		want   string
+	}{
+		{"strings", "you@example.com", "echo hello", ""},
+		{"lists", "[you@example.com, me@example.com]", "[echo, hello]", ""},
+		{"scalars", "1", "[echo, 1, true]", ""},
+		{"mapping", "{a: b}", "echo", "mails.yaml:4:11: templates[t].header.To: expecting a string or a list"},
+		{"list of lists", "you@example.com", "[[echo]]", "mails.yaml:6:18: templates[t].attachments[0].command: expecting a string or a list"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateNamed(t, "mails.yaml", fmt.Sprintf(mails, tt.header, tt.cmd)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Secret references, such as the password of an account, are values
+// read when compiled instead of being written in the config file:
+//
+//	env:SMTP_PASSWORD          the environment variable SMTP_PASSWORD
+//	file:~/.secrets/smtp       the content of a file, trailing newlines removed
+//	cmd:pass show smtp/foo     the first line printed by a shell command
+//	keyring:smtp/foo           an entry of the keyring, see she secret
+//
+// Any other value is the secret itself.
+const (
+	secretEnv     = "env:"
+	secretFile    = "file:"
+	secretCmd     = "cmd:"
+	secretKeyring = "keyring:"
+)
+
+// ErrSecretNotFound is returned when a secret reference names nothing.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// ResolveSecret returns the secret s refers to, or s itself when it is
+// not a reference. Errors describe the reference, never the secret.
+func ResolveSecret(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, secretEnv):
+		name := strings.TrimPrefix(s, secretEnv)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%s: %w", s, ErrSecretNotFound)
+		}
+
+		return v, nil
+	case strings.HasPrefix(s, secretFile):
+		path := expandHome(strings.TrimPrefix(s, secretFile))
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return "", fmt.Errorf("%s: %w", s, ErrSecretNotFound)
+			}
+
+			return "", fmt.Errorf("%s: %w", s, err)
+		}
+
+		return strings.TrimRight(string(bs), "\r\n"), nil
+	case strings.HasPrefix(s, secretCmd):
+		return commandSecret(s)
+	case strings.HasPrefix(s, secretKeyring):
+		keyring, err := OpenKeyring()
+		if err != nil {
+			return "", err
+		}
+
+		v, ok := keyring.Get(strings.TrimPrefix(s, secretKeyring))
+		if !ok {
+			return "", fmt.Errorf("%s: %w", s, ErrSecretNotFound)
+		}
+
+		return v, nil
+	}
+
+	return s, nil
+}
+
+// commandSecret runs the command of the reference s with the shell, its
+// output is kept out of the error, which only carries what it reported.
+func commandSecret(s string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	// the command does not read the standard input, which may be the
+	// message sent or an attachment
+	c := exec.Command("sh", "-c", strings.TrimPrefix(s, secretCmd))
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %w: %s", s, err, msg)
+		}
+
+		return "", fmt.Errorf("%s: %w", s, err)
+	}
+
+	line, _, _ := strings.Cut(stdout.String(), "\n")
+	line = strings.TrimSuffix(line, "\r")
+	if line == "" {
+		return "", fmt.Errorf("%s: %w", s, ErrSecretNotFound)
+	}
+
+	return line, nil
+}
+
+// compileSecret executes the template s then resolves the secret it
+// refers to, the secret itself is never executed as a template.
+func compileSecret(t *SheTemplate, s string) (string, error) {
+	ref, err := t.Execute(s, nil)
+	if err != nil {
+		// the error would quote a plain secret
+		return "", errors.New("secret: invalid template")
+	}
+
+	return ResolveSecret(ref)
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, path[1:])
+}
+
+// Keyring stands in for the secret service of the desktop, keeping
+// secrets by name in a file only readable by its owner, out of the
+// config file which may then be shared.
+type Keyring struct {
+	path    string
+	secrets map[string]string
+}
+
+// KeyringFile returns the file of the keyring, $XDG_DATA_HOME/she/keyring.json
+// by default.
+func KeyringFile() (string, error) {
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+
+		dataDir = filepath.Join(home, ".local", "share")
+	}
+
+	return filepath.Join(dataDir, "she", "keyring.json"), nil
+}
+
+// OpenKeyring reads the keyring, which is empty until a secret is set.
+func OpenKeyring() (*Keyring, error) {
+	path, err := KeyringFile()
+	if err != nil {
+		return nil, err
+	}
+
+	result := Keyring{path: path, secrets: make(map[string]string)}
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &result, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(bs, &result.secrets); err != nil {
+		return nil, fmt.Errorf("keyring %s: %w", path, err)
+	}
+
+	return &result, nil
+}
+
+// Get returns the secret stored as name.
+func (k *Keyring) Get(name string) (string, bool) {
+	v, ok := k.secrets[name]
+	return v, ok
+}
+
+// Set stores secret as name, replacing any previous one.
+func (k *Keyring) Set(name string, secret string) error {
+	k.secrets[name] = secret
+	return k.save()
+}
+
+// Delete removes the secret stored as name.
+func (k *Keyring) Delete(name string) error {
+	if _, ok := k.secrets[name]; !ok {
+		return fmt.Errorf("%s%s: %w", secretKeyring, name, ErrSecretNotFound)
+	}
+
+	delete(k.secrets, name)
+	return k.save()
+}
+
+// Names returns the sorted names of the stored secrets.
+func (k *Keyring) Names() []string {
+	var result []string
+	for name := range k.secrets {
+		result = append(result, name)
+	}
+
+	slices.Sort(result)
+	return result
+}
+
+func (k *Keyring) save() error {
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+
+	bs, err := json.MarshalIndent(k.secrets, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// written aside then renamed, a failed write keeps the previous keyring
+	tmp := k.path + ".tmp"
+	if err = os.WriteFile(tmp, bs, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, k.path)
+}
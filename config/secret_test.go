@@ -0,0 +1,177 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSecret is the secret in the tests, which must never show in
+// errors or messages.
+const testSecret = "s3cr3t-pa55"
+
+func TestResolveSecret(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", dir)
+	t.Setenv("SHE_TEST_SECRET", testSecret)
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte(testSecret+"\r\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := OpenKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = keyring.Set("smtp/me", testSecret); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ref  string
+		want string
+	}{
+		{"env", "env:SHE_TEST_SECRET", testSecret},
+		{"file", "file:" + filepath.Join(dir, "secret"), testSecret},
+		{"cmd", "cmd:printf '%s\\nsecond line\\n' " + testSecret, testSecret},
+		{"keyring", "keyring:smtp/me", testSecret},
+		{"plain", testSecret, testSecret},
+		// unknown schemes are the secret itself
+		{"unknown scheme", "vault:smtp/me", "vault:smtp/me"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveSecret(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSecretNotFound(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	os.Unsetenv("SHE_TEST_MISSING")
+	for _, ref := range []string{
+		"env:SHE_TEST_MISSING",
+		"file:" + filepath.Join(t.TempDir(), "missing"),
+		"cmd:true",
+		"keyring:smtp/missing",
+	} {
+		if _, err := ResolveSecret(ref); !errors.Is(err, ErrSecretNotFound) {
+			t.Errorf("ResolveSecret(%q) = %v, want ErrSecretNotFound", ref, err)
+		}
+	}
+}
+
+// A failing command reports what it printed on stderr, never its output.
+func TestResolveSecretCommandFails(t *testing.T) {
+	_, err := ResolveSecret("cmd:echo " + testSecret + "; echo 'no such entry' >&2; exit 3")
+	if err == nil {
+		t.Fatal("no error")
+	}
+
+	msg := strings.ReplaceAll(err.Error(), "cmd:echo "+testSecret, "")
+	if strings.Contains(msg, testSecret) {
+		t.Errorf("secret in error: %s", err)
+	}
+
+	if !strings.Contains(msg, "no such entry") || !strings.Contains(msg, "exit status 3") {
+		t.Errorf("error = %s", err)
+	}
+}
+
+// The command does not read the standard input, which may carry the
+// message sent.
+func TestResolveSecretCommandStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+	if _, err = w.WriteString(testSecret + "\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	if _, err = ResolveSecret("cmd:cat"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("err = %v, want ErrSecretNotFound", err)
+	}
+}
+
+func TestCompileSecretInvalidTemplate(t *testing.T) {
+	_, err := compileSecret(NewTemplate(), "{{"+testSecret)
+	if err == nil || strings.Contains(err.Error(), testSecret) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+// The resolved password is neither in the printed message nor in the
+// errors of compiling it.
+func TestCompileMailSecret(t *testing.T) {
+	t.Setenv("SHE_TEST_SECRET", testSecret)
+	cfg, err := ParseConfig([]byte(`smtp:
+  - name: main
+    host: smtp.example.com
+    port: 587
+    starttls: true
+accounts:
+  - name: me
+    smtpRef: main
+    loginUser: me
+    password: env:SHE_TEST_SECRET
+    defaultFrom: me@example.com
+  - name: broken
+    smtpRef: other
+    password: env:SHE_TEST_SECRET
+`), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mf := loadTestMessageFile(t, FormatYAML, `templates:
+  - name: t
+    header:
+      From: me@example.com
+      To: you@example.com
+      Subject: hello
+    body: hello
+mails:
+  - name: m
+    template: t
+`)
+	cm, err := CompileMail(cfg, mf, "me", "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cm.Password != testSecret {
+		t.Fatalf("password = %q", cm.Password)
+	}
+
+	var buf bytes.Buffer
+	if _, err = cm.Message.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(buf.String(), testSecret) {
+		t.Errorf("secret in message:\n%s", buf.String())
+	}
+
+	if _, err = CompileMail(cfg, mf, "broken", "m"); err == nil || strings.Contains(err.Error(), testSecret) {
+		t.Errorf("err = %v", err)
+	}
+}
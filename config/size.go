@@ -0,0 +1,186 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lifeym/she/mail"
+)
+
+// Policies applied when a message exceeds the maximum message size.
+const (
+	OversizeFail     = "fail"
+	OversizeCompress = "compress"
+	OversizeSplit    = "split"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"kib", 1 << 10},
+	{"mib", 1 << 20},
+	{"gib", 1 << 30},
+	{"kb", 1 << 10},
+	{"mb", 1 << 20},
+	{"gb", 1 << 30},
+	{"k", 1 << 10},
+	{"m", 1 << 20},
+	{"g", 1 << 30},
+	{"b", 1},
+}
+
+// parseSize parses a size such as "25MB", "512k" or "1048576",
+// units are powers of 1024. An empty string is 0, meaning no limit.
+func parseSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+
+	factor := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			factor = u.factor
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			break
+		}
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+
+	return int64(f * float64(factor)), nil
+}
+
+// formatSize formats n bytes for humans.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// sentHeadersSize is the room kept for the headers set once the message
+// is compiled: Message-ID, Date, In-Reply-To and References. The size of
+// the message as sent is checked again by CheckSize.
+const sentHeadersSize = 512
+
+// messageSize returns the size of m as sent, signed with DKIM when
+// configured. Without signature the attachments are not read again.
+func (cm *CompiledMail) messageSize(m *mail.Message) (int64, error) {
+	if cm.DKIM == nil {
+		return m.Size()
+	}
+
+	return mail.WireSize(m, cm.DKIM)
+}
+
+// wireSize returns the size of m as sent with the room of the headers set
+// when sent.
+func (cm *CompiledMail) wireSize(m *mail.Message) (int64, error) {
+	size, err := cm.messageSize(m)
+	if err != nil {
+		return 0, err
+	}
+
+	return size + sentHeadersSize, nil
+}
+
+// applySizeLimit checks the size of the compiled message against
+// MaxMessageSize, applying the oversize policy when it is exceeded.
+func (cm *CompiledMail) applySizeLimit() error {
+	if cm.MaxMessageSize <= 0 {
+		return nil
+	}
+
+	size, err := cm.wireSize(cm.Message)
+	if err != nil {
+		return err
+	}
+
+	if size <= cm.MaxMessageSize {
+		return nil
+	}
+
+	switch strings.ToLower(cm.OversizePolicy) {
+	case "", OversizeFail:
+		return cm.oversizeError(cm.Message, size)
+	case OversizeCompress:
+		cm.Message.CompressAttachments()
+		if size, err = cm.wireSize(cm.Message); err != nil {
+			return err
+		}
+
+		if size > cm.MaxMessageSize {
+			return cm.oversizeError(cm.Message, size)
+		}
+
+		return nil
+	case OversizeSplit:
+		// the parts are measured without the headers added when sent
+		plainSize, err := cm.Message.Size()
+		if err != nil {
+			return err
+		}
+
+		parts, err := mail.SplitBySize(cm.Message, cm.MaxMessageSize-(size-plainSize))
+		if errors.Is(err, mail.ErrAttachmentTooLarge) || errors.Is(err, mail.ErrCannotSplit) {
+			return fmt.Errorf("%w\n%w", err, cm.oversizeError(cm.Message, size))
+		}
+
+		if err != nil {
+			return err
+		}
+
+		cm.parts = parts
+		return nil
+	default:
+		return fmt.Errorf("unknown oversize policy: %s", cm.OversizePolicy)
+	}
+}
+
+// CheckSize checks the size of msg, one of the compiled messages with
+// all its headers set, as sent against MaxMessageSize.
+func (cm *CompiledMail) CheckSize(msg *mail.Message) error {
+	if cm.MaxMessageSize <= 0 {
+		return nil
+	}
+
+	size, err := cm.messageSize(msg)
+	if err != nil {
+		return err
+	}
+
+	if size > cm.MaxMessageSize {
+		return cm.oversizeError(msg, size)
+	}
+
+	return nil
+}
+
+// oversizeError reports the size of every attachment of the message.
+func (cm *CompiledMail) oversizeError(msg *mail.Message, size int64) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "message size %s exceeds the limit of %s", formatSize(size), formatSize(cm.MaxMessageSize))
+	for _, att := range msg.Attachments {
+		attSize, err := att.EncodedSize()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&sb, "\n  %-40s %10s", att.Name, formatSize(attSize))
+	}
+
+	return errors.New(sb.String())
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestOversizeSplit(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`smtp:
+  - name: main
+    host: smtp.example.com
+    port: 587
+    starttls: true
+    maxMessageSize: 4k
+    oversizePolicy: split
+accounts:
+  - name: me
+    smtpRef: main
+    defaultFrom: me@example.com
+`), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mf := loadTestMessageFile(t, FormatYAML, fmt.Sprintf(`templates:
+  - name: t
+    header:
+      From: me@example.com
+      To: you@example.com
+      Subject: report
+mails:
+  - name: split
+    template: t
+    spec:
+      body: hello
+      attachments:
+        - name: a.txt
+          content: %[1]s
+        - name: b.txt
+          content: %[1]s
+  - name: long body
+    template: t
+    spec:
+      body: %[2]s
+      attachments:
+        - name: a.txt
+          content: hello
+  - name: long body only
+    template: t
+    spec:
+      body: %[2]s
+`, strings.Repeat("a", 1500), strings.Repeat("b", 5000)))
+	cm, err := CompileMail(cfg, mf, "me", "split")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parts := cm.Messages(); len(parts) != 2 {
+		t.Errorf("%d parts, want 2", len(parts))
+	}
+
+	for _, name := range []string{"long body", "long body only"} {
+		_, err = CompileMail(cfg, mf, "me", name)
+		if err == nil || !strings.Contains(err.Error(), "cannot split below") || !strings.Contains(err.Error(), "exceeds the limit of 4.0 KiB") {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+}
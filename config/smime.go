@@ -0,0 +1,181 @@
+package config
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lifeym/she/mail"
+)
+
+// SMIMEConfig configures the S/MIME signing and encryption of the
+// messages of an account.
+type SMIMEConfig struct {
+	// CertFile holds the PEM encoded certificate of the account, followed
+	// by its intermediate certificates, KeyFile its private key.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// RecipientCertDir holds the certificates of the recipients, named
+	// after their address such as bob@example.com.pem, any other file is
+	// searched for a certificate of the address.
+	RecipientCertDir string `yaml:"recipientCertDir,omitempty"`
+	// Sign and Encrypt are the defaults of the mails of the account,
+	// Sign defaults to true.
+	Sign    string `yaml:",omitempty"`
+	Encrypt string `yaml:",omitempty"`
+}
+
+// smimeSpec overrides the S/MIME defaults of the account for a mail.
+type smimeSpec struct {
+	Sign    *bool `yaml:",omitempty"`
+	Encrypt *bool `yaml:",omitempty"`
+}
+
+func (s *smimeSpec) requested() bool {
+	return s != nil && (s.Sign != nil && *s.Sign || s.Encrypt != nil && *s.Encrypt)
+}
+
+type compiledSMIME struct {
+	signer           *mail.SMIMESigner
+	recipientCertDir string
+	sign             bool
+	encrypt          bool
+}
+
+func compileSMIME(t *SheTemplate, sc *SMIMEConfig) (*compiledSMIME, error) {
+	result := compiledSMIME{}
+	certFile, err := t.Execute(sc.CertFile, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	keyFile, err := t.Execute(sc.KeyFile, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if certFile != "" {
+		certs, err := mail.LoadCertificates(certFile)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := mail.LoadPrivateKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		result.signer = &mail.SMIMESigner{Cert: certs[0], Key: key, Chain: certs[1:]}
+	}
+
+	if result.recipientCertDir, err = t.Execute(sc.RecipientCertDir, nil); err != nil {
+		return nil, err
+	}
+
+	if result.sign, err = compileBool(t, sc.Sign, result.signer != nil); err != nil {
+		return nil, err
+	}
+
+	if result.encrypt, err = compileBool(t, sc.Encrypt, false); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func compileBool(t *SheTemplate, s string, def bool) (bool, error) {
+	cs, err := t.Execute(s, nil)
+	if err != nil || cs == "" {
+		return def, err
+	}
+
+	return strconv.ParseBool(cs)
+}
+
+// recipientCertificate returns the certificate of address found in dir.
+func recipientCertificate(dir string, address string) (*x509.Certificate, error) {
+	for _, ext := range []string{".pem", ".crt", ".cer"} {
+		certs, err := mail.LoadCertificates(filepath.Join(dir, address+ext))
+		if err == nil {
+			return certs[0], nil
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		certs, err := mail.LoadCertificates(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+
+		for _, cert := range certs {
+			if slices.ContainsFunc(cert.EmailAddresses, func(a string) bool { return strings.EqualFold(a, address) }) {
+				return cert, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%w %s", mail.ErrNoRecipientCertificate, address)
+}
+
+// apply sets up the S/MIME protection of msg, spec overriding the
+// defaults of the account.
+func (cs *compiledSMIME) apply(msg *mail.Message, spec *smimeSpec) error {
+	sign, encrypt := cs.sign, cs.encrypt
+	if spec != nil && spec.Sign != nil {
+		sign = *spec.Sign
+	}
+
+	if spec != nil && spec.Encrypt != nil {
+		encrypt = *spec.Encrypt
+	}
+
+	if !sign && !encrypt {
+		return nil
+	}
+
+	result := mail.SMIME{}
+	if sign {
+		if cs.signer == nil {
+			return fmt.Errorf("smime: no certificate to sign with")
+		}
+
+		result.Signer = cs.signer
+	}
+
+	if encrypt {
+		_, to, err := msg.Envelope()
+		if err != nil {
+			return err
+		}
+
+		for _, address := range to {
+			cert, err := recipientCertificate(cs.recipientCertDir, address)
+			if err != nil {
+				return err
+			}
+
+			result.Recipients = append(result.Recipients, cert)
+		}
+
+		// the sender can read the message it sent as well
+		if cs.signer != nil {
+			result.Recipients = append(result.Recipients, cs.signer.Cert)
+		}
+	}
+
+	msg.SMIME = &result
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"text/template"
 
 	"github.com/Masterminds/sprig/v3"
+	"github.com/lifeym/she/mail"
 )
 
 type SheTemplate struct {
@@ -34,6 +35,8 @@ func funcMap() template.FuncMap {
 		return stringPrompt(label)
 	}
 
+	result["fwd"] = mail.ForwardSubject
+
 	return result
 }
 
@@ -0,0 +1,445 @@
+package config
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is a problem found in a config or message file, at a
+// line and column of the file.
+type ValidationError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	// the values of toml files have no position
+	if e.Line == 0 {
+		if e.File == "" {
+			return e.Message
+		}
+
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	}
+
+	if e.File == "" {
+		return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+	}
+
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+}
+
+// ValidationErrors are all the problems found, sorted by position.
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	var lines []string
+	for _, e := range errs {
+		lines = append(lines, e.Error())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// source is a parsed file, kept to report the positions of problems.
+type source struct {
+	filename string
+	root     *yaml.Node
+}
+
+// parseSource parses bs as a document of format, an empty one is an
+// empty mapping.
+func parseSource(filename string, format Format, bs []byte) (*source, error) {
+	var root *yaml.Node
+	switch format {
+	case FormatJSON:
+		n, err := parseJSON(filename, bs)
+		if err != nil {
+			return nil, err
+		}
+
+		root = n
+	case FormatTOML:
+		n, err := parseTOML(filename, bs)
+		if err != nil {
+			return nil, err
+		}
+
+		root = n
+	default:
+		var doc yaml.Node
+		if err := yaml.Unmarshal(bs, &doc); err != nil {
+			return nil, (&source{filename: filename}).wrap(err)
+		}
+
+		if len(doc.Content) > 0 {
+			root = doc.Content[0]
+		}
+	}
+
+	if root == nil {
+		root = &yaml.Node{Kind: yaml.MappingNode, Line: 1, Column: 1}
+	}
+
+	return &source{filename: filename, root: root}, nil
+}
+
+// wrap prefixes err with the file name.
+func (s *source) wrap(err error) error {
+	if s.filename == "" {
+		return err
+	}
+
+	return fmt.Errorf("%s: %w", s.filename, err)
+}
+
+// decode decodes the file into out. The decoder stops at the first value
+// of a wrong type without telling its column, the problems found against
+// schema are returned instead when there are any.
+func (s *source) decode(out any, schema *Schema) error {
+	err := s.root.Decode(out)
+	if err == nil {
+		return nil
+	}
+
+	v := validator{src: s}
+	v.checkSchema(schema)
+	if len(v.errs) == 0 {
+		return s.wrap(err)
+	}
+
+	sortErrors(v.errs)
+	return v.errs
+}
+
+type validator struct {
+	src  *source
+	errs ValidationErrors
+}
+
+func (v *validator) add(n *yaml.Node, format string, args ...any) {
+	v.errs = append(v.errs, &ValidationError{
+		File:    v.src.filename,
+		Line:    n.Line,
+		Column:  n.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n != nil && n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+
+	return n
+}
+
+// mappingValue returns the key and value nodes of key in the mapping n.
+func mappingValue(n *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	n = resolveAlias(n)
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i], resolveAlias(n.Content[i+1])
+		}
+	}
+
+	return nil, nil
+}
+
+// sequenceItems returns the items of the sequence at key of the mapping n.
+func sequenceItems(n *yaml.Node, key string) []*yaml.Node {
+	_, value := mappingValue(n, key)
+	if value == nil || value.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	var result []*yaml.Node
+	for _, item := range value.Content {
+		result = append(result, resolveAlias(item))
+	}
+
+	return result
+}
+
+// isTemplate tells whether s is executed to a value known when compiled
+// only.
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// scalar returns the value at key of the mapping n, and the node to report
+// it at, n itself when the key is missing.
+func scalar(n *yaml.Node, key string) (string, *yaml.Node, bool) {
+	_, value := mappingValue(n, key)
+	if value == nil || value.Kind != yaml.ScalarNode || value.Tag == "!!null" {
+		return "", n, false
+	}
+
+	return value.Value, value, true
+}
+
+// checkNames reports the entries of items with the name of a previous
+// entry, and returns the entries by name.
+func (v *validator) checkNames(items []*yaml.Node, what string) map[string]*yaml.Node {
+	result := make(map[string]*yaml.Node)
+	for _, item := range items {
+		name, at, _ := scalar(item, "name")
+		if name == "" {
+			continue
+		}
+
+		if prev, ok := result[name]; ok {
+			if prev.Line == 0 {
+				v.add(at, "duplicate %s %s", what, name)
+			} else {
+				v.add(at, "duplicate %s %s, first defined at line %d", what, name, prev.Line)
+			}
+
+			continue
+		}
+
+		result[name] = at
+	}
+
+	return result
+}
+
+// entry is an smtp config or account as merged from the files, the
+// last one defining it replacing the others, and the environment
+// variables, its fields checked once merged.
+type entry struct {
+	what   string
+	prefix string
+	name   string
+	// the file defining it last and its node, nil when only defined by
+	// environment variables
+	v    *validator
+	n    *yaml.Node
+	env  []envVar
+	errs *ValidationErrors
+}
+
+// add reports a problem of the field at key, at the environment variable
+// setting it, else at its node in the file.
+func (e *entry) add(key string, format string, args ...any) {
+	message := e.what + ": " + fmt.Sprintf(format, args...)
+	variable := e.prefix + envName(e.name) + "_" + envKey(key)
+	if slices.ContainsFunc(e.env, func(ev envVar) bool { return ev.key == variable }) || e.v == nil {
+		*e.errs = append(*e.errs, &ValidationError{File: variable, Message: message})
+		return
+	}
+
+	_, at, _ := scalar(e.n, key)
+	e.v.add(at, "%s", message)
+}
+
+func (e *entry) checkRequired(key string, value string) {
+	if value == "" {
+		e.add(key, "%s is required", key)
+	}
+}
+
+func (e *entry) checkInt(key string, value string, min int, max int) {
+	if value == "" || isTemplate(value) {
+		return
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil || i < min || i > max {
+		e.add(key, "invalid %s %q, expecting a number from %d to %d", key, value, min, max)
+	}
+}
+
+func (e *entry) checkBool(key string, value string) {
+	if value == "" || isTemplate(value) {
+		return
+	}
+
+	if _, err := strconv.ParseBool(value); err != nil {
+		e.add(key, "invalid %s %q, expecting true or false", key, value)
+	}
+}
+
+func (e *entry) checkSize(maxMessageSize string, oversizePolicy string) {
+	if maxMessageSize != "" && !isTemplate(maxMessageSize) {
+		if _, err := parseSize(maxMessageSize); err != nil {
+			e.add("maxMessageSize", "%s", err)
+		}
+	}
+
+	switch strings.ToLower(oversizePolicy) {
+	case "", OversizeFail, OversizeCompress, OversizeSplit:
+	default:
+		if !isTemplate(oversizePolicy) {
+			e.add("oversizePolicy", "unknown oversize policy %q, expecting %s, %s or %s", oversizePolicy, OversizeFail, OversizeCompress, OversizeSplit)
+		}
+	}
+}
+
+// entries returns the smtp configs, at key smtp, or the accounts of c,
+// by name.
+func (c *AppConfig) entries(validators []*validator, key string, prefix string, names []string, errs *ValidationErrors) []*entry {
+	var result []*entry
+	for _, name := range names {
+		e := &entry{what: key + "[" + name + "]", prefix: prefix, name: name, env: c.env, errs: errs}
+		for _, v := range validators {
+			for _, n := range sequenceItems(v.src.root, key) {
+				if s, _, _ := scalar(n, "name"); s == name {
+					e.v, e.n = v, n
+				}
+			}
+		}
+
+		result = append(result, e)
+	}
+
+	return result
+}
+
+func sortErrors(errs ValidationErrors) {
+	slices.SortStableFunc(errs, func(a, b *ValidationError) int {
+		return cmp.Or(cmp.Compare(a.File, b.File), cmp.Compare(a.Line, b.Line), cmp.Compare(a.Column, b.Column))
+	})
+}
+
+// Validate reports the problems of the config files which would only
+// show when sending: fields unknown to the schema, duplicate names,
+// references to undefined smtp configs or accounts. The smtp configs and
+// accounts are checked once merged with those of the other files and the
+// environment variables, for missing fields, invalid ports and settings.
+func (c *AppConfig) Validate() error {
+	type ref struct {
+		v    *validator
+		name string
+		at   *yaml.Node
+	}
+
+	// references are checked once all the files are read, as a file may
+	// refer to the definitions of another
+	schema := ConfigSchema()
+	var validators []*validator
+	var accountRefs []ref
+	smtpNames := make(map[string]bool)
+	accountNames := make(map[string]bool)
+	// those of the environment variables included
+	for _, s := range c.Smtp {
+		smtpNames[s.Name] = true
+	}
+
+	for _, a := range c.Accounts {
+		accountNames[a.Name] = true
+	}
+
+	for _, src := range c.sources {
+		v := &validator{src: src}
+		validators = append(validators, v)
+		v.checkSchema(schema)
+		v.checkNames(sequenceItems(src.root, "smtp"), "smtp")
+		v.checkNames(sequenceItems(src.root, "accounts"), "account")
+		if s, at, _ := scalar(src.root, "defaultAccount"); s != "" {
+			accountRefs = append(accountRefs, ref{v, s, at})
+		}
+
+		_, relay := mappingValue(src.root, "relay")
+		if s, at, _ := scalar(relay, "fallbackAccount"); s != "" && !isTemplate(s) {
+			accountRefs = append(accountRefs, ref{v, s, at})
+		}
+
+		for _, rs := range sequenceItems(relay, "senders") {
+			if s, at, _ := scalar(rs, "account"); s != "" && !isTemplate(s) {
+				accountRefs = append(accountRefs, ref{v, s, at})
+			}
+		}
+	}
+
+	for _, r := range accountRefs {
+		if !accountNames[r.name] {
+			r.v.add(r.at, "account not found: %s", r.name)
+		}
+	}
+
+	var errs ValidationErrors
+	var names []string
+	for _, s := range c.Smtp {
+		names = append(names, s.Name)
+	}
+
+	for i, e := range c.entries(validators, "smtp", smtpEnvPrefix, names, &errs) {
+		s := c.Smtp[i]
+		e.checkRequired("host", s.Host)
+		e.checkRequired("port", s.Port)
+		e.checkRequired("starttls", s.StartTLS)
+		e.checkInt("port", s.Port, 1, 65535)
+		e.checkBool("starttls", s.StartTLS)
+		e.checkInt("messagesPerMinute", s.MessagesPerMinute, 0, 1<<30)
+		e.checkInt("recipientsPerHour", s.RecipientsPerHour, 0, 1<<30)
+		e.checkSize(s.MaxMessageSize, s.OversizePolicy)
+	}
+
+	names = nil
+	for _, a := range c.Accounts {
+		names = append(names, a.Name)
+	}
+
+	for i, e := range c.entries(validators, "accounts", accountEnvPrefix, names, &errs) {
+		a := c.Accounts[i]
+		e.checkRequired("smtpRef", a.SmtpRef)
+		if a.SmtpRef != "" && !isTemplate(a.SmtpRef) && !smtpNames[a.SmtpRef] {
+			e.add("smtpRef", "smtp config not found: %s", a.SmtpRef)
+		}
+
+		e.checkInt("concurrency", a.Concurrency, 1, 1<<16)
+		e.checkSize(a.MaxMessageSize, a.OversizePolicy)
+	}
+
+	for _, v := range validators {
+		errs = append(errs, v.errs...)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	sortErrors(errs)
+	return errs
+}
+
+// Validate reports the problems of the message file which would only
+// show when sending: fields unknown to or missing from the schema,
+// duplicate names, and mails of undefined templates.
+func (mf *MessageFile) Validate() error {
+	if mf.source == nil {
+		return nil
+	}
+
+	v := validator{src: mf.source}
+	v.checkSchema(MessageSchema())
+	templates := v.checkNames(sequenceItems(mf.source.root, "templates"), "template")
+	mails := sequenceItems(mf.source.root, "mails")
+	v.checkNames(mails, "mail")
+	for _, m := range mails {
+		name, _, _ := scalar(m, "name")
+		s, at, _ := scalar(m, "template")
+		if s != "" && templates[s] == nil && !isTemplate(s) {
+			v.add(at, "mails[%s]: template not found: %s", name, s)
+		}
+	}
+
+	if len(v.errs) == 0 {
+		return nil
+	}
+
+	sortErrors(v.errs)
+	return v.errs
+}
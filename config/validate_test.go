@@ -0,0 +1,225 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// validateFile returns the problems of the config file of content with
+// the environment variables environ.
+func validateFile(t *testing.T, content string, environ ...string) string {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, smtpEnvPrefix) || strings.HasPrefix(kv, accountEnvPrefix) {
+			key, _, _ := strings.Cut(kv, "=")
+			t.Setenv(key, "")
+		}
+	}
+
+	for _, kv := range environ {
+		key, value, _ := strings.Cut(kv, "=")
+		t.Setenv(key, value)
+	}
+
+	return validateNamed(t, "config.yaml", content)
+}
+
+// validateNamed returns the problems found loading and validating the
+// config or message file name of content, the directory of the file
+// trimmed. Message files are those named mails.
+func validateNamed(t *testing.T, name string, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	if strings.HasPrefix(name, "mails.") {
+		var mf *MessageFile
+		if mf, err = LoadMessageFile(filename); err == nil {
+			err = mf.Validate()
+		}
+	} else {
+		var cfg *AppConfig
+		if cfg, err = LoadConfigFiles([]string{filename}); err == nil {
+			err = cfg.Validate()
+		}
+	}
+
+	if err != nil {
+		return strings.ReplaceAll(err.Error(), dir+string(filepath.Separator), "")
+	}
+
+	return ""
+}
+
+func TestValidateMerged(t *testing.T) {
+	const noPort = `smtp:
+  - name: main
+    host: smtp.example.com
+    starttls: true
+accounts:
+  - name: me
+    smtpRef: main
+`
+	tests := []struct {
+		name    string
+		content string
+		environ []string
+		want    string
+	}{
+		{"valid", testConfig, nil, ""},
+		{"missing port", noPort, nil, "config.yaml:2:5: smtp[main]: port is required"},
+		{"port of the environment", noPort, []string{"SHE_SMTP_MAIN_PORT=587"}, ""},
+		{"invalid port of the environment", noPort, []string{"SHE_SMTP_MAIN_PORT=abc"},
+			`SHE_SMTP_MAIN_PORT: smtp[main]: invalid port "abc", expecting a number from 1 to 65535`},
+		{"invalid starttls of the environment", testConfig, []string{"SHE_SMTP_MAIN_STARTTLS=maybe"},
+			`SHE_SMTP_MAIN_STARTTLS: smtp[main]: invalid starttls "maybe", expecting true or false`},
+		{"smtp config of the environment", testConfig, []string{"SHE_SMTP_OTHER_HOST=smtp.example.org", "SHE_SMTP_OTHER_STARTTLS=false"},
+			"SHE_SMTP_OTHER_PORT: smtp[other]: port is required"},
+		{"smtp ref of the environment", testConfig, []string{"SHE_ACCOUNT_ME_SMTP_REF=other"},
+			"SHE_ACCOUNT_ME_SMTP_REF: accounts[me]: smtp config not found: other"},
+		{"relay fallback account", testConfig + "relay:\n  fallbackAccount: other\n", nil,
+			"config.yaml:21:20: account not found: other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateFile(t, tt.content, tt.environ...); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// A file may leave the fields of an smtp config to a file loaded after.
+func TestValidateLayers(t *testing.T) {
+	dir := t.TempDir()
+	global := filepath.Join(dir, "global.yaml")
+	project := filepath.Join(dir, "project.yaml")
+	files := map[string]string{
+		global:  "smtp:\n  - name: main\n    host: smtp.example.com\n    port: 587\n    starttls: true\n",
+		project: "accounts:\n  - name: me\n    smtpRef: main\n    concurrency: 0\n",
+	}
+
+	for filename, content := range files {
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := LoadConfigFiles([]string{global, project})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := project + `:4:18: accounts[me]: invalid concurrency "0", expecting a number from 1 to 65536`
+	if err = cfg.Validate(); err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
+
+func TestValidatePositions(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []string
+	}{
+		{"unknown fields", "config.yaml", `smtp:
+  - name: main
+    host: smtp.example.com
+    port: 587
+    starttls: true
+    smtpHost: smtp.example.org
+accounts:
+  - name: me
+    smtpref: main
+`, []string{
+			"config.yaml:6:5: smtp[main]: unknown field smtpHost",
+			"config.yaml:8:5: accounts[me]: smtpRef is required",
+			"config.yaml:9:5: accounts[me]: unknown field smtpref, did you mean smtpRef?",
+		}},
+		{"wrong type", "config.yaml", "accounts:\n  - name: me\n    smtpRef: main\n    concurrency: [1]\n", []string{
+			"config.yaml:4:18: accounts[me].concurrency: expecting a string",
+		}},
+		{"duplicate names and references", "config.yaml", `smtp:
+  - name: main
+    host: smtp.example.com
+    port: 587
+    starttls: true
+accounts:
+  - name: me
+    smtpRef: main
+  - name: me
+    smtpRef: other
+defaultAccount: you
+`, []string{
+			"config.yaml:9:11: duplicate account me, first defined at line 7",
+			"config.yaml:10:14: accounts[me]: smtp config not found: other",
+			"config.yaml:11:17: account not found: you",
+		}},
+		{"json", "config.json", `{
+  "smtp": [
+    {"name": "main", "host": "smtp.example.com", "port": 70000, "starttls": true}
+  ],
+  "accounts": [{"name": "me", "smtpRef": "other"}]
+}
+`, []string{
+			`config.json:3:58: smtp[main]: invalid port "70000", expecting a number from 1 to 65535`,
+			"config.json:5:42: accounts[me]: smtp config not found: other",
+		}},
+		// the values of toml files have no position
+		{"toml", "config.toml", "[[smtp]]\nname = \"main\"\nhost = \"smtp.example.com\"\nport = 587\nstarttls = true\nbogus = 1\n", []string{
+			"config.toml: smtp[main]: unknown field bogus",
+		}},
+		{"message file", "mails.yaml", `templates:
+  - name: t
+    header:
+      To: you@example.com
+    attachments:
+      - path: a.txt
+        bogus: x
+mails:
+  - name: m
+    template: t
+    spec:
+      body: [hello]
+`, []string{
+			"mails.yaml:7:9: templates[t].attachments[0]: unknown field bogus",
+			"mails.yaml:12:13: mails[m].spec.body: expecting a string",
+		}},
+		{"message file references", "mails.yaml", `templates:
+  - name: t
+mails:
+  - name: m
+    template: other
+  - name: m
+    template: t
+`, []string{
+			"mails.yaml:5:15: mails[m]: template not found: other",
+			"mails.yaml:6:11: duplicate mail m, first defined at line 4",
+		}},
+		{"json message file", "mails.json", `{
+  "mails": [
+    {"name": "m", "template": "t", "Spec": {}}
+  ]
+}
+`, []string{
+			"mails.json:3:31: mails[m]: template not found: t",
+			"mails.json:3:36: mails[m]: unknown field Spec, did you mean spec?",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := validateNamed(t, tt.file, tt.content), strings.Join(tt.want, "\n"); got != want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
@@ -13,8 +13,8 @@ func NewGenericList[T comparable]() GenericList[T] {
 	return []T{}
 }
 
-func (l GenericList[T]) Append(value T) {
-	l = append(l, value)
+func (l *GenericList[T]) Append(value T) {
+	*l = append(*l, value)
 }
 
 func (l GenericList[T]) ValueByIndex(index int) (T, error) {
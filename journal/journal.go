@@ -0,0 +1,183 @@
+// Package journal records the delivered messages in a JSON lines file, so
+// that an interrupted send can be resumed without sending twice and later
+// mails can reply to earlier ones.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a delivered message, those not sent from a message file, such
+// as by sendmail or relay, have no MessageFile, Mail and Key.
+type Entry struct {
+	// MessageFile is the absolute path of the message file
+	MessageFile string `json:"messageFile,omitempty"`
+	Mail        string `json:"mail,omitempty"`
+	// Key identifies the message within its message file, see Journal.Sent.
+	Key       string    `json:"key,omitempty"`
+	Account   string    `json:"account"`
+	MessageID string    `json:"messageId,omitempty"`
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Subject   string    `json:"subject,omitempty"`
+	SentAt    time.Time `json:"sentAt"`
+	// Reply is the reply of the server accepting the message.
+	Reply string `json:"reply,omitempty"`
+}
+
+// Journal is a journal file open for appending.
+type Journal struct {
+	mu   sync.Mutex
+	f    *os.File
+	sent map[string]bool
+	// first entry of each key
+	roots map[string]*Entry
+}
+
+func sentKey(messageFile string, key string) string {
+	return messageFile + "\x00" + key
+}
+
+// Open opens the journal at path, creating it if needed.
+func Open(path string) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// a line truncated by a crash is ended, not continued
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		last := make([]byte, 1)
+		if r, err := os.Open(path); err == nil {
+			_, err = r.ReadAt(last, fi.Size()-1)
+			r.Close()
+			if err == nil && last[0] != '\n' {
+				f.Write([]byte("\n"))
+			}
+		}
+	}
+
+	j := Journal{f: f, sent: make(map[string]bool), roots: make(map[string]*Entry)}
+	for _, e := range entries {
+		j.record(e)
+	}
+
+	return &j, nil
+}
+
+// Sent reports whether the message of messageFile identified by key was
+// delivered already.
+func (j *Journal) Sent(messageFile string, key string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.sent[sentKey(messageFile, key)]
+}
+
+// Add records e, which is written to disk before Add returns.
+func (j *Journal) Add(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// a single write per entry, so that concurrent writers do not mix lines
+	if _, err = j.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	if err = j.f.Sync(); err != nil {
+		return err
+	}
+
+	j.record(e)
+	return nil
+}
+
+func (j *Journal) record(e *Entry) {
+	if e.MessageFile == "" {
+		return
+	}
+
+	k := sentKey(e.MessageFile, e.Key)
+	j.sent[k] = true
+	if _, ok := j.roots[k]; !ok {
+		j.roots[k] = e
+	}
+}
+
+// Root returns the first message of messageFile sent with key, or with
+// the first part of key when it was split, nil if there is none. Later
+// messages with the same key are threaded under it.
+func (j *Journal) Root(messageFile string, key string) *Entry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if e, ok := j.roots[sentKey(messageFile, key)]; ok {
+		return e
+	}
+
+	return j.roots[sentKey(messageFile, key+"#1")]
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
+
+// Read returns the entries of the journal at path, in the order they were
+// added, none if it does not exist. A truncated last line, left by a
+// crash, is ignored.
+func Read(path string) ([]*Entry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	var result []*Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		e := Entry{}
+		if err = json.Unmarshal([]byte(line), &e); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) && !strings.HasSuffix(line, "}") {
+				continue
+			}
+
+			return nil, fmt.Errorf("journal: %s:%d: %w", path, n, err)
+		}
+
+		result = append(result, &e)
+	}
+
+	return result, scanner.Err()
+}
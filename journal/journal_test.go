@@ -0,0 +1,55 @@
+package journal
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []*Entry{
+		{MessageFile: "/m.yaml", Mail: "report", Key: "report#1", MessageID: "<1@example.com>"},
+		{MessageFile: "/m.yaml", Mail: "report", Key: "report#2", MessageID: "<2@example.com>"},
+		// sent by sendmail or relay
+		{MessageID: "<3@example.com>"},
+	}
+
+	for _, e := range entries {
+		if err = j.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j.Close()
+	if j, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+
+	defer j.Close()
+	if !j.Sent("/m.yaml", "report#2") || j.Sent("/other.yaml", "report#2") {
+		t.Error("Sent does not tell the message files apart")
+	}
+
+	if j.Sent("", "") {
+		t.Error("message without message file recorded as sent")
+	}
+
+	// a split message is threaded under its first part
+	if root := j.Root("/m.yaml", "report"); root == nil || root.MessageID != "<1@example.com>" {
+		t.Errorf("Root = %+v", root)
+	}
+
+	got, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 3 || got[2].MessageID != "<3@example.com>" {
+		t.Errorf("Read = %+v", got)
+	}
+}
@@ -0,0 +1,158 @@
+package mail
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Archive formats supported for attaching directories.
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+type archiveFormat struct {
+	ext   string
+	write func(w io.Writer, dir string) error
+}
+
+func lookupArchiveFormat(format string) (*archiveFormat, error) {
+	switch strings.ToLower(format) {
+	case "", ArchiveZip:
+		return &archiveFormat{".zip", writeZip}, nil
+	case ArchiveTarGz, "tgz":
+		return &archiveFormat{".tar.gz", writeTarGz}, nil
+	default:
+		return nil, fmt.Errorf("unsupported archive format: %s", format)
+	}
+}
+
+// ArchiveDir returns a source archiving dir on the fly each time it is
+// opened, format is either ArchiveZip (the default) or ArchiveTarGz.
+func ArchiveDir(dir string, format string) (AttachmentSource, error) {
+	af, err := lookupArchiveFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(af.write(pw, dir))
+		}()
+
+		return pr, nil
+	}, nil
+}
+
+func writeZip(w io.Writer, dir string) error {
+	zw := zip.NewWriter(w)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		fh, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+
+		fh.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			fh.Name += "/"
+		} else {
+			fh.Method = zip.Deflate
+		}
+
+		fw, err := zw.CreateHeader(fh)
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		return copyFile(fw, path)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func writeTarGz(w io.Writer, dir string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		th, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		th.Name = filepath.ToSlash(rel)
+		if err = tw.WriteHeader(th); err != nil || info.IsDir() {
+			return err
+		}
+
+		return copyFile(tw, path)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+
+	return gw.Close()
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
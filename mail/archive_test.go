@@ -0,0 +1,159 @@
+package mail
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeTree creates the files of tree under dir, keyed by their slash
+// separated path.
+func writeTree(t *testing.T, dir string, tree map[string]string) {
+	t.Helper()
+	for name, content := range tree {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readArchive returns the files of the archive data by name, directories
+// having an empty content.
+func readArchive(t *testing.T, format string, data []byte) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	if format == ArchiveZip {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			content, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files[f.Name] = string(content)
+		}
+
+		return files
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(gr)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if th.Typeflag == tar.TypeDir {
+			th.Name += "/"
+		}
+
+		files[th.Name] = string(content)
+	}
+}
+
+func TestArchiveDir(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.log":     "first\n",
+		"sub/b.log": "second\n",
+	})
+
+	want := map[string]string{"a.log": "first\n", "sub/": "", "sub/b.log": "second\n"}
+	for _, format := range []string{ArchiveZip, ArchiveTarGz} {
+		t.Run(format, func(t *testing.T) {
+			source, err := ArchiveDir(dir, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the archive is created again each time it is opened
+			for i := 0; i < 2; i++ {
+				r, err := source()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				data, err := io.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got := readArchive(t, format, data); !reflect.DeepEqual(got, want) {
+					t.Errorf("archive = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+
+	if _, err := ArchiveDir(dir, "rar"); err == nil {
+		t.Error("unsupported format accepted")
+	}
+}
+
+func TestAttachDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	writeTree(t, dir, map[string]string{"a.log": "first\n"})
+	m := testMessage()
+	if err := m.AttachDir(dir, "", "tgz", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AttachDir(dir, "all.zip", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, att := range m.Attachments {
+		names = append(names, att.Name)
+	}
+
+	sort.Strings(names)
+	if want := []string{"all.zip", "logs.tar.gz"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %v, want %v", names, want)
+	}
+
+	if err := m.AttachDir(filepath.Join(dir, "a.log"), "", "", nil); err == nil {
+		t.Error("file attached as a directory")
+	}
+
+	if err := m.AttachDir(filepath.Join(dir, "missing"), "", "", nil); err == nil {
+		t.Error("missing directory attached")
+	}
+}
@@ -0,0 +1,102 @@
+package mail
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// contentTypes maps extensions of common office, archive and data files to
+// their media types, since mime.TypeByExtension depends on the platform and
+// sniffing reports most of them as zip or octet-stream.
+var contentTypes = map[string]string{
+	".7z":   "application/x-7z-compressed",
+	".bz2":  "application/x-bzip2",
+	".csv":  "text/csv",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".eml":  "message/rfc822",
+	".gz":   "application/gzip",
+	".json": "application/json",
+	".log":  "text/plain",
+	".md":   "text/markdown",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".pdf":  "application/pdf",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".rar":  "application/vnd.rar",
+	".rtf":  "application/rtf",
+	".tar":  "application/x-tar",
+	".tgz":  "application/gzip",
+	".tsv":  "text/tab-separated-values",
+	".txt":  "text/plain",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".xml":  "application/xml",
+	".xz":   "application/x-xz",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".zip":  "application/zip",
+}
+
+// typeByExtension returns the media type of a file name by its extension,
+// or an empty string when the extension is unknown.
+func typeByExtension(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == "" {
+		return ""
+	}
+
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+
+	return mime.TypeByExtension(ext)
+}
+
+// DetectContentType returns the Content-Type of an attachment named name
+// whose content starts with head. The extension is trusted first, content
+// sniffing is used for unknown extensions, and a charset is added to text
+// types when head is valid utf-8.
+func DetectContentType(name string, head []byte) string {
+	ct := typeByExtension(name)
+	if ct == "" {
+		ct = http.DetectContentType(head)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return ct
+	}
+
+	if strings.HasPrefix(mediaType, "text/") && params["charset"] == "" && validUTF8Head(head) {
+		params["charset"] = "utf-8"
+	}
+
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// validUTF8Head reports whether head, which may be cut in the middle of a
+// rune, is valid utf-8.
+func validUTF8Head(head []byte) bool {
+	if utf8.Valid(head) {
+		return true
+	}
+
+	if len(head) < sniffLen {
+		return false
+	}
+
+	// drop a trailing partial rune left by truncation
+	for i := len(head) - 1; i >= 0 && i >= len(head)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(head[i]) {
+			return utf8.Valid(head[:i])
+		}
+	}
+
+	return false
+}
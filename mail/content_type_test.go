@@ -0,0 +1,37 @@
+package mail
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"report.pdf", []byte("%PDF-1.7"), "application/pdf"},
+		{"Report.XLSX", []byte("PK\x03\x04"), "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{"notes.txt", []byte("héllo\n"), "text/plain; charset=utf-8"},
+		{"notes.txt", []byte("h\xe9llo\n"), "text/plain"},
+		{"data.csv", []byte("a,b\n1,2\n"), "text/csv; charset=utf-8"},
+		{"original.eml", []byte("Subject: hello\r\n"), "message/rfc822"},
+		// unknown extensions are sniffed
+		{"report.unknown", []byte("%PDF-1.7"), "application/pdf"},
+		{"image", []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+		{"README", []byte("hello\n"), "text/plain; charset=utf-8"},
+		{"page", []byte("<html><body>"), "text/html; charset=utf-8"},
+		// a text type without charset but for utf-8 cut in a rune
+		{"long", append(bytes.Repeat([]byte("a"), sniffLen-1), "é"[0]), "text/plain; charset=utf-8"},
+		{"data.bin", []byte{0, 1, 2, 0xff}, "application/octet-stream"},
+		{"empty", nil, "text/plain; charset=utf-8"},
+		{"data", []byte{0, 1, 2, 0xff}, "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		if got := DetectContentType(tt.name, tt.head); got != tt.want {
+			t.Errorf("DetectContentType(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
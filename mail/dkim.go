@@ -0,0 +1,521 @@
+package mail
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DKIM signing algorithms, given by the type of the key.
+const (
+	DKIMRSASHA256     = "rsa-sha256"
+	DKIMEd25519SHA256 = "ed25519-sha256"
+)
+
+// DefaultDKIMHeaders are the header fields signed when none are given,
+// those missing in a message are skipped.
+var DefaultDKIMHeaders = []string{
+	"from", "reply-to", "subject", "date", "to", "cc", "message-id",
+	"in-reply-to", "references", "mime-version", "content-type", "content-transfer-encoding",
+}
+
+// ErrDKIMNoSignature is returned by VerifyDKIM for an unsigned message.
+var ErrDKIMNoSignature = errors.New("dkim: no signature")
+
+// DKIMSigner signs messages for a domain with DKIM (RFC 6376), using
+// relaxed/relaxed canonicalization.
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	// Key is an *rsa.PrivateKey or an ed25519.PrivateKey (RFC 8463).
+	Key crypto.Signer
+	// Headers are the names of the signed header fields, DefaultDKIMHeaders
+	// when empty. From is always signed.
+	Headers []string
+}
+
+// ParseDKIMKey parses a PEM encoded RSA or Ed25519 private key.
+func ParseDKIMKey(data []byte) (crypto.Signer, error) {
+	key, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+
+	if _, err = dkimAlgorithm(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// LoadDKIMKey reads the PEM encoded private key at path.
+func LoadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseDKIMKey(data)
+}
+
+// DKIMRecord returns the DNS TXT record publishing the public key of key,
+// at <selector>._domainkey.<domain>.
+func DKIMRecord(key crypto.Signer) (string, error) {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", err
+		}
+
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	}
+
+	return "", fmt.Errorf("dkim: unsupported key type %T", key)
+}
+
+func dkimAlgorithm(key crypto.Signer) (string, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return DKIMRSASHA256, nil
+	case ed25519.PrivateKey:
+		return DKIMEd25519SHA256, nil
+	}
+
+	return "", fmt.Errorf("dkim: unsupported key type %T", key)
+}
+
+// relaxedHeader canonicalizes a header field: lowercase name, unfolded
+// value with whitespace runs reduced to a space and trimmed.
+func relaxedHeader(name string, value string) string {
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(collapseSpace(value))
+}
+
+// collapseSpace reduces the runs of spaces and tabs of s to a space, the
+// other bytes are kept as they are, whatever their encoding.
+func collapseSpace(s string) string {
+	var sb strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+
+		if space {
+			sb.WriteByte(' ')
+			space = false
+		}
+
+		sb.WriteByte(c)
+	}
+
+	if space {
+		sb.WriteByte(' ')
+	}
+
+	return sb.String()
+}
+
+// relaxedBody writes the relaxed canonical form of the body read from r:
+// whitespace runs reduced to a space, trailing whitespace and trailing
+// empty lines removed, every line ended by CRLF.
+func relaxedBody(w io.Writer, r *bufio.Reader) error {
+	emptyLines := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if line != "" {
+			line = strings.TrimRight(collapseSpace(strings.TrimRight(line, "\r\n")), " ")
+			if line == "" {
+				emptyLines++
+			} else {
+				if _, werr := io.WriteString(w, strings.Repeat("\r\n", emptyLines)+line+"\r\n"); werr != nil {
+					return werr
+				}
+
+				emptyLines = 0
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// selectHeaders returns the fields named by names, several instances of a
+// field being taken from the bottom up as RFC 6376 requires. A name with
+// no instance left selects nothing.
+func selectHeaders(fields []rawField, names []string) []rawField {
+	var result []rawField
+	used := make(map[string]int)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		seen := 0
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.ToLower(fields[i].name) != name {
+				continue
+			}
+
+			if seen == used[name] {
+				result = append(result, fields[i])
+				break
+			}
+
+			seen++
+		}
+
+		used[name]++
+	}
+
+	return result
+}
+
+// signedHeaderNames returns the names to sign among those present in
+// fields, each instance listed once.
+func (d *DKIMSigner) signedHeaderNames(fields []rawField) []string {
+	names := d.Headers
+	if len(names) == 0 {
+		names = DefaultDKIMHeaders
+	}
+
+	var result []string
+	hasFrom := false
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "from" {
+			hasFrom = true
+		}
+
+		for _, f := range fields {
+			if strings.ToLower(f.name) == name {
+				result = append(result, name)
+			}
+		}
+	}
+
+	if !hasFrom {
+		result = append([]string{"from"}, result...)
+	}
+
+	return result
+}
+
+// dkimHeaderHash returns the hash of the canonical signed fields followed
+// by the canonical signature field, whose b= value must be empty.
+func dkimHeaderHash(fields []rawField, names []string, sigValue string) []byte {
+	h := sha256.New()
+	for _, f := range selectHeaders(fields, names) {
+		io.WriteString(h, relaxedHeader(f.name, f.value)+"\r\n")
+	}
+
+	io.WriteString(h, relaxedHeader("DKIM-Signature", sigValue))
+	return h.Sum(nil)
+}
+
+func dkimBodyHash(r *bufio.Reader) (string, error) {
+	h := sha256.New()
+	if err := relaxedBody(h, r); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// SignedMessage is a message rendered with its DKIM signature, kept in a
+// temporary file until closed.
+type SignedMessage struct {
+	signature string
+	f         *os.File
+}
+
+// WriteTo writes the signature followed by the message to w, it may be
+// called several times.
+func (sm *SignedMessage) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, sm.signature)
+	if err != nil {
+		return int64(n), err
+	}
+
+	if _, err = sm.f.Seek(0, io.SeekStart); err != nil {
+		return int64(n), err
+	}
+
+	m, err := io.Copy(w, sm.f)
+	return int64(n) + m, err
+}
+
+// Close removes the rendered message.
+func (sm *SignedMessage) Close() error {
+	err := sm.f.Close()
+	if rerr := os.Remove(sm.f.Name()); err == nil {
+		err = rerr
+	}
+
+	return err
+}
+
+// Sign renders msg and signs it, the returned message must be closed.
+// The message is rendered once to a temporary file since the body hash
+// has to be known before the header is written.
+func (d *DKIMSigner) Sign(msg io.WriterTo) (*SignedMessage, error) {
+	algorithm, err := dkimAlgorithm(d.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp("", "she-dkim-*.eml")
+	if err != nil {
+		return nil, err
+	}
+
+	sm := SignedMessage{f: f}
+	if err = d.sign(&sm, algorithm, msg); err != nil {
+		sm.Close()
+		return nil, err
+	}
+
+	return &sm, nil
+}
+
+func (d *DKIMSigner) sign(sm *SignedMessage, algorithm string, msg io.WriterTo) error {
+	bw := bufio.NewWriter(sm.f)
+	if _, err := msg.WriteTo(bw); err != nil {
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := sm.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(sm.f)
+	fields, err := readRawHeader(br)
+	if err != nil {
+		return err
+	}
+
+	bodyHash, err := dkimBodyHash(br)
+	if err != nil {
+		return err
+	}
+
+	names := d.signedHeaderNames(fields)
+	sigValue := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		algorithm, d.Domain, d.Selector, time.Now().Unix(), strings.Join(names, ":"), bodyHash)
+	digest := dkimHeaderHash(fields, names, sigValue)
+
+	// rsa signs the digest, ed25519 signs it as the message (RFC 8463)
+	var opts crypto.SignerOpts = crypto.SHA256
+	if algorithm == DKIMEd25519SHA256 {
+		opts = crypto.Hash(0)
+	}
+
+	sig, err := d.Key.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return fmt.Errorf("dkim: %w", err)
+	}
+
+	b := base64.StdEncoding.EncodeToString(sig)
+	var folded strings.Builder
+	for len(b) > 0 {
+		n := min(len(b), maxEncodedLineLength-4)
+		if folded.Len() > 0 {
+			folded.WriteString("\r\n\t ")
+		}
+
+		folded.WriteString(b[:n])
+		b = b[n:]
+	}
+
+	sm.signature = "DKIM-Signature: " + sigValue + folded.String() + "\r\n"
+	return nil
+}
+
+// DKIMKeyLookup returns the public key published by domain for selector.
+type DKIMKeyLookup func(domain string, selector string) (crypto.PublicKey, error)
+
+// ParseDKIMRecord parses the public key of a DKIM DNS TXT record.
+func ParseDKIMRecord(record string) (crypto.PublicKey, error) {
+	tags := parseDKIMTags(record)
+	p, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(p) == 0 {
+		return nil, errors.New("dkim: invalid or revoked public key")
+	}
+
+	switch tags["k"] {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(p)
+		if err != nil {
+			// some records hold a bare PKCS #1 key
+			if pub, err = x509.ParsePKCS1PublicKey(p); err != nil {
+				return nil, fmt.Errorf("dkim: %w", err)
+			}
+		}
+
+		return pub, nil
+	case "ed25519":
+		if len(p) != ed25519.PublicKeySize {
+			return nil, errors.New("dkim: invalid ed25519 public key")
+		}
+
+		return ed25519.PublicKey(p), nil
+	}
+
+	return nil, fmt.Errorf("dkim: unsupported key type %s", tags["k"])
+}
+
+// LookupDKIMKey looks the public key up in DNS.
+func LookupDKIMKey(domain string, selector string) (crypto.PublicKey, error) {
+	txts, err := net.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseDKIMRecord(strings.Join(txts, ""))
+}
+
+// parseDKIMTags parses a tag list, whitespace within values is removed.
+func parseDKIMTags(s string) map[string]string {
+	result := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+
+		result[strings.TrimSpace(k)] = strings.Join(strings.Fields(v), "")
+	}
+
+	return result
+}
+
+// stripSignature empties the b= tag of a signature field value.
+func stripSignature(value string) string {
+	tags := strings.Split(value, ";")
+	for i, tag := range tags {
+		if k, _, ok := strings.Cut(tag, "="); ok && strings.TrimSpace(k) == "b" {
+			tags[i] = k + "="
+		}
+	}
+
+	return strings.Join(tags, ";")
+}
+
+// VerifyDKIM checks the first DKIM signature of the message read from r,
+// which must be relaxed/relaxed. lookup defaults to LookupDKIMKey.
+func VerifyDKIM(r io.Reader, lookup DKIMKeyLookup) error {
+	if lookup == nil {
+		lookup = LookupDKIMKey
+	}
+
+	br := bufio.NewReader(r)
+	fields, err := readRawHeader(br)
+	if err != nil {
+		return err
+	}
+
+	var sigField *rawField
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, "DKIM-Signature") {
+			sigField = &fields[i]
+			break
+		}
+	}
+
+	if sigField == nil {
+		return ErrDKIMNoSignature
+	}
+
+	tags := parseDKIMTags(sigField.value)
+	if tags["v"] != "1" {
+		return fmt.Errorf("dkim: unsupported version %s", tags["v"])
+	}
+
+	if tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("dkim: unsupported canonicalization %s", tags["c"])
+	}
+
+	bodyHash, err := dkimBodyHash(br)
+	if err != nil {
+		return err
+	}
+
+	if bodyHash != tags["bh"] {
+		return errors.New("dkim: body hash mismatch")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("dkim: invalid signature: %w", err)
+	}
+
+	pub, err := lookup(tags["d"], tags["s"])
+	if err != nil {
+		return err
+	}
+
+	digest := dkimHeaderHash(fields, strings.Split(tags["h"], ":"), stripSignature(sigField.value))
+	switch tags["a"] {
+	case DKIMRSASHA256:
+		pub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("dkim: key does not match algorithm")
+		}
+
+		if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig); err != nil {
+			return fmt.Errorf("dkim: %w", err)
+		}
+	case DKIMEd25519SHA256:
+		pub, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("dkim: key does not match algorithm")
+		}
+
+		if !ed25519.Verify(pub, digest, sig) {
+			return errors.New("dkim: verification error")
+		}
+	default:
+		return fmt.Errorf("dkim: unsupported algorithm %s", tags["a"])
+	}
+
+	return nil
+}
+
+// dkimSigned signs msg with d when set, the returned function releases
+// the signed message.
+func dkimSigned(d *DKIMSigner, msg io.WriterTo) (io.WriterTo, func(), error) {
+	if d == nil {
+		return msg, func() {}, nil
+	}
+
+	sm, err := d.Sign(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sm, func() { sm.Close() }, nil
+}
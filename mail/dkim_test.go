@@ -0,0 +1,122 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+// signTestMessage returns a test message signed by d.
+func signTestMessage(t *testing.T, d *DKIMSigner) []byte {
+	t.Helper()
+	m := newTestMessage()
+	m.SetHeader("Subject", "signed  report")
+	m.Body = "hello\nworld  \n\n"
+
+	sm, err := d.Sign(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sm.Close()
+	var buf bytes.Buffer
+	if _, err = sm.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  crypto.Signer
+	}{
+		{"rsa", rsaKey},
+		{"ed25519", edKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DKIMSigner{Domain: "example.com", Selector: "mail", Key: tt.key}
+			lookup := func(domain string, selector string) (crypto.PublicKey, error) {
+				if domain != d.Domain || selector != d.Selector {
+					t.Errorf("lookup(%s, %s)", domain, selector)
+				}
+
+				record, err := DKIMRecord(tt.key)
+				if err != nil {
+					return nil, err
+				}
+
+				return ParseDKIMRecord(record)
+			}
+
+			signed := signTestMessage(t, d)
+			if err := VerifyDKIM(bytes.NewReader(signed), lookup); err != nil {
+				t.Fatalf("VerifyDKIM: %v\n%s", err, signed)
+			}
+
+			// relaxed canonicalization ignores changes of whitespace and
+			// fields which are not signed
+			relaxed := bytes.Replace(signed, []byte("signed  report"), []byte("signed \t report"), 1)
+			relaxed = append([]byte("X-Spam-Score: 0\r\n"), relaxed...)
+			if err := VerifyDKIM(bytes.NewReader(relaxed), lookup); err != nil {
+				t.Errorf("relaxed changes: %v", err)
+			}
+
+			tampered := map[string][]byte{
+				"body":   bytes.Replace(signed, []byte("hello"), []byte("jello"), 1),
+				"header": bytes.Replace(signed, []byte("signed  report"), []byte("signed  rep0rt"), 1),
+			}
+
+			for name, b := range tampered {
+				if bytes.Equal(b, signed) {
+					t.Fatalf("%s not tampered", name)
+				}
+
+				if err := VerifyDKIM(bytes.NewReader(b), lookup); err == nil {
+					t.Errorf("tampered %s verified", name)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyDKIMNoSignature(t *testing.T) {
+	b, err := newTestMessage().ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = VerifyDKIM(bytes.NewReader(b), nil); err != ErrDKIMNoSignature {
+		t.Errorf("err = %v, want ErrDKIMNoSignature", err)
+	}
+}
+
+func TestCollapseSpace(t *testing.T) {
+	tests := map[string]string{
+		"a  b\t\tc ":    "a b c ",
+		"caf\xe9  \xff": "caf\xe9 \xff",
+		"\t":            " ",
+	}
+
+	for s, want := range tests {
+		if got := collapseSpace(s); got != want {
+			t.Errorf("collapseSpace(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+)
+
+// Content-Transfer-Encoding values written by the message builder.
+const (
+	Encoding7Bit            = "7bit"
+	Encoding8Bit            = "8bit"
+	EncodingQuotedPrintable = "quoted-printable"
+	EncodingBase64          = "base64"
+)
+
+// maxEncodedLineLength is the MIME limit of an encoded line, excluding CRLF.
+const maxEncodedLineLength = 76
+
+// maxLineLength is the RFC 5322 limit of a line, excluding CRLF.
+const maxLineLength = 998
+
+// lineWrapper inserts CRLF every maxEncodedLineLength bytes written to w.
+type lineWrapper struct {
+	w   io.Writer
+	col int
+}
+
+func (lw *lineWrapper) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if lw.col == maxEncodedLineLength {
+			if _, err := io.WriteString(lw.w, "\r\n"); err != nil {
+				return n, err
+			}
+
+			lw.col = 0
+		}
+
+		chunk := min(len(p), maxEncodedLineLength-lw.col)
+		written, err := lw.w.Write(p[:chunk])
+		n += written
+		lw.col += written
+		if err != nil {
+			return n, err
+		}
+
+		p = p[chunk:]
+	}
+
+	return n, nil
+}
+
+// newBase64Writer returns a writer base64 encoding everything written to it
+// into w, wrapped at 76 columns. Close must be called to flush the last block.
+func newBase64Writer(w io.Writer) io.WriteCloser {
+	return base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: w})
+}
+
+// chooseBodyEncoding picks the Content-Transfer-Encoding for a text body:
+// 7bit for short-lined pure ASCII, quoted-printable for mostly ASCII text,
+// and base64 for everything else.
+func chooseBodyEncoding(body []byte) string {
+	nonASCII := 0
+	lineLen := 0
+	longLine := false
+	for i, b := range body {
+		switch {
+		case b == '\n':
+			lineLen = 0
+			continue
+		case b == '\r' && i+1 < len(body) && body[i+1] == '\n':
+			// the end of a CRLF line
+			continue
+		case b >= 0x80 || b == 0 || b == '\r':
+			nonASCII++
+		}
+
+		lineLen++
+		if lineLen > maxLineLength {
+			longLine = true
+		}
+	}
+
+	if nonASCII == 0 && !longLine {
+		return Encoding7Bit
+	}
+
+	// Quoted-printable triples the size of every escaped byte, so it is only
+	// worth using while most of the text stays readable ASCII.
+	if utf8.Valid(body) && nonASCII*3 <= len(body) {
+		return EncodingQuotedPrintable
+	}
+
+	return EncodingBase64
+}
+
+// writeEncoded writes a text body into w using the given transfer encoding.
+func writeEncoded(w io.Writer, encoding string, content []byte) error {
+	if encoding == Encoding7Bit {
+		// 7bit content only holds a CR before a LF (see chooseBodyEncoding),
+		// lines end with either which become CRLF.
+		content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+		_, err := w.Write(bytes.ReplaceAll(content, []byte("\n"), []byte("\r\n")))
+		return err
+	}
+
+	return copyEncoded(w, encoding, bytes.NewReader(content))
+}
+
+// copyEncoded streams r into w using the given transfer encoding,
+// unknown encodings are copied as is.
+func copyEncoded(w io.Writer, encoding string, r io.Reader) error {
+	var ew io.WriteCloser
+	switch strings.ToLower(encoding) {
+	case EncodingBase64:
+		ew = newBase64Writer(w)
+	case EncodingQuotedPrintable:
+		ew = quotedprintable.NewWriter(w)
+	default:
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	if _, err := io.Copy(ew, r); err != nil {
+		return err
+	}
+
+	return ew.Close()
+}
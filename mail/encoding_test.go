@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestChooseBodyEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"ascii", "hello\nworld\n", Encoding7Bit},
+		{"crlf", "hello\r\nworld\r\n", Encoding7Bit},
+		{"lone cr", "hello\rworld\n", EncodingQuotedPrintable},
+		{"long line", strings.Repeat("a", maxLineLength+1), EncodingQuotedPrintable},
+		{"utf-8", "héllo wörld\n", EncodingQuotedPrintable},
+		{"binary", "\xff\xfe\x00\x01", EncodingBase64},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chooseBodyEncoding([]byte(tt.body)); got != tt.want {
+				t.Errorf("chooseBodyEncoding(%q) = %s, want %s", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteEncoded7BitLineEndings(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeEncoded(&buf, Encoding7Bit, []byte("a\r\nb\nc")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := buf.String(), "a\r\nb\r\nc"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+package mail
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+// MessageContentType is the media type of a message embedded as attachment.
+const MessageContentType = "message/rfc822"
+
+// isMessageType reports whether contentType is the one of an embedded message.
+func isMessageType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == MessageContentType
+}
+
+// transferEncoding returns the Content-Transfer-Encoding of the attachment
+// for the given Content-Type, which is base64 but for embedded messages.
+// Those should not be encoded (RFC 2046 5.2.1), they are sent as 7bit in
+// CRLF form when they can be. Messages with 8-bit content, bare CRs or
+// lines over 998 characters, which relays may not carry as is, are base64
+// encoded all the same, which mail clients read as well.
+func (a *MessageAttachment) transferEncoding(contentType string) (string, error) {
+	if !isMessageType(contentType) {
+		return EncodingBase64, nil
+	}
+
+	r, err := a.Open()
+	if err != nil {
+		return "", err
+	}
+
+	defer r.Close()
+	br := bufio.NewReader(r)
+	lineLen := 0
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return Encoding7Bit, nil
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case b == '\n':
+			lineLen = 0
+			continue
+		case b == '\r':
+			if next, err := br.Peek(1); err == nil && next[0] == '\n' {
+				continue
+			}
+
+			return EncodingBase64, nil
+		case b >= 0x80 || b == 0:
+			return EncodingBase64, nil
+		}
+
+		lineLen++
+		if lineLen > maxLineLength {
+			return EncodingBase64, nil
+		}
+	}
+}
+
+// writeContent writes the content of an attachment read from r to w,
+// encoded as header tells. Embedded messages not encoded are written in
+// CRLF form.
+func writeContent(w io.Writer, header textproto.MIMEHeader, r io.Reader) error {
+	encoding := header.Get("Content-Transfer-Encoding")
+	switch strings.ToLower(encoding) {
+	case Encoding7Bit, Encoding8Bit:
+		if isMessageType(header.Get("Content-Type")) {
+			w = &crlfWriter{w: w}
+		}
+	}
+
+	return copyEncoded(w, encoding, r)
+}
+
+// AttachMessage attaches the message stored at src, typically an .eml file,
+// as an embedded message/rfc822 part, as done when forwarding a mail as
+// attachment.
+func (m *Message) AttachMessage(src string, name string, header textproto.MIMEHeader) error {
+	if header == nil {
+		header = make(textproto.MIMEHeader)
+	}
+
+	header.Set("Content-Type", MessageContentType)
+	return m.AttachFile(src, name, header)
+}
+
+// ForwardSubject returns subject prefixed with "Fwd: ",
+// unless it is marked as forwarded already.
+func ForwardSubject(subject string) string {
+	lower := strings.ToLower(strings.TrimSpace(subject))
+	if strings.HasPrefix(lower, "fwd:") || strings.HasPrefix(lower, "fw:") {
+		return subject
+	}
+
+	return "Fwd: " + subject
+}
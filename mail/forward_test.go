@@ -0,0 +1,124 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// attachedPart returns the header and raw content of the attachment of
+// the message data.
+func attachedPart(t *testing.T, data []byte) (*multipart.Part, []byte) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for i := 0; i < 2; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 1 {
+			content, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return part, content
+		}
+	}
+
+	return nil, nil
+}
+
+func TestAttachMessage(t *testing.T) {
+	const header = "From: you@example.com\nSubject: original\n\n"
+	tests := []struct {
+		name     string
+		content  string
+		encoding string
+		want     string
+	}{
+		{"LF lines", header + "hello\n.\nworld\n", "7bit", strings.ReplaceAll(header, "\n", "\r\n") + "hello\r\n.\r\nworld\r\n"},
+		{"CRLF lines", "Subject: original\r\n\r\nhello\r\n", "7bit", "Subject: original\r\n\r\nhello\r\n"},
+		{"8-bit content", header + "héllo\n", "base64", header + "héllo\n"},
+		{"long line", header + strings.Repeat("a", 999) + "\n", "base64", header + strings.Repeat("a", 999) + "\n"},
+		{"longest line", header + strings.Repeat("a", 998) + "\n", "7bit", strings.ReplaceAll(header, "\n", "\r\n") + strings.Repeat("a", 998) + "\r\n"},
+		{"bare CR", header + "hello\rworld\n", "base64", header + "hello\rworld\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "original.eml")
+			if err := os.WriteFile(filename, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			m := NewMessage()
+			m.SetHeader("From", "me@example.com")
+			m.SetHeader("Subject", ForwardSubject("original"))
+			m.Body = "see attached\n"
+			if err := m.AttachMessage(filename, "", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := m.ToBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			part, content := attachedPart(t, data)
+			if got := part.Header.Get("Content-Type"); got != MessageContentType {
+				t.Errorf("Content-Type = %q", got)
+			}
+
+			if got := part.Header.Get("Content-Transfer-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Transfer-Encoding = %q, want %q", got, tt.encoding)
+			}
+
+			if tt.encoding == "base64" {
+				if content, err = base64.StdEncoding.DecodeString(string(bytes.ReplaceAll(content, []byte("\r\n"), nil))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if string(content) != tt.want {
+				t.Errorf("content = %q, want %q", content, tt.want)
+			}
+
+			if size, err := m.Size(); err != nil || size != int64(len(data)) {
+				t.Errorf("Size = %d, %v, want %d", size, err, len(data))
+			}
+		})
+	}
+}
+
+func TestForwardSubject(t *testing.T) {
+	for subject, want := range map[string]string{
+		"hello":       "Fwd: hello",
+		"Fwd: hello":  "Fwd: hello",
+		" FW: hello":  " FW: hello",
+		"Re: hello":   "Fwd: Re: hello",
+		"Forwarding?": "Fwd: Forwarding?",
+	} {
+		if got := ForwardSubject(subject); got != want {
+			t.Errorf("ForwardSubject(%q) = %q, want %q", subject, got, want)
+		}
+	}
+}
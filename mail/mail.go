@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"net/mail"
 	"net/smtp"
 	"strings"
 )
@@ -18,6 +17,7 @@ type SmtpAuth struct {
 	host     string
 	hostPort int
 	starttls bool
+	dkim     *DKIMSigner
 }
 
 func New(username string, password string, host string, hostPort int, tls bool) *SmtpAuth {
@@ -26,9 +26,15 @@ func New(username string, password string, host string, hostPort int, tls bool)
 		host,
 		hostPort,
 		tls,
+		nil,
 	}
 }
 
+// SetDKIM signs the messages sent with d, nil disables signing.
+func (s *SmtpAuth) SetDKIM(d *DKIMSigner) {
+	s.dkim = d
+}
+
 // Dial returns a new Client connected to an SMTP server at addr.
 // The addr must include a port, as in "mail.example.com:smtp".
 func DialInsecure(addr string) (*smtp.Client, error) {
@@ -45,21 +51,43 @@ func DialInsecure(addr string) (*smtp.Client, error) {
 	return smtp.NewClient(conn, host)
 }
 
-func (s *SmtpAuth) SendMail(c *smtp.Client, from string, to []string, msg []byte) error {
+// SendMail sends msg through c, the message content is streamed
+// to the DATA command as it is produced.
+func (s *SmtpAuth) SendMail(c *smtp.Client, from string, to []string, msg io.WriterTo) error {
+	_, err := s.sendMail(c, from, to, msg)
+	return err
+}
+
+// sendMail is SendMail returning the reply of the server accepting msg.
+func (s *SmtpAuth) sendMail(c *smtp.Client, from string, to []string, msg io.WriterTo) (string, error) {
 	var err error
 	if err = validateLine(from); err != nil {
-		return err
+		return "", err
 	}
 
 	for _, recp := range to {
 		if err = validateLine(recp); err != nil {
-			return err
+			return "", err
 		}
 	}
 
+	if err = s.hello(c); err != nil {
+		return "", err
+	}
+
+	reply, err := s.transaction(c, from, to, msg)
+	if err != nil {
+		return "", err
+	}
+
+	return reply, c.Quit()
+}
+
+// hello starts tls when offered and authenticates on a new connection.
+func (s *SmtpAuth) hello(c *smtp.Client) error {
 	if ok, _ := c.Extension("STARTTLS"); ok {
 		config := &tls.Config{ServerName: s.host}
-		if err = c.StartTLS(config); err != nil {
+		if err := c.StartTLS(config); err != nil {
 			return err
 		}
 	}
@@ -69,100 +97,104 @@ func (s *SmtpAuth) SendMail(c *smtp.Client, from string, to []string, msg []byte
 			return errors.New("smtp: server doesn't support AUTH")
 		}
 
-		if err = c.Auth(s.auth); err != nil {
+		if err := c.Auth(s.auth); err != nil {
 			return err
 		}
 	}
 
+	return nil
+}
+
+// transaction sends a single message on an established connection,
+// which may be used for another one afterwards. It returns the reply of
+// the server accepting the message, which often holds its queue id.
+func (s *SmtpAuth) transaction(c *smtp.Client, from string, to []string, msg io.WriterTo) (string, error) {
+	// signed before the transaction starts, which a slow signature
+	// could otherwise time out
+	msg, release, err := dkimSigned(s.dkim, msg)
+	if err != nil {
+		return "", err
+	}
+
+	defer release()
 	if err = c.Mail(from); err != nil {
-		return err
+		return "", err
 	}
 
 	for _, addr := range to {
 		if err = c.Rcpt(addr); err != nil {
-			return err
+			return "", err
 		}
 	}
 
-	var w io.WriteCloser
-	w, err = c.Data()
+	// the DATA command is run on the text connection since the writer
+	// of smtp.Client discards the final reply
+	id, err := c.Text.Cmd("DATA")
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	_, err = w.Write(msg)
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	// Closing w would end the DATA command and deliver a truncated
+	// message, so on failure the connection is dropped instead.
+	w := c.Text.DotWriter()
+	if _, err = msg.WriteTo(w); err != nil {
+		return "", err
 	}
 
-	err = w.Close()
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+
+	code, reply, err := c.Text.ReadResponse(250)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return c.Quit()
+	return fmt.Sprintf("%d %s", code, reply), nil
 }
 
 func (s *SmtpAuth) Send(m *Message) error {
-	mailfrom, err := mail.ParseAddress(m.GetHeader("from"))
+	from, to, err := m.Envelope()
 	if err != nil {
 		return err
 	}
 
-	if err := validateLine(mailfrom.Address); err != nil {
-		return err
-	}
-
-	var mailto []string
-	addrs, _ := m.AddressList("to")
-	if addrs == nil {
-		return fmt.Errorf("mail: header not in message -- %s", "To")
-	}
-
-	for _, a := range addrs {
-		mailto = append(mailto, a.Address)
-	}
-
-	addrs, _ = m.AddressList("cc")
-	for _, a := range addrs {
-		mailto = append(mailto, a.Address)
-	}
-
-	addrs, _ = m.AddressList("bcc")
-	for _, a := range addrs {
-		mailto = append(mailto, a.Address)
-	}
-
-	for _, recp := range mailto {
-		if err := validateLine(recp); err != nil {
-			return err
-		}
-	}
+	_, err = s.SendRaw(from, to, m)
+	return err
+}
 
+// Dial connects to the smtp server.
+func (s *SmtpAuth) Dial() (*smtp.Client, error) {
 	addr := fmt.Sprintf("%s:%d", s.host, s.hostPort)
 
 	// Here is the key, you need to call tls.Dial instead of smtp.Dial
 	// for smtp servers running on 465 that require an ssl connection
 	// from the very beginning (no starttls)
-	var c *smtp.Client
 	if s.starttls {
-		c, err = smtp.Dial(addr)
-	} else {
-		c, err = DialInsecure(addr)
+		return smtp.Dial(addr)
 	}
 
-	if err != nil {
-		return err
-	}
+	return DialInsecure(addr)
+}
 
-	defer c.Close()
-	var msgData []byte
-	msgData, err = m.ToBytes()
+// SendRaw sends msg as is from the envelope sender to the envelope
+// recipients in a new connection. It returns the reply of the server
+// accepting the message.
+func (s *SmtpAuth) SendRaw(from string, to []string, msg io.WriterTo) (string, error) {
+	c, err := s.Dial()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return s.SendMail(c, mailfrom.Address, mailto, msgData)
+	defer c.Close()
+	return s.sendMail(c, from, to, msg)
 }
 
 // validateLine checks to see if a line has CR or LF as per RFC 5321.
@@ -1,18 +1,58 @@
 package mail
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"net/mail"
 	"net/textproto"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
 
 	"github.com/lifeym/she/genericlist"
 )
 
+// AttachmentSource opens the content of an attachment,
+// it is called each time the message is written.
+type AttachmentSource func() (io.ReadCloser, error)
+
+// MessageAttachment is a file attached to a mail message.
+// The content is read from Source if set, otherwise the file at Path is
+// streamed from disk while the message is written, otherwise Content is used.
 type MessageAttachment struct {
 	Name    string
+	Path    string
 	Content []byte
+	Source  AttachmentSource
 	Header  textproto.MIMEHeader
+
+	// encodedSize is the size of the content once encoded, kept once
+	// measured, 0 when unknown.
+	encodedSize int64
+}
+
+// Open returns a reader of the attachment content.
+func (a *MessageAttachment) Open() (io.ReadCloser, error) {
+	if a.Source != nil {
+		return a.Source()
+	}
+
+	if a.Path != "" {
+		return os.Open(a.Path)
+	}
+
+	return io.NopCloser(bytes.NewReader(a.Content)), nil
+}
+
+// MessageBody is a version of the text body of a message.
+type MessageBody struct {
+	Content string
+	// ContentType is the Content-Type of Content, sniffed as utf-8 text
+	// when empty.
+	ContentType string
 }
 
 // Message represents a mail message to be sent by smtp server
@@ -22,9 +62,19 @@ type Message struct {
 	// Cc          []string
 	// Bcc         []string
 	// Subject     string
-	Body        string
-	Attachments genericlist.GenericList[*MessageAttachment]
-	Header      mail.Header
+	Body string
+	// BodyType is the Content-Type of Body, such as text/html;
+	// charset=iso-8859-1, utf-8 text when empty.
+	BodyType string
+	// Alternatives are other versions of Body, such as the plain text one
+	// of an html body, by increasing preference. The message is then
+	// written as multipart/alternative, Body being the last part.
+	Alternatives []MessageBody
+	Attachments  genericlist.GenericList[*MessageAttachment]
+	Header       mail.Header
+	// SMIME or PGP sign or encrypt the message once built when set.
+	SMIME *SMIME
+	PGP   *PGP
 }
 
 func NewMessage() *Message {
@@ -49,12 +99,18 @@ func (m *Message) RemoveHeader(field string) {
 	textproto.MIMEHeader(m.Header).Del(field)
 }
 
+// AttachFile attaches the file at src to the message, the file is not read
+// until the message is written.
 func (m *Message) AttachFile(src string, name string, header textproto.MIMEHeader) error {
-	b, err := os.ReadFile(src)
+	fi, err := os.Stat(src)
 	if err != nil {
 		return err
 	}
 
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file: %s", src)
+	}
+
 	var attachName string
 	if name == "" {
 		_, fileName := filepath.Split(src)
@@ -63,11 +119,117 @@ func (m *Message) AttachFile(src string, name string, header textproto.MIMEHeade
 		attachName = name
 	}
 
-	result := MessageAttachment{attachName, b, header}
+	result := MessageAttachment{Name: attachName, Path: src, Header: header}
+	m.Attachments.Append(&result)
+	return nil
+}
+
+// AttachContent attaches content held in memory to the message.
+func (m *Message) AttachContent(name string, content []byte, header textproto.MIMEHeader) {
+	result := MessageAttachment{Name: name, Content: content, Header: header}
 	m.Attachments.Append(&result)
+}
+
+// AttachReader reads r until EOF and attaches what was read to the message,
+// r is consumed once so the message can still be written several times.
+func (m *Message) AttachReader(r io.Reader, name string, header textproto.MIMEHeader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.AttachContent(name, b, header)
 	return nil
 }
 
+// AttachCommandOutput runs cmd and attaches its standard output to the message.
+func (m *Message) AttachCommandOutput(cmd *exec.Cmd, name string, header textproto.MIMEHeader) error {
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+
+	b, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("command %s: %w", cmd, err)
+	}
+
+	m.AttachContent(name, b, header)
+	return nil
+}
+
+// AttachDir attaches the directory dir to the message as a single archive
+// of the given format, created on the fly when the message is written.
+func (m *Message) AttachDir(dir string, name string, format string, header textproto.MIMEHeader) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("not a directory: %s", dir)
+	}
+
+	af, err := lookupArchiveFormat(format)
+	if err != nil {
+		return err
+	}
+
+	source, err := ArchiveDir(dir, format)
+	if err != nil {
+		return err
+	}
+
+	attachName := name
+	if attachName == "" {
+		attachName = filepath.Base(filepath.Clean(dir)) + af.ext
+	}
+
+	result := MessageAttachment{Name: attachName, Source: source, Header: header}
+	m.Attachments.Append(&result)
+	return nil
+}
+
+// Envelope returns the envelope sender and recipients of the message,
+// taken from its From, To, Cc and Bcc headers.
+func (m *Message) Envelope() (string, []string, error) {
+	mailfrom, err := mail.ParseAddress(m.GetHeader("from"))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := validateLine(mailfrom.Address); err != nil {
+		return "", nil, err
+	}
+
+	var mailto []string
+	addrs, _ := m.AddressList("to")
+	if addrs == nil {
+		return "", nil, fmt.Errorf("mail: header not in message -- %s", "To")
+	}
+
+	for _, a := range addrs {
+		mailto = append(mailto, a.Address)
+	}
+
+	addrs, _ = m.AddressList("cc")
+	for _, a := range addrs {
+		mailto = append(mailto, a.Address)
+	}
+
+	addrs, _ = m.AddressList("bcc")
+	for _, a := range addrs {
+		mailto = append(mailto, a.Address)
+	}
+
+	for _, recp := range mailto {
+		if err := validateLine(recp); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return mailfrom.Address, mailto, nil
+}
+
 func (m *Message) AddressList(key string) ([]*mail.Address, error) {
 	hdr := m.Header.Get(key)
 	if hdr == "" {
@@ -77,7 +239,73 @@ func (m *Message) AddressList(key string) ([]*mail.Address, error) {
 	return mail.ParseAddressList(hdr)
 }
 
+// WriteTo streams the message content to w.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	if m.SMIME != nil || m.PGP != nil {
+		return m.writeProtected(w)
+	}
+
+	cw := countingWriter{w: w}
+	mb := newMessageBuilder(&cw)
+	err := mb.Build(m)
+	return cw.n, err
+}
+
+// writeProtected signs or encrypts the message as it is built, see
+// SMIME.Protect and PGP.Protect for the part held in memory.
+func (m *Message) writeProtected(w io.Writer) (int64, error) {
+	if m.SMIME != nil && m.PGP != nil {
+		return 0, errors.New("mail: a message cannot be protected by both S/MIME and PGP")
+	}
+
+	built := m
+	if m.PGP != nil && m.PGP.AttachPublicKey && m.PGP.Signer != nil {
+		att, err := m.PGP.publicKeyAttachment()
+		if err != nil {
+			return 0, err
+		}
+
+		built = m.withAttachments(append(slices.Clone(m.Attachments), att))
+	}
+
+	protect := m.SMIME.Protect
+	if m.PGP != nil {
+		protect = m.PGP.Protect
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(newMessageBuilder(pw).Build(built))
+	}()
+
+	cw := countingWriter{w: w}
+	err := protect(&cw, pr)
+	// stops the builder if protect returned early
+	pr.CloseWithError(err)
+	<-done
+	return cw.n, err
+}
+
+// ToBytes returns the whole message content, which may be large when
+// files are attached, prefer WriteTo if possible.
 func (m *Message) ToBytes() ([]byte, error) {
-	mb := newMessageBuilder()
-	return mb.Build(m)
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
 }
@@ -1,37 +1,45 @@
 package mail
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/base64"
 	"fmt"
+	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/mail"
 	"net/textproto"
+	"path/filepath"
 	"slices"
+	"strings"
 )
 
-// Utility for building mail message
+// sniffLen is the number of bytes http.DetectContentType looks at.
+const sniffLen = 512
+
+// Utility for building mail message, the message is streamed
+// to the underlying writer while being built.
 type messageBuilder struct {
-	buf *bytes.Buffer
+	w *bufio.Writer
+	// sizeOnly skips the content of the attachments, adding its encoded
+	// size to skipped instead, to measure the message.
+	sizeOnly bool
+	skipped  int64
 }
 
-func newMessageBuilder() *messageBuilder {
+func newMessageBuilder(w io.Writer) *messageBuilder {
 	return &messageBuilder{
-		buf: bytes.NewBuffer(nil),
+		w: bufio.NewWriter(w),
 	}
 }
 
 func (mb *messageBuilder) writeLine(s string) (int, error) {
-	return mb.buf.WriteString(fmt.Sprintf("%s\r\n", s))
+	return mb.w.WriteString(fmt.Sprintf("%s\r\n", s))
 }
 
 func (mb *messageBuilder) writeEmptyLine() (int, error) {
-	return mb.buf.WriteString("\r\n")
-}
-
-func (mb *messageBuilder) writeString(s string) (int, error) {
-	return mb.buf.WriteString(s)
+	return mb.w.WriteString("\r\n")
 }
 
 func (mb *messageBuilder) writeFiled(name string, value string) (int, error) {
@@ -76,26 +84,83 @@ func (mb *messageBuilder) writeHeader(h mail.Header) error {
 	return nil
 }
 
-func writeMessageAttachments(m *Message, mw *multipart.Writer) error {
-	for _, att := range m.Attachments {
-		headerPatchDefault(att.Header, "Content-Type", http.DetectContentType(att.Content))
-		headerPatchDefault(att.Header, "Content-Transfer-Encoding", "base64")
-		headerPatchDefault(att.Header, "Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", att.Name))
+// writeAttachment streams the content of att into a new part of mw,
+// encoding it on the fly.
+func (mb *messageBuilder) writeAttachment(att *MessageAttachment, mw *multipart.Writer) error {
+	r, err := att.Open()
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	// Only the head of the content is needed for sniffing, the rest is
+	// streamed right after it.
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	head = head[:n]
+	header, err := att.partHeader(head)
+	if err != nil {
+		return err
+	}
+
+	w, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	content := io.MultiReader(bytes.NewReader(head), r)
+	if mb.sizeOnly {
+		size, err := att.encodedLen(header, content)
+		mb.skipped += size
+		return err
+	}
+
+	return writeContent(w, header, content)
+}
+
+// partHeader returns the header of the part of att, its defaults filled
+// from head, the beginning of the content.
+func (att *MessageAttachment) partHeader(head []byte) (textproto.MIMEHeader, error) {
+	// defaults are filled in a copy, so the attachment is left untouched
+	// and can be written again.
+	header := cloneHeader(att.Header)
 
-		w, err := mw.CreatePart(att.Header)
+	// a custom attachment name may come without the extension of the file
+	name := att.Name
+	if filepath.Ext(name) == "" {
+		name = att.Path
+	}
+
+	headerPatchDefault(header, "Content-Type", DetectContentType(name, head))
+	if header.Get("Content-Transfer-Encoding") == "" {
+		encoding, err := att.transferEncoding(header.Get("Content-Type"))
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		bs := make([]byte, base64.StdEncoding.EncodedLen(len(att.Content)))
-		base64.StdEncoding.Encode(bs, att.Content)
-		w.Write(bs)
+		header.Set("Content-Transfer-Encoding", encoding)
+	}
+
+	headerPatchDefault(header, "Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", att.Name))
+	return header, nil
+}
+
+func (mb *messageBuilder) writeAttachments(m *Message, mw *multipart.Writer) error {
+	for _, att := range m.Attachments {
+		if err := mb.writeAttachment(att, mw); err != nil {
+			return fmt.Errorf("cannot write attachment %s: %w", att.Name, err)
+		}
 	}
 
 	return nil
 }
 
-func (mb *messageBuilder) Build(m *Message) ([]byte, error) {
+func (mb *messageBuilder) Build(m *Message) error {
 	// mb.appendFrom(m.From)
 	// mb.appendSubject(m.Subject)
 	// mb.appendTo(m.To)
@@ -103,55 +168,157 @@ func (mb *messageBuilder) Build(m *Message) ([]byte, error) {
 	// 	mb.appendCc(m.Cc)
 	// }
 	if err := mb.writeHeader(m.Header); err != nil {
-		return nil, err
+		return err
 	}
 
 	// mb.appendFiled("MIME-Version", "1.0")
+	if m.Header.Get("Mime-Version") == "" {
+		if _, err := mb.writeFiled("MIME-Version", "1.0"); err != nil {
+			return err
+		}
+	}
 
-	if len(m.Attachments) > 0 {
-		mw := multipart.NewWriter(mb.buf)
-		boundary := mw.Boundary()
-		if _, err := mb.writeFiled("Content-Type", fmt.Sprintf("multipart/mixed; boundary=\"%s\"", boundary)); err != nil {
-			return nil, err
+	switch {
+	case len(m.Attachments) > 0:
+		mw := multipart.NewWriter(mb.w)
+		if err := mb.writeMultipartHeader("multipart/mixed", mw.Boundary()); err != nil {
+			return err
 		}
 
-		if _, err := mb.writeEmptyLine(); err != nil {
-			return nil, err
+		if err := writeBodyPart(m, mw); err != nil {
+			return err
 		}
 
-		mpHeader := make(textproto.MIMEHeader)
-		mpHeader.Add("Content-Type", fmt.Sprintf("%s; charset=utf-8", http.DetectContentType([]byte(m.Body))))
-		w, err := mw.CreatePart(mpHeader)
-		if err != nil {
-			return nil, err
+		if err := mb.writeAttachments(m, mw); err != nil {
+			return err
 		}
 
-		if _, err = w.Write([]byte(m.Body)); err != nil {
-			return nil, err
+		if err := mw.Close(); err != nil {
+			return err
+		}
+	case len(m.Alternatives) > 0:
+		mw := multipart.NewWriter(mb.w)
+		if err := mb.writeMultipartHeader("multipart/alternative", mw.Boundary()); err != nil {
+			return err
 		}
 
-		if err = writeMessageAttachments(m, mw); err != nil {
-			return nil, err
+		if err := writeAlternatives(m, mw); err != nil {
+			return err
+		}
+	default:
+		body := []byte(m.Body)
+		bodyEncoding := chooseBodyEncoding(body)
+		contentType := m.BodyType
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
 		}
 
-		if err = mw.Close(); err != nil {
-			return nil, err
+		if _, err := mb.writeFiled("Content-Type", contentType); err != nil {
+			return err
 		}
-	} else {
-		if _, err := mb.writeFiled("Content-Type", "text/plain; charset=utf-8"); err != nil {
-			return nil, err
+
+		if _, err := mb.writeFiled("Content-Transfer-Encoding", bodyEncoding); err != nil {
+			return err
 		}
 
 		if _, err := mb.writeEmptyLine(); err != nil {
-			return nil, err
+			return err
 		}
 
-		if _, err := mb.writeString(m.Body); err != nil {
-			return nil, err
+		if err := writeEncoded(mb.w, bodyEncoding, body); err != nil {
+			return err
+		}
+	}
+
+	return mb.w.Flush()
+}
+
+func (mb *messageBuilder) writeMultipartHeader(mediaType string, boundary string) error {
+	if _, err := mb.writeFiled("Content-Type", fmt.Sprintf("%s; boundary=\"%s\"", mediaType, boundary)); err != nil {
+		return err
+	}
+
+	_, err := mb.writeEmptyLine()
+	return err
+}
+
+// writeBodyPart writes the body of m as a part of mw, a nested
+// multipart/alternative one when it has alternatives.
+func writeBodyPart(m *Message, mw *multipart.Writer) error {
+	if len(m.Alternatives) == 0 {
+		return writeTextPart(mw, MessageBody{Content: m.Body, ContentType: m.BodyType})
+	}
+
+	// a boundary is picked before the part, whose header declares it
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", fmt.Sprintf("multipart/alternative; boundary=\"%s\"", boundary))
+	w, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	aw := multipart.NewWriter(w)
+	if err = aw.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	return writeAlternatives(m, aw)
+}
+
+// writeAlternatives writes the alternatives of m then its body as the
+// parts of mw, closing it.
+func writeAlternatives(m *Message, mw *multipart.Writer) error {
+	for _, alt := range m.Alternatives {
+		if err := writeTextPart(mw, alt); err != nil {
+			return err
 		}
 	}
 
-	return mb.buf.Bytes(), nil
+	if err := writeTextPart(mw, MessageBody{Content: m.Body, ContentType: m.BodyType}); err != nil {
+		return err
+	}
+
+	return mw.Close()
+}
+
+func writeTextPart(mw *multipart.Writer, b MessageBody) error {
+	body := []byte(b.Content)
+	bodyEncoding := chooseBodyEncoding(body)
+	contentType := b.ContentType
+	if contentType == "" {
+		contentType = bodyContentType(body)
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Add("Content-Type", contentType)
+	header.Add("Content-Transfer-Encoding", bodyEncoding)
+	w, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	return writeEncoded(w, bodyEncoding, body)
+}
+
+// bodyContentType sniffs the media type of a text body, always declaring
+// utf-8 since the body comes from a go string.
+func bodyContentType(body []byte) string {
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(body))
+	if err != nil || !strings.HasPrefix(mediaType, "text/") {
+		mediaType = "text/plain"
+	}
+
+	return mime.FormatMediaType(mediaType, map[string]string{"charset": "utf-8"})
+}
+
+func cloneHeader(header textproto.MIMEHeader) textproto.MIMEHeader {
+	result := make(textproto.MIMEHeader, len(header))
+	for k, v := range header {
+		result[k] = slices.Clone(v)
+	}
+
+	return result
 }
 
 func headerPatchDefault(header textproto.MIMEHeader, k string, v string) {
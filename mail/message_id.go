@@ -0,0 +1,93 @@
+package mail
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+)
+
+// GenerateMessageID returns a new RFC 5322 message id, such as
+// "<20240501T083000.123456.5f2a9c3e1b7d4a60@example.com>", made unique by
+// the time and random bytes.
+func GenerateMessageID(domain string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	if domain == "" {
+		domain = defaultIDDomain()
+	}
+
+	return fmt.Sprintf("<%s.%s@%s>", time.Now().UTC().Format("20060102T150405.000000"), hex.EncodeToString(b), domain), nil
+}
+
+// AddressDomain returns the domain of a mail address, empty if it has none.
+func AddressDomain(address string) string {
+	if a, err := mail.ParseAddress(address); err == nil {
+		address = a.Address
+	}
+
+	_, domain, found := strings.Cut(address, "@")
+	if !found {
+		return ""
+	}
+
+	return strings.TrimSpace(domain)
+}
+
+func defaultIDDomain() string {
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+
+	return "localhost"
+}
+
+// SetMessageID sets a generated Message-ID header unless the message has
+// one already. The id is made with domain, the domain of the From address
+// when empty.
+func (m *Message) SetMessageID(domain string) error {
+	if m.GetHeader("message-id") != "" {
+		return nil
+	}
+
+	if domain == "" {
+		domain = AddressDomain(m.GetHeader("from"))
+	}
+
+	id, err := GenerateMessageID(domain)
+	if err != nil {
+		return err
+	}
+
+	m.SetHeader("message-id", id)
+	return nil
+}
+
+// SetThread makes the message a reply to the message id inReplyTo within
+// the thread of references, as the In-Reply-To and References headers.
+// The parent is added to references when missing, empty values are skipped.
+func (m *Message) SetThread(inReplyTo string, references []string) {
+	var refs []string
+	for _, ref := range references {
+		if ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+
+	if inReplyTo != "" {
+		m.SetHeader("in-reply-to", inReplyTo)
+		if len(refs) == 0 || refs[len(refs)-1] != inReplyTo {
+			refs = append(refs, inReplyTo)
+		}
+	}
+
+	if len(refs) > 0 {
+		m.SetHeader("references", strings.Join(refs, " "))
+	}
+}
@@ -0,0 +1,128 @@
+package mail
+
+import (
+	"os"
+	"regexp"
+	"testing"
+)
+
+var messageIDPattern = regexp.MustCompile(`^<\d{8}T\d{6}\.\d{6}\.[0-9a-f]{16}@([^>]+)>$`)
+
+func TestGenerateMessageID(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+
+	seen := make(map[string]bool)
+	for _, domain := range []string{"example.com", "example.com", ""} {
+		id, err := GenerateMessageID(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := messageIDPattern.FindStringSubmatch(id)
+		if m == nil {
+			t.Fatalf("invalid message id %q", id)
+		}
+
+		want := domain
+		if want == "" {
+			want = host
+		}
+
+		if m[1] != want {
+			t.Errorf("domain of %s, want %s", id, want)
+		}
+
+		if seen[id] {
+			t.Errorf("%s generated twice", id)
+		}
+
+		seen[id] = true
+	}
+}
+
+func TestAddressDomain(t *testing.T) {
+	for address, want := range map[string]string{
+		"me@example.com":           "example.com",
+		"Me <me@mail.example.com>": "mail.example.com",
+		`"a@b" <me@example.org>`:   "example.org",
+		"me":                       "",
+		"":                         "",
+	} {
+		if got := AddressDomain(address); got != want {
+			t.Errorf("AddressDomain(%q) = %q, want %q", address, got, want)
+		}
+	}
+}
+
+func TestSetMessageID(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		domain string
+		want   string
+	}{
+		{"configured domain", "", "ids.example.net", "ids.example.net"},
+		{"domain of From", "", "", "example.com"},
+		{"kept", "<kept@example.org>", "ids.example.net", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testMessage()
+			m.SetHeader("From", "Me <me@example.com>")
+			if tt.id != "" {
+				m.SetHeader("Message-ID", tt.id)
+			}
+
+			if err := m.SetMessageID(tt.domain); err != nil {
+				t.Fatal(err)
+			}
+
+			id := m.GetHeader("Message-ID")
+			if tt.id != "" {
+				if id != tt.id {
+					t.Errorf("Message-ID = %q, want %q", id, tt.id)
+				}
+
+				return
+			}
+
+			if m := messageIDPattern.FindStringSubmatch(id); m == nil || m[1] != tt.want {
+				t.Errorf("Message-ID = %q, want domain %s", id, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetThread(t *testing.T) {
+	tests := []struct {
+		name       string
+		inReplyTo  string
+		references []string
+		wantReply  string
+		wantRefs   string
+	}{
+		{"reply", "<1@x>", nil, "<1@x>", "<1@x>"},
+		{"reply in thread", "<2@x>", []string{"<1@x>"}, "<2@x>", "<1@x> <2@x>"},
+		{"parent last already", "<2@x>", []string{"<1@x>", "<2@x>"}, "<2@x>", "<1@x> <2@x>"},
+		{"references only", "", []string{"<1@x>", "", "<2@x>"}, "", "<1@x> <2@x>"},
+		{"nothing", "", []string{""}, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testMessage()
+			m.SetThread(tt.inReplyTo, tt.references)
+			if got := m.GetHeader("In-Reply-To"); got != tt.wantReply {
+				t.Errorf("In-Reply-To = %q, want %q", got, tt.wantReply)
+			}
+
+			if got := m.GetHeader("References"); got != tt.wantRefs {
+				t.Errorf("References = %q, want %q", got, tt.wantRefs)
+			}
+		})
+	}
+}
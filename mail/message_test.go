@@ -0,0 +1,105 @@
+package mail
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var boundaryPattern = regexp.MustCompile(`boundary="?([0-9a-f]+)`)
+
+// sameBoundaries replaces the random boundaries of the message data by
+// fixed ones, in the order they appear.
+func sameBoundaries(data []byte) string {
+	s := string(data)
+	for i, m := range boundaryPattern.FindAllStringSubmatch(s, -1) {
+		s = strings.ReplaceAll(s, m[1], "boundary"+string(rune('a'+i)))
+	}
+
+	return s
+}
+
+// diffIndex returns the index of the first byte differing in a and b.
+func diffIndex(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+// chunkWriter writes to buf in chunks of at most n bytes at once.
+type chunkWriter struct {
+	buf bytes.Buffer
+	n   int
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += w.n {
+		w.buf.Write(p[i:min(i+w.n, len(p))])
+	}
+
+	return len(p), nil
+}
+
+func TestWriteTo(t *testing.T) {
+	dir := t.TempDir()
+	report := filepath.Join(dir, "report.bin")
+	if err := os.WriteFile(report, bytes.Repeat([]byte{0, 1, 2, 0xff}, 10000), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	original := filepath.Join(dir, "original.eml")
+	if err := os.WriteFile(original, []byte("Subject: original\n\nhello\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := testMessage()
+	m.Body = "héllo\nworld\n"
+	m.AttachContent("notes.txt", []byte("some notes\n"), nil)
+	if err := m.AttachFile(report, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AttachMessage(original, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.AttachDir(dir, "", "zip", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the message built at once in memory
+	var buffered bytes.Buffer
+	if err := newMessageBuilder(&buffered).Build(m); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &chunkWriter{n: 7}
+	n, err := m.WriteTo(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(w.buf.Len()) {
+		t.Errorf("WriteTo = %d, wrote %d bytes", n, w.buf.Len())
+	}
+
+	if got, want := sameBoundaries(w.buf.Bytes()), sameBoundaries(buffered.Bytes()); got != want {
+		t.Errorf("streamed message differs from the built one at byte %d", diffIndex(got, want))
+	}
+
+	// written again, the attachments are read again
+	again, err := m.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := sameBoundaries(again), sameBoundaries(w.buf.Bytes()); got != want {
+		t.Errorf("message written twice differs at byte %d", diffIndex(got, want))
+	}
+}
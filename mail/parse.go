@@ -0,0 +1,227 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// ErrNoContent is returned by ReadMessage for a message with neither
+// text body nor attachment.
+var ErrNoContent = errors.New("mail: message has no content")
+
+// mimeFields are the header fields the message builder generates,
+// they are dropped from parsed messages.
+var mimeFields = []string{"Content-Type", "Content-Transfer-Encoding", "Mime-Version"}
+
+// ReadMessage parses a RFC 5322 message read from r, such as one written
+// by Message.WriteTo, into a Message. The text body is taken from the
+// first text/plain or text/html part, the richest one of a
+// multipart/alternative whose other text parts become its alternatives,
+// every other part becomes an attachment. Text is decoded from its
+// transfer encoding but charsets other than utf-8 are kept as is, and
+// declared by the BodyType.
+func ReadMessage(r io.Reader) (*Message, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := NewMessage()
+	for k, v := range msg.Header {
+		result.Header[k] = v
+	}
+
+	header := textproto.MIMEHeader(msg.Header)
+	for _, k := range mimeFields {
+		textproto.MIMEHeader(result.Header).Del(k)
+	}
+
+	p := messageParser{msg: result}
+	if err = p.parsePart(header, msg.Body); err != nil {
+		return nil, err
+	}
+
+	if !p.hasBody && len(result.Attachments) == 0 {
+		return nil, ErrNoContent
+	}
+
+	return result, nil
+}
+
+// ReadMessageFile parses the message stored in the file at path,
+// typically an .eml file.
+func ReadMessageFile(path string) (*Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	return ReadMessage(f)
+}
+
+type messageParser struct {
+	msg     *Message
+	hasBody bool
+}
+
+func (p *messageParser) parsePart(header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 5.2, a missing or invalid Content-Type means plain text
+		mediaType, params = "text/plain", map[string]string{"charset": "us-ascii"}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		return p.parseMultipart(mediaType, params["boundary"], body)
+	}
+
+	content, err := io.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if !p.hasBody && disposition != "attachment" && isTextBody(mediaType) {
+		p.msg.Body = textContent(content)
+		p.msg.BodyType = mime.FormatMediaType(mediaType, params)
+		p.hasBody = true
+		return nil
+	}
+
+	attHeader := cloneHeader(header)
+	attHeader.Del("Content-Transfer-Encoding")
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+
+	if name == "" {
+		name = defaultPartName(mediaType)
+	}
+
+	p.msg.AttachContent(name, content, attHeader)
+	return nil
+}
+
+func (p *messageParser) parseMultipart(mediaType string, boundary string, body io.Reader) error {
+	if boundary == "" {
+		return fmt.Errorf("mail: %s without boundary", mediaType)
+	}
+
+	var parts []*multipart.Part
+	var contents [][]byte
+	mr := multipart.NewReader(body, boundary)
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return err
+		}
+
+		parts = append(parts, part)
+		contents = append(contents, content)
+	}
+
+	// alternatives are ordered by increasing preference (RFC 2046 5.1.4),
+	// the richest one is parsed, the text ones before it are kept as the
+	// alternatives of the body.
+	var alternatives []MessageBody
+	if mediaType == "multipart/alternative" && len(parts) > 0 {
+		best := len(parts) - 1
+		for i := len(parts) - 1; i >= 0; i-- {
+			ct, _, _ := mime.ParseMediaType(parts[i].Header.Get("Content-Type"))
+			if isTextBody(ct) || strings.HasPrefix(ct, "multipart/") {
+				best = i
+				break
+			}
+		}
+
+		for i, part := range parts[:best] {
+			ct, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if err != nil || !isTextBody(ct) {
+				continue
+			}
+
+			content, err := io.ReadAll(decodeTransfer(part.Header.Get("Content-Transfer-Encoding"), bytes.NewReader(contents[i])))
+			if err != nil {
+				return err
+			}
+
+			alternatives = append(alternatives, MessageBody{Content: textContent(content), ContentType: mime.FormatMediaType(ct, params)})
+		}
+
+		parts, contents = parts[best:best+1], contents[best:best+1]
+	}
+
+	hadBody := p.hasBody
+	for i, part := range parts {
+		if err := p.parsePart(part.Header, bytes.NewReader(contents[i])); err != nil {
+			return err
+		}
+	}
+
+	if !hadBody && p.hasBody {
+		p.msg.Alternatives = append(alternatives, p.msg.Alternatives...)
+	}
+
+	return nil
+}
+
+func isTextBody(mediaType string) bool {
+	return mediaType == "text/plain" || mediaType == "text/html"
+}
+
+// textContent returns the decoded content of a text part with LF line
+// endings, as bodies are written.
+func textContent(content []byte) string {
+	return string(bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n")))
+}
+
+// decodeTransfer returns a reader decoding r from the given
+// Content-Transfer-Encoding.
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case EncodingBase64:
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case EncodingQuotedPrintable:
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// defaultPartName names an attachment part which came without file name.
+func defaultPartName(mediaType string) string {
+	if mediaType == MessageContentType {
+		return "message.eml"
+	}
+
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return "part" + exts[0]
+	}
+
+	return "part"
+}
@@ -0,0 +1,169 @@
+package mail
+
+import (
+	"bytes"
+	"io"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// roundTrip writes m and reads it back.
+func roundTrip(t *testing.T, m *Message) *Message {
+	t.Helper()
+	b, err := m.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v\n%s", err, b)
+	}
+
+	return result
+}
+
+func attachmentContent(t *testing.T, a *MessageAttachment) string {
+	t.Helper()
+	r, err := a.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+// assertSameMessage compares the headers, bodies and attachments of two
+// messages.
+func assertSameMessage(t *testing.T, got *Message, want *Message) {
+	t.Helper()
+	for _, k := range []string{"From", "To", "Subject", "Message-Id"} {
+		if got.GetHeader(k) != want.GetHeader(k) {
+			t.Errorf("%s = %q, want %q", k, got.GetHeader(k), want.GetHeader(k))
+		}
+	}
+
+	if got.Body != want.Body {
+		t.Errorf("Body = %q, want %q", got.Body, want.Body)
+	}
+
+	if got.BodyType != want.BodyType {
+		t.Errorf("BodyType = %q, want %q", got.BodyType, want.BodyType)
+	}
+
+	if !reflect.DeepEqual(got.Alternatives, want.Alternatives) {
+		t.Errorf("Alternatives = %q, want %q", got.Alternatives, want.Alternatives)
+	}
+
+	if len(got.Attachments) != len(want.Attachments) {
+		t.Fatalf("%d attachments, want %d", len(got.Attachments), len(want.Attachments))
+	}
+
+	for i, att := range got.Attachments {
+		if att.Name != want.Attachments[i].Name {
+			t.Errorf("attachment %d name = %q, want %q", i, att.Name, want.Attachments[i].Name)
+		}
+
+		if attachmentContent(t, att) != attachmentContent(t, want.Attachments[i]) {
+			t.Errorf("attachment %s content differs", att.Name)
+		}
+	}
+}
+
+func newTestMessage() *Message {
+	m := NewMessage()
+	m.SetHeader("From", "me@example.com")
+	m.SetHeader("To", "you@example.com")
+	m.SetHeader("Subject", "round trip")
+	m.SetHeader("Message-Id", "<1@example.com>")
+	return m
+}
+
+func TestReadMessageRoundTrip(t *testing.T) {
+	m := newTestMessage()
+	m.Body = "héllo\nworld\n"
+	m.AttachContent("notes.txt", []byte("some notes\n"), textproto.MIMEHeader{})
+	m.AttachContent("data.bin", []byte{0, 1, 2, 0xff}, textproto.MIMEHeader{})
+
+	got := roundTrip(t, m)
+	// the sniffed type of the body is declared when written
+	m.BodyType = "text/plain; charset=utf-8"
+	assertSameMessage(t, got, m)
+	assertSameMessage(t, roundTrip(t, got), got)
+}
+
+func TestReadMessageKeepsBodyType(t *testing.T) {
+	raw := "From: me@example.com\r\n" +
+		"To: you@example.com\r\n" +
+		"Subject: latin\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/html; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<p>caf=E9</p>\r\n"
+
+	m, err := ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Body != "<p>caf\xe9</p>\n" {
+		t.Errorf("Body = %q", m.Body)
+	}
+
+	if m.BodyType != "text/html; charset=iso-8859-1" {
+		t.Errorf("BodyType = %q", m.BodyType)
+	}
+
+	b, err := m.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(b, []byte("Content-Type: text/html; charset=iso-8859-1\r\n")) {
+		t.Errorf("content type not kept:\n%s", b)
+	}
+
+	assertSameMessage(t, roundTrip(t, m), m)
+}
+
+func TestReadMessageKeepsAlternatives(t *testing.T) {
+	m := newTestMessage()
+	m.Body = "<p>hello</p>\n"
+	m.BodyType = "text/html; charset=utf-8"
+	m.Alternatives = []MessageBody{{Content: "hello\n", ContentType: "text/plain; charset=utf-8"}}
+
+	b, err := m.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(b, []byte("Content-Type: multipart/alternative;")) {
+		t.Errorf("not written as multipart/alternative:\n%s", b)
+	}
+
+	assertSameMessage(t, roundTrip(t, m), m)
+
+	// nested in multipart/mixed with an attachment
+	m.AttachContent("notes.txt", []byte("some notes\n"), textproto.MIMEHeader{})
+	assertSameMessage(t, roundTrip(t, m), m)
+}
+
+func TestReadMessageNoContent(t *testing.T) {
+	raw := "From: me@example.com\r\n" +
+		"Content-Type: multipart/mixed; boundary=x\r\n" +
+		"\r\n" +
+		"--x--\r\n"
+
+	if _, err := ReadMessage(strings.NewReader(raw)); err != ErrNoContent {
+		t.Errorf("err = %v, want ErrNoContent", err)
+	}
+}
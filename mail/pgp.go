@@ -0,0 +1,237 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// PGPKeysContentType is the media type of attached public keys.
+const PGPKeysContentType = "application/pgp-keys"
+
+// PGP signs and encrypts a message once built, as PGP/MIME (RFC 3156).
+type PGP struct {
+	// Signer signs the message when set, its private key must be
+	// decrypted.
+	Signer *openpgp.Entity
+	// Recipients encrypt the message to their keys when not empty, the
+	// message being signed within the encrypted data when Signer is set.
+	Recipients openpgp.EntityList
+	// AttachPublicKey attaches the public key of Signer to the message.
+	AttachPublicKey bool
+}
+
+var pgpConfig = &packet.Config{DefaultHash: crypto.SHA256}
+
+// ReadKeyRing reads the armored or binary keyring file at path.
+func ReadKeyRing(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys openpgp.EntityList
+	if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("pgp: %s: %w", path, err)
+	}
+
+	return keys, nil
+}
+
+// FindKey returns the key of keys matching query, which is an email
+// address of one of its identities, or the hex key id or fingerprint of
+// the key, with or without a 0x prefix.
+func FindKey(keys openpgp.EntityList, query string) (*openpgp.Entity, error) {
+	hex := strings.ToUpper(strings.TrimPrefix(strings.ReplaceAll(query, " ", ""), "0x"))
+	for _, e := range keys {
+		fingerprint := fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+		if len(hex) >= 8 && strings.HasSuffix(fingerprint, hex) {
+			return e, nil
+		}
+
+		for _, id := range e.Identities {
+			if id.UserId != nil && strings.EqualFold(id.UserId.Email, query) {
+				return e, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("pgp: no key found for %s", query)
+}
+
+// DecryptKey decrypts the private keys of e with passphrase when they
+// are encrypted.
+func DecryptKey(e *openpgp.Entity, passphrase []byte) error {
+	if e.PrivateKey == nil {
+		return fmt.Errorf("pgp: no private key for %X", e.PrimaryKey.Fingerprint)
+	}
+
+	if e.PrivateKey.Encrypted {
+		if err := e.PrivateKey.Decrypt(passphrase); err != nil {
+			return fmt.Errorf("pgp: %w", err)
+		}
+	}
+
+	for _, sub := range e.Subkeys {
+		if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+			if err := sub.PrivateKey.Decrypt(passphrase); err != nil {
+				return fmt.Errorf("pgp: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ArmoredPublicKey returns the armored public key of e.
+func ArmoredPublicKey(e *openpgp.Entity) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = e.Serialize(w); err != nil {
+		return nil, err
+	}
+
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// publicKeyAttachment returns the public key of the signer as an
+// attachment named after its key id.
+func (p *PGP) publicKeyAttachment() (*MessageAttachment, error) {
+	key, err := ArmoredPublicKey(p.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", PGPKeysContentType)
+	return &MessageAttachment{
+		Name:    fmt.Sprintf("0x%X.asc", p.Signer.PrimaryKey.KeyId),
+		Content: key,
+		Header:  header,
+	}, nil
+}
+
+// writeSigned writes entity to w as a multipart/signed entity, the
+// signature reading the entity as it is written.
+func (p *PGP) writeSigned(w io.Writer, entity io.Reader) error {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "Content-Type: multipart/signed; micalg=pgp-sha256; protocol=\"application/pgp-signature\";\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+	bw.WriteString("This is an OpenPGP/MIME signed message (RFC 3156)\r\n")
+	fmt.Fprintf(bw, "\r\n--%s\r\n", boundary)
+
+	// the entity is signed in its canonical form, as it is sent
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(&crlfWriter{w: pw}, entity)
+		pw.CloseWithError(err)
+	}()
+
+	var sig bytes.Buffer
+	err := openpgp.ArmoredDetachSign(&sig, p.Signer, io.TeeReader(pr, bw), pgpConfig)
+	pr.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("pgp: %w", err)
+	}
+
+	fmt.Fprintf(bw, "\r\n--%s\r\n", boundary)
+	bw.WriteString("Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n")
+	bw.WriteString("Content-Description: OpenPGP digital signature\r\n")
+	bw.WriteString("Content-Disposition: attachment; filename=\"signature.asc\"\r\n\r\n")
+	bw.Write(canonicalCRLF(sig.Bytes()))
+	fmt.Fprintf(bw, "\r\n--%s--\r\n", boundary)
+	return bw.Flush()
+}
+
+// writeEncrypted writes entity to w as a multipart/encrypted entity,
+// signed within the encrypted data when p has a signer, encrypting it as
+// it is read.
+func (p *PGP) writeEncrypted(w io.Writer, entity io.Reader) error {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\";\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+	bw.WriteString("This is an OpenPGP/MIME encrypted message (RFC 3156)\r\n")
+	fmt.Fprintf(bw, "\r\n--%s\r\n", boundary)
+	bw.WriteString("Content-Type: application/pgp-encrypted\r\n")
+	bw.WriteString("Content-Description: PGP/MIME version identification\r\n\r\n")
+	bw.WriteString("Version: 1\r\n")
+	fmt.Fprintf(bw, "\r\n--%s\r\n", boundary)
+	bw.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+	bw.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+	bw.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n")
+
+	aw, err := armor.Encode(&crlfWriter{w: bw}, "PGP MESSAGE", nil)
+	if err != nil {
+		return err
+	}
+
+	ew, err := openpgp.Encrypt(aw, p.Recipients, p.Signer, nil, pgpConfig)
+	if err != nil {
+		return fmt.Errorf("pgp: %w", err)
+	}
+
+	if _, err = io.Copy(&crlfWriter{w: ew}, entity); err != nil {
+		return err
+	}
+
+	if err = ew.Close(); err != nil {
+		return err
+	}
+
+	if err = aw.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(bw, "\r\n--%s--\r\n", boundary)
+	return bw.Flush()
+}
+
+// Protect writes the built message read from r to w, signed or encrypted
+// as configured. The message is streamed, only the signature being held
+// in memory.
+func (p *PGP) Protect(w io.Writer, r io.Reader) error {
+	if p.Signer == nil && len(p.Recipients) == 0 {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	header, entity, err := readEntity(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(append(header, "MIME-Version: 1.0\r\n"...)); err != nil {
+		return err
+	}
+
+	if len(p.Recipients) > 0 {
+		return p.writeEncrypted(w, entity)
+	}
+
+	return p.writeSigned(w, entity)
+}
@@ -0,0 +1,225 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// newPGPEntity returns a new key of email.
+func newPGPEntity(t *testing.T, email string) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity("", "", email, &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+func newPGPMessage() *Message {
+	m := NewMessage()
+	m.SetHeader("From", "me@example.com")
+	m.SetHeader("To", "you@example.com")
+	m.SetHeader("Subject", "hello")
+	m.Body = "hello\nworld\n"
+	m.AttachContent("notes.txt", []byte("some notes\n"), nil)
+	return m
+}
+
+// readPGPParts parses the protected message data, returning the media
+// type of its body and its two parts, the first one raw as it is signed.
+func readPGPParts(t *testing.T, data []byte) (string, []byte, []byte) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := msg.Header.Get("Subject"); got != "hello" {
+		t.Errorf("Subject = %q", got)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delimiter := "\r\n--" + params["boundary"]
+	_, first, ok := strings.Cut(string(body), delimiter+"\r\n")
+	if !ok {
+		t.Fatalf("no first part:\n%s", body)
+	}
+
+	first, _, ok = strings.Cut(first, delimiter)
+	if !ok {
+		t.Fatalf("no second part:\n%s", body)
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var second []byte
+	for i := 0; i < 2; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if second, err = io.ReadAll(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return mediaType, []byte(first), second
+}
+
+func TestPGPSign(t *testing.T) {
+	signer := newPGPEntity(t, "me@example.com")
+	m := newPGPMessage()
+	m.PGP = &PGP{Signer: signer, AttachPublicKey: true}
+	data, err := m.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, signed, sig := readPGPParts(t, data)
+	if mediaType != "multipart/signed" {
+		t.Fatalf("media type = %s", mediaType)
+	}
+
+	if bytes.Contains(bytes.ReplaceAll(signed, []byte("\r\n"), nil), []byte("\n")) {
+		t.Error("signed part not in canonical form")
+	}
+
+	got, err := openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{signer}, bytes.NewReader(signed), bytes.NewReader(sig), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.PrimaryKey.KeyId != signer.PrimaryKey.KeyId {
+		t.Errorf("signed by %X", got.PrimaryKey.KeyId)
+	}
+
+	// the public key is attached within the signed part
+	name := fmt.Sprintf("0x%X.asc", signer.PrimaryKey.KeyId)
+	if !bytes.Contains(signed, []byte(PGPKeysContentType)) || !bytes.Contains(signed, []byte(name)) {
+		t.Errorf("public key not attached:\n%s", signed)
+	}
+
+	// a changed message does not verify
+	changed := bytes.Replace(signed, []byte("world"), []byte("World"), 1)
+	if _, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{signer}, bytes.NewReader(changed), bytes.NewReader(sig), nil); err == nil {
+		t.Error("changed message verified")
+	}
+}
+
+func TestPGPEncrypt(t *testing.T) {
+	signer := newPGPEntity(t, "me@example.com")
+	recipient := newPGPEntity(t, "you@example.com")
+	tests := []struct {
+		name   string
+		signer *openpgp.Entity
+	}{
+		{"encrypted", nil},
+		{"signed and encrypted", signer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newPGPMessage()
+			m.PGP = &PGP{Signer: tt.signer, Recipients: openpgp.EntityList{recipient}}
+			data, err := m.ToBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Contains(data, []byte("world")) || bytes.Contains(data, []byte("some notes")) {
+				t.Fatal("content in the clear")
+			}
+
+			mediaType, version, encrypted := readPGPParts(t, data)
+			if mediaType != "multipart/encrypted" {
+				t.Fatalf("media type = %s", mediaType)
+			}
+
+			if !bytes.HasSuffix(version, []byte("\r\n\r\nVersion: 1\r\n")) {
+				t.Errorf("version part = %q", version)
+			}
+
+			block, err := armor.Decode(bytes.NewReader(encrypted))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{recipient, signer}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plain, err := io.ReadAll(md.UnverifiedBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if md.IsSigned != (tt.signer != nil) || md.SignatureError != nil {
+				t.Errorf("signed %v, signature error %v", md.IsSigned, md.SignatureError)
+			}
+
+			entity, err := mail.ReadMessage(bytes.NewReader(plain))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := entity.Header.Get("Content-Type"); !strings.HasPrefix(got, "multipart/mixed;") {
+				t.Errorf("Content-Type = %q", got)
+			}
+
+			if !bytes.Contains(plain, []byte("hello\r\nworld\r\n")) || !bytes.Contains(plain, []byte("notes.txt")) {
+				t.Errorf("decrypted message:\n%s", plain)
+			}
+		})
+	}
+}
+
+func TestPGPProtectNothing(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (&PGP{}).Protect(&buf, strings.NewReader("Subject: hello\r\n\r\nhello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "Subject: hello\r\n\r\nhello\r\n" {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+func TestFindKey(t *testing.T) {
+	me := newPGPEntity(t, "me@example.com")
+	you := newPGPEntity(t, "you@example.com")
+	keys := openpgp.EntityList{me, you}
+	fingerprint := fmt.Sprintf("%x", you.PrimaryKey.Fingerprint)
+	for _, query := range []string{"You@Example.com", fingerprint, "0x" + fingerprint[len(fingerprint)-16:], fingerprint[len(fingerprint)-8:]} {
+		got, err := FindKey(keys, query)
+		if err != nil || got != you {
+			t.Errorf("FindKey(%q) = %v, %v", query, got, err)
+		}
+	}
+
+	for _, query := range []string{"other@example.com", fingerprint[len(fingerprint)-6:]} {
+		if _, err := FindKey(keys, query); err == nil {
+			t.Errorf("FindKey(%q) found a key", query)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+)
+
+// Object identifiers of the CMS (RFC 5652) structures produced for S/MIME.
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidAES256CBC       = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+)
+
+// The structures are assembled from DER encoded elements, which keeps
+// the implicit tagging and SET OF ordering of CMS under control.
+
+// derEncoder marshals values, keeping the first error so that a whole
+// structure is assembled before checking it.
+type derEncoder struct {
+	err error
+}
+
+func (e *derEncoder) marshal(v any) []byte {
+	if e.err != nil {
+		return nil
+	}
+
+	b, err := asn1.Marshal(v)
+	if err != nil {
+		e.err = fmt.Errorf("smime: %w", err)
+	}
+
+	return b
+}
+
+// derElement returns an element of content, tag must be lower than 31.
+func derElement(class int, tag int, compound bool, content []byte) []byte {
+	return append(derHeader(class, tag, compound, len(content)), content...)
+}
+
+func derSequence(elems ...[]byte) []byte {
+	return derElement(asn1.ClassUniversal, asn1.TagSequence, true, bytes.Join(elems, nil))
+}
+
+// derSetContent returns the content of a SET OF, sorted as DER requires.
+func derSetContent(elems ...[]byte) []byte {
+	sorted := slices.Clone(elems)
+	slices.SortFunc(sorted, bytes.Compare)
+	return bytes.Join(sorted, nil)
+}
+
+func derSet(elems ...[]byte) []byte {
+	return derElement(asn1.ClassUniversal, asn1.TagSet, true, derSetContent(elems...))
+}
+
+// derExplicit wraps elem in an explicit context specific tag.
+func derExplicit(tag int, elem []byte) []byte {
+	return derElement(asn1.ClassContextSpecific, tag, true, elem)
+}
+
+func (e *derEncoder) algorithm(oid asn1.ObjectIdentifier, params []byte) []byte {
+	if params == nil {
+		return derSequence(e.marshal(oid))
+	}
+
+	return derSequence(e.marshal(oid), params)
+}
+
+var derNull = []byte{asn1.TagNull, 0}
+
+func (e *derEncoder) contentInfo(contentType asn1.ObjectIdentifier, content []byte) []byte {
+	return derSequence(e.marshal(contentType), derExplicit(0, content))
+}
+
+func (e *derEncoder) issuerAndSerial(cert *x509.Certificate) []byte {
+	return derSequence(cert.RawIssuer, e.marshal(new(big.Int).Set(cert.SerialNumber)))
+}
+
+func (e *derEncoder) attribute(oid asn1.ObjectIdentifier, value []byte) []byte {
+	return derSequence(e.marshal(oid), derSet(value))
+}
+
+// signatureAlgorithm returns the algorithm identifier of signatures made
+// with key, and the options to sign a SHA-256 digest with it.
+func (e *derEncoder) signatureAlgorithm(key crypto.Signer) ([]byte, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return e.algorithm(oidRSAEncryption, derNull), nil
+	case *ecdsa.PrivateKey:
+		return e.algorithm(oidECDSAWithSHA256, nil), nil
+	}
+
+	return nil, fmt.Errorf("smime: unsupported key type %T", key)
+}
+
+// signDetached returns a DER encoded CMS SignedData of the content whose
+// SHA-256 digest is given, which is not included, signed by key with
+// cert, chain being added to the certificates of the signature.
+func signDetached(digest []byte, cert *x509.Certificate, key crypto.Signer, chain []*x509.Certificate) ([]byte, error) {
+	var e derEncoder
+	sigAlg, err := e.signatureAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := derSetContent(
+		e.attribute(oidContentType, e.marshal(oidData)),
+		e.attribute(oidSigningTime, e.marshal(time.Now().UTC())),
+		e.attribute(oidMessageDigest, e.marshal(digest)),
+	)
+
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	// the signature covers the attributes encoded as a SET, while they
+	// are sent with an implicit [0] tag
+	attrsDigest := sha256.Sum256(derElement(asn1.ClassUniversal, asn1.TagSet, true, attrs))
+	signature, err := key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("smime: %w", err)
+	}
+
+	digestAlg := e.algorithm(oidSHA256, nil)
+	signerInfo := derSequence(
+		e.marshal(1),
+		e.issuerAndSerial(cert),
+		digestAlg,
+		derElement(asn1.ClassContextSpecific, 0, true, attrs),
+		sigAlg,
+		e.marshal(signature),
+	)
+
+	var certs [][]byte
+	for _, c := range append([]*x509.Certificate{cert}, chain...) {
+		certs = append(certs, c.Raw)
+	}
+
+	signedData := derSequence(
+		e.marshal(1),
+		derSet(digestAlg),
+		derSequence(e.marshal(oidData)),
+		derElement(asn1.ClassContextSpecific, 0, true, derSetContent(certs...)),
+		derSet(signerInfo),
+	)
+
+	result := e.contentInfo(oidSignedData, signedData)
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	return result, nil
+}
+
+// derHeader returns the identifier and length octets of an element whose
+// content is length bytes long.
+func derHeader(class int, tag int, compound bool, length int) []byte {
+	id := byte(class<<6 | tag)
+	if compound {
+		id |= 0x20
+	}
+
+	if length < 0x80 {
+		return []byte{id, byte(length)}
+	}
+
+	var octets []byte
+	for n := length; n > 0; n >>= 8 {
+		octets = append([]byte{byte(n)}, octets...)
+	}
+
+	return append([]byte{id, 0x80 | byte(len(octets))}, octets...)
+}
+
+// derPrefix returns the beginning of a SEQUENCE made of elems followed by
+// tail bytes not included, so that a large last element is not copied.
+func derPrefix(tail int, elems ...[]byte) []byte {
+	content := bytes.Join(elems, nil)
+	return append(derHeader(asn1.ClassUniversal, asn1.TagSequence, true, len(content)+tail), content...)
+}
+
+// encryptEnveloped returns a DER encoded CMS EnvelopedData of content,
+// encrypted with AES-256-CBC under a random key transported to each of
+// the recipients with RSA. Content is encrypted in place, and returned
+// as the end of the encoding following prefix.
+func encryptEnveloped(content []byte, recipients []*x509.Certificate) (prefix []byte, encrypted []byte, err error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := rand.Read(iv); err != nil {
+		return nil, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// PKCS #7 padding, always at least one byte
+	pad := aes.BlockSize - len(content)%aes.BlockSize
+	encrypted = append(content, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	var e derEncoder
+	var recipientInfos [][]byte
+	for _, cert := range recipients {
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("smime: unsupported key type %T of %s", cert.PublicKey, cert.Subject)
+		}
+
+		encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("smime: %w", err)
+		}
+
+		recipientInfos = append(recipientInfos, derSequence(
+			e.marshal(0),
+			e.issuerAndSerial(cert),
+			e.algorithm(oidRSAEncryption, derNull),
+			e.marshal(encryptedKey),
+		))
+	}
+
+	// ContentInfo { oid, [0] EnvelopedData { version, recipients,
+	// EncryptedContentInfo { oid, algorithm, [0] encrypted } } }
+	n := len(encrypted)
+	prefix = derHeader(asn1.ClassContextSpecific, 0, false, n)
+	prefix = derPrefix(n, e.marshal(oidData), e.algorithm(oidAES256CBC, e.marshal(iv)), prefix)
+	prefix = derPrefix(n, e.marshal(0), derSet(recipientInfos...), prefix)
+	prefix = append(derHeader(asn1.ClassContextSpecific, 0, true, len(prefix)+n), prefix...)
+	prefix = derPrefix(n, e.marshal(oidEnvelopedData), prefix)
+	if e.err != nil {
+		return nil, nil, e.err
+	}
+
+	return prefix, encrypted, nil
+}
@@ -0,0 +1,306 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// The CMS structures are parsed back with encoding/asn1 as RFC 5652
+// defines them, independently of how they are built.
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+	Certificates     asn1.RawValue   `asn1:"tag:0"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	Sid                cmsIssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type cmsEnvelopedData struct {
+	Version              int
+	RecipientInfos       []cmsRecipientInfo `asn1:"set"`
+	EncryptedContentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Algorithm   pkix.AlgorithmIdentifier
+		Content     []byte `asn1:"tag:0"`
+	}
+}
+
+type cmsRecipientInfo struct {
+	Version      int
+	Rid          cmsIssuerAndSerial
+	Algorithm    pkix.AlgorithmIdentifier
+	EncryptedKey []byte
+}
+
+// unmarshalAll parses b into v, failing on trailing bytes.
+func unmarshalAll(t *testing.T, b []byte, v any) {
+	t.Helper()
+	rest, err := asn1.Unmarshal(b, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rest) > 0 {
+		t.Fatalf("%d trailing bytes", len(rest))
+	}
+}
+
+// newTestCert returns a self-signed certificate of key.
+func newTestCert(t *testing.T, key crypto.Signer, serial int64) *x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        pkix.Name{CommonName: "me@example.com"},
+		EmailAddresses: []string{"me@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestSignDetached(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  crypto.Signer
+	}{
+		{"rsa", newRSAKey(t)},
+		{"ecdsa", ecKey},
+	}
+
+	content := []byte("Content-Type: text/plain\r\n\r\nhello\r\n")
+	digest := sha256.Sum256(content)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := newTestCert(t, tt.key, 1)
+			der, err := signDetached(digest[:], cert, tt.key, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ci cmsContentInfo
+			unmarshalAll(t, der, &ci)
+			if !ci.ContentType.Equal(oidSignedData) {
+				t.Fatalf("content type = %s", ci.ContentType)
+			}
+
+			var sd cmsSignedData
+			unmarshalAll(t, ci.Content.Bytes, &sd)
+			if !sd.ContentInfo.ContentType.Equal(oidData) || len(sd.SignerInfos) != 1 {
+				t.Fatalf("signed data = %+v", sd)
+			}
+
+			certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+			if err != nil || len(certs) != 1 || !certs[0].Equal(cert) {
+				t.Fatalf("certificates = %v, %v", certs, err)
+			}
+
+			si := sd.SignerInfos[0]
+			if si.Sid.Serial.Cmp(cert.SerialNumber) != 0 || !bytes.Equal(si.Sid.Issuer.FullBytes, cert.RawIssuer) {
+				t.Errorf("signer = %+v", si.Sid)
+			}
+
+			if !si.DigestAlgorithm.Algorithm.Equal(oidSHA256) {
+				t.Errorf("digest algorithm = %s", si.DigestAlgorithm.Algorithm)
+			}
+
+			// the message digest attribute is the digest of the content
+			found := false
+			for rest := si.SignedAttrs.Bytes; len(rest) > 0; {
+				var attr cmsAttribute
+				if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+					t.Fatal(err)
+				}
+
+				if attr.Type.Equal(oidMessageDigest) {
+					var got []byte
+					unmarshalAll(t, attr.Values.Bytes, &got)
+					found = bytes.Equal(got, digest[:])
+				}
+			}
+
+			if !found {
+				t.Error("no message digest of the content")
+			}
+
+			// the signature covers the attributes encoded as a SET
+			attrs, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			attrsDigest := sha256.Sum256(attrs)
+			switch pub := cert.PublicKey.(type) {
+			case *rsa.PublicKey:
+				err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, attrsDigest[:], si.Signature)
+			case *ecdsa.PublicKey:
+				if !ecdsa.VerifyASN1(pub, attrsDigest[:], si.Signature) {
+					err = errors.New("invalid ecdsa signature")
+				}
+			}
+
+			if err != nil {
+				t.Errorf("signature: %v", err)
+			}
+		})
+	}
+}
+
+func TestEncryptEnveloped(t *testing.T) {
+	keys := []*rsa.PrivateKey{newRSAKey(t), newRSAKey(t)}
+	var certs []*x509.Certificate
+	for i, key := range keys {
+		certs = append(certs, newTestCert(t, key, int64(i+1)))
+	}
+
+	for _, content := range []string{"", "hello\r\n", string(bytes.Repeat([]byte("0123456789abcdef"), 100))} {
+		prefix, encrypted, err := encryptEnveloped([]byte(content), certs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ci cmsContentInfo
+		unmarshalAll(t, append(prefix, encrypted...), &ci)
+		if !ci.ContentType.Equal(oidEnvelopedData) {
+			t.Fatalf("content type = %s", ci.ContentType)
+		}
+
+		var ed cmsEnvelopedData
+		unmarshalAll(t, ci.Content.Bytes, &ed)
+		eci := ed.EncryptedContentInfo
+		if !eci.ContentType.Equal(oidData) || !eci.Algorithm.Algorithm.Equal(oidAES256CBC) {
+			t.Fatalf("encrypted content info = %+v", eci)
+		}
+
+		var iv []byte
+		unmarshalAll(t, eci.Algorithm.Parameters.FullBytes, &iv)
+		if len(ed.RecipientInfos) != len(keys) {
+			t.Fatalf("%d recipients, want %d", len(ed.RecipientInfos), len(keys))
+		}
+
+		// each recipient decrypts the content
+		for i, key := range keys {
+			ri := ed.RecipientInfos[i]
+			if ri.Rid.Serial.Cmp(certs[i].SerialNumber) != 0 {
+				t.Fatalf("recipient %d serial = %s", i, ri.Rid.Serial)
+			}
+
+			cek, err := rsa.DecryptPKCS1v15(rand.Reader, key, ri.EncryptedKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			block, err := aes.NewCipher(cek)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plain := make([]byte, len(eci.Content))
+			cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, eci.Content)
+			pad := int(plain[len(plain)-1])
+			if pad < 1 || pad > aes.BlockSize || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+				t.Fatalf("invalid padding %d", pad)
+			}
+
+			if got := string(plain[:len(plain)-pad]); got != content {
+				t.Errorf("recipient %d: got %q, want %q", i, got, content)
+			}
+		}
+	}
+}
+
+func TestDERElement(t *testing.T) {
+	for _, n := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 0x10000} {
+		content := bytes.Repeat([]byte{1}, n)
+		want, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: content})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := derElement(asn1.ClassContextSpecific, 3, true, content); !bytes.Equal(got, want) {
+			t.Errorf("%d bytes of content: got % x, want % x", n, got[:min(len(got), 8)], want[:min(len(want), 8)])
+		}
+	}
+}
+
+// The first error of the values marshaled is returned.
+func TestDEREncoderError(t *testing.T) {
+	var e derEncoder
+	e.marshal(1)
+	e.algorithm(asn1.ObjectIdentifier{1}, nil)
+	err := e.err
+	if err == nil {
+		t.Fatal("invalid object identifier marshaled")
+	}
+
+	e.marshal(time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC))
+	if e.err != err {
+		t.Errorf("err = %v, want %v", e.err, err)
+	}
+}
@@ -0,0 +1,144 @@
+package mail
+
+import (
+	"errors"
+	"io"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+)
+
+// ErrPoolClosed is returned when sending through a closed Pool.
+var ErrPoolClosed = errors.New("smtp: pool closed")
+
+// Pool keeps authenticated connections to the smtp server of an SmtpAuth
+// open, so that many messages are sent without a new connection each.
+// It is safe for concurrent use, every connection being used by a single
+// sender at once.
+type Pool struct {
+	smtp *SmtpAuth
+	// dial opens new connections, smtp.Dial but in tests
+	dial func() (*smtp.Client, error)
+	// idle connections ready for a new transaction
+	idle   chan *smtp.Client
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewPool returns a pool keeping at most size idle connections of s.
+func (s *SmtpAuth) NewPool(size int) *Pool {
+	return &Pool{smtp: s, dial: s.Dial, idle: make(chan *smtp.Client, max(size, 1))}
+}
+
+// get returns an idle connection checked with RSET, or a new one.
+func (p *Pool) get() (*smtp.Client, error) {
+	for {
+		select {
+		case c, ok := <-p.idle:
+			if !ok {
+				return nil, ErrPoolClosed
+			}
+
+			if err := c.Reset(); err != nil {
+				// timed out or closed by the server
+				c.Close()
+				continue
+			}
+
+			return c, nil
+		default:
+		}
+
+		c, err := p.dial()
+		if err != nil {
+			return nil, err
+		}
+
+		if err = p.smtp.hello(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		return c, nil
+	}
+}
+
+// put returns c to the pool, or quits it when the pool is full or closed.
+func (p *Pool) put(c *smtp.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		select {
+		case p.idle <- c:
+			return
+		default:
+		}
+	}
+
+	c.Quit()
+}
+
+// Send sends msg as is from the envelope sender to the envelope
+// recipients through a pooled connection, returning the reply of the
+// server accepting it.
+func (p *Pool) Send(from string, to []string, msg io.WriterTo) (string, error) {
+	if err := validateLine(from); err != nil {
+		return "", err
+	}
+
+	for _, recp := range to {
+		if err := validateLine(recp); err != nil {
+			return "", err
+		}
+	}
+
+	c, err := p.get()
+	if err != nil {
+		return "", err
+	}
+
+	reply, err := p.smtp.transaction(c, from, to, msg)
+	if err != nil {
+		// a rejected command leaves the connection usable, anything else
+		// may have left it in the middle of a transaction
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			p.put(c)
+		} else {
+			c.Close()
+		}
+
+		return "", err
+	}
+
+	p.put(c)
+	return reply, nil
+}
+
+// SendMessage sends m through a pooled connection.
+func (p *Pool) SendMessage(m *Message) (string, error) {
+	from, to, err := m.Envelope()
+	if err != nil {
+		return "", err
+	}
+
+	return p.Send(from, to, m)
+}
+
+// Close quits the idle connections, those in use are quit when their
+// message is sent.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+
+	p.closed = true
+	close(p.idle)
+	for c := range p.idle {
+		c.Quit()
+	}
+
+	return nil
+}
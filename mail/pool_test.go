@@ -0,0 +1,178 @@
+package mail
+
+import (
+	"errors"
+	"net"
+	"net/smtp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lifeym/she/relay"
+)
+
+// startRelay serves a relay server with handler on a loopback listener
+// until the end of the test, it returns an auth connecting to it.
+func startRelay(t *testing.T, timeout time.Duration, handler relay.Handler) *SmtpAuth {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &relay.Server{
+		Hostname: "relay.test",
+		Timeout:  timeout,
+		Handler:  handler,
+		Authenticate: func(user string, password string) bool {
+			return user == "u" && password == "p"
+		},
+	}
+
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	addr := l.Addr().(*net.TCPAddr)
+	return New("u", "p", "127.0.0.1", addr.Port, true)
+}
+
+// newTestPool returns a pool of s counting its connections.
+func newTestPool(t *testing.T, s *SmtpAuth, size int) (*Pool, *atomic.Int32) {
+	t.Helper()
+	var dials atomic.Int32
+	p := s.NewPool(size)
+	p.dial = func() (*smtp.Client, error) {
+		dials.Add(1)
+		return s.Dial()
+	}
+
+	t.Cleanup(func() { p.Close() })
+	return p, &dials
+}
+
+func testMessage() *Message {
+	m := NewMessage()
+	m.SetHeader("From", "me@example.com")
+	m.SetHeader("To", "you@example.com")
+	m.SetHeader("Subject", "hello")
+	m.Body = "hello\n"
+	return m
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	received := make(chan *relay.Envelope, 10)
+	s := startRelay(t, 0, func(env *relay.Envelope) error {
+		received <- env
+		return nil
+	})
+
+	p, dials := newTestPool(t, s, 1)
+	for i := 0; i < 3; i++ {
+		reply, err := p.SendMessage(testMessage())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reply != "250 2.0.0 OK: relayed" {
+			t.Errorf("reply = %q", reply)
+		}
+
+		if env := <-received; env.User != "u" || env.From != "me@example.com" {
+			t.Errorf("envelope = %+v", env)
+		}
+	}
+
+	// a rejected recipient leaves the connection usable
+	if _, err := p.Send("me@example.com", []string{"you@"}, testMessage()); err == nil {
+		t.Error("invalid recipient accepted")
+	}
+
+	if _, err := p.SendMessage(testMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := dials.Load(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+}
+
+// Connections closed by the server while idle are replaced.
+func TestPoolEvictsClosedConnections(t *testing.T) {
+	s := startRelay(t, 100*time.Millisecond, func(env *relay.Envelope) error { return nil })
+	p, dials := newTestPool(t, s, 1)
+	for i := 0; i < 2; i++ {
+		if _, err := p.SendMessage(testMessage()); err != nil {
+			t.Fatal(err)
+		}
+
+		// past the idle timeout of the server
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	if n := dials.Load(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+}
+
+// Connections over the size of the pool are quit once used.
+func TestPoolSize(t *testing.T) {
+	// both messages are in flight at once
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	s := startRelay(t, 0, func(env *relay.Envelope) error {
+		arrived.Done()
+		arrived.Wait()
+		return nil
+	})
+
+	p, dials := newTestPool(t, s, 1)
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.SendMessage(testMessage())
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(p.idle); n != 1 {
+		t.Errorf("%d idle connections, want 1", n)
+	}
+
+	arrived.Add(1)
+	if _, err := p.SendMessage(testMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := dials.Load(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+
+	p.Close()
+	if _, err := p.SendMessage(testMessage()); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("err = %v, want ErrPoolClosed", err)
+	}
+}
+
+func TestPoolAuthFails(t *testing.T) {
+	s := startRelay(t, 0, func(env *relay.Envelope) error { return nil })
+	s.auth = smtp.PlainAuth("", "u", "wrong", "127.0.0.1")
+	p, _ := newTestPool(t, s, 1)
+	if _, err := p.SendMessage(testMessage()); err == nil {
+		t.Fatal("sent with invalid credentials")
+	}
+
+	if n := len(p.idle); n != 0 {
+		t.Errorf("%d idle connections, want 0", n)
+	}
+}
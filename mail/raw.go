@@ -0,0 +1,160 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// ErrMalformedHeader is returned by ReadRawMessage for a header line which
+// is neither a field nor a continuation.
+var ErrMalformedHeader = errors.New("mail: malformed header line")
+
+type rawField struct {
+	name  string
+	value string
+}
+
+// RawMessage is a message kept as read, without decoding its MIME
+// structure, so that it can be relayed untouched. Header fields keep
+// their original order and folding.
+type RawMessage struct {
+	fields []rawField
+	Body   []byte
+}
+
+// ReadRawMessage reads a whole message from r.
+func ReadRawMessage(r io.Reader) (*RawMessage, error) {
+	br := bufio.NewReader(r)
+	fields, err := readRawHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RawMessage{fields: fields, Body: body}, nil
+}
+
+// readRawHeader reads the header fields of a message up to the empty line
+// ending them, continuation lines are kept in the values after a CRLF.
+func readRawHeader(br *bufio.Reader) ([]rawField, error) {
+	var fields []rawField
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			if err == io.EOF && line == "" && len(fields) == 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+
+			break
+		}
+
+		if trimmed[0] == ' ' || trimmed[0] == '\t' {
+			if len(fields) == 0 {
+				return nil, ErrMalformedHeader
+			}
+
+			last := &fields[len(fields)-1]
+			last.value += "\r\n" + trimmed
+		} else {
+			name, value, ok := strings.Cut(trimmed, ":")
+			if !ok || name == "" || strings.ContainsAny(name, " \t") {
+				return nil, fmt.Errorf("%w: %q", ErrMalformedHeader, trimmed)
+			}
+
+			fields = append(fields, rawField{name, strings.TrimLeft(value, " \t")})
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return fields, nil
+}
+
+// Get returns the first value of the header field name, unfolded.
+func (m *RawMessage) Get(name string) string {
+	values := m.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// Values returns all the values of the header field name, unfolded.
+func (m *RawMessage) Values(name string) []string {
+	var result []string
+	for _, f := range m.fields {
+		if strings.EqualFold(f.name, name) {
+			result = append(result, strings.ReplaceAll(f.value, "\r\n", ""))
+		}
+	}
+
+	return result
+}
+
+// Add appends the header field name with value.
+func (m *RawMessage) Add(name string, value string) {
+	m.fields = append(m.fields, rawField{textproto.CanonicalMIMEHeaderKey(name), value})
+}
+
+// Del removes every header field name.
+func (m *RawMessage) Del(name string) {
+	fields := m.fields[:0]
+	for _, f := range m.fields {
+		if !strings.EqualFold(f.name, name) {
+			fields = append(fields, f)
+		}
+	}
+
+	m.fields = fields
+}
+
+// AddressList parses the addresses of every header field name.
+func (m *RawMessage) AddressList(name string) ([]*mail.Address, error) {
+	var result []*mail.Address
+	for _, v := range m.Values(name) {
+		addrs, err := mail.ParseAddressList(v)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, addrs...)
+	}
+
+	return result, nil
+}
+
+// WriteTo writes the message to w with CRLF line endings in the header,
+// the body is written as read.
+func (m *RawMessage) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, f := range m.fields {
+		fmt.Fprintf(&buf, "%s: %s\r\n", f.name, f.value)
+	}
+
+	buf.WriteString("\r\n")
+	n, err := buf.WriteTo(w)
+	if err != nil {
+		return n, err
+	}
+
+	bn, err := w.Write(m.Body)
+	return n + int64(bn), err
+}
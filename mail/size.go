@@ -0,0 +1,285 @@
+package mail
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// partOverhead is a generous estimate of the bytes a multipart part takes
+// besides its content: the boundary line and the part header.
+const partOverhead = 512
+
+// ErrAttachmentTooLarge is returned by SplitBySize when a single attachment
+// does not fit in a message.
+var ErrAttachmentTooLarge = errors.New("attachment too large for a single message")
+
+// ErrCannotSplit is returned by SplitBySize when the message is too large
+// without any attachment.
+var ErrCannotSplit = errors.New("message too large without its attachments")
+
+// Size returns the size in bytes of the message once written. The
+// attachments are not encoded, their size being computed from that of
+// their content when known, else measured once. Signed or encrypted
+// messages are written.
+func (m *Message) Size() (int64, error) {
+	if m.SMIME != nil || m.PGP != nil {
+		return m.WriteTo(io.Discard)
+	}
+
+	cw := countingWriter{w: io.Discard}
+	mb := newMessageBuilder(&cw)
+	mb.sizeOnly = true
+	err := mb.Build(m)
+	return cw.n + mb.skipped, err
+}
+
+// WireSize returns the size in bytes of msg as sent, with the
+// DKIM-Signature header of d when set.
+func WireSize(msg io.WriterTo, d *DKIMSigner) (int64, error) {
+	signed, release, err := dkimSigned(d, msg)
+	if err != nil {
+		return 0, err
+	}
+
+	defer release()
+	return signed.WriteTo(io.Discard)
+}
+
+// EncodedSize returns the size in bytes of the attachment content once
+// transfer encoded, the part header is not included.
+func (a *MessageAttachment) EncodedSize() (int64, error) {
+	if a.encodedSize > 0 {
+		return a.encodedSize, nil
+	}
+
+	r, err := a.Open()
+	if err != nil {
+		return 0, err
+	}
+
+	defer r.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+
+	header, err := a.partHeader(head[:n])
+	if err != nil {
+		return 0, err
+	}
+
+	return a.encodedLen(header, io.MultiReader(bytes.NewReader(head[:n]), r))
+}
+
+// encodedLen returns the size of the content of a read from r once
+// encoded as header tells. It is computed from the size of the content
+// when known, else the content is encoded once and its size kept for the
+// next calls.
+func (a *MessageAttachment) encodedLen(header textproto.MIMEHeader, r io.Reader) (int64, error) {
+	if a.encodedSize > 0 {
+		return a.encodedSize, nil
+	}
+
+	if n, ok := a.contentSize(); ok && strings.EqualFold(header.Get("Content-Transfer-Encoding"), EncodingBase64) {
+		return base64Size(n), nil
+	}
+
+	cw := countingWriter{w: io.Discard}
+	if err := writeContent(&cw, header, r); err != nil {
+		return 0, err
+	}
+
+	a.encodedSize = cw.n
+	return cw.n, nil
+}
+
+// contentSize returns the size of the content of a when known without
+// reading it: that of Content, or of the file at Path.
+func (a *MessageAttachment) contentSize() (int64, bool) {
+	switch {
+	case a.Source != nil:
+		return 0, false
+	case a.Path != "":
+		fi, err := os.Stat(a.Path)
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0, false
+		}
+
+		return fi.Size(), true
+	default:
+		return int64(len(a.Content)), true
+	}
+}
+
+// base64Size returns the size of n bytes once written by newBase64Writer:
+// 4 bytes for every 3, lines of maxEncodedLineLength separated by CRLF.
+func base64Size(n int64) int64 {
+	encoded := (n + 2) / 3 * 4
+	if encoded == 0 {
+		return 0
+	}
+
+	return encoded + (encoded-1)/maxEncodedLineLength*2
+}
+
+// compressedTypes lists media types which do not shrink when gzipped.
+var compressedTypes = []string{
+	"application/gzip",
+	"application/pdf",
+	"application/vnd.oasis.opendocument.",
+	"application/vnd.openxmlformats-officedocument.",
+	"application/vnd.rar",
+	"application/x-7z-compressed",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/zip",
+	"audio/",
+	"image/",
+	"video/",
+}
+
+// isCompressed reports whether the attachment is known by its name or
+// declared Content-Type to be compressed already.
+func (a *MessageAttachment) isCompressed() bool {
+	ct := a.Header.Get("Content-Type")
+	if ct == "" {
+		ct = typeByExtension(a.Name)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(ct)
+	for _, t := range compressedTypes {
+		if strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Gzip returns a copy of the attachment gzipped on the fly, or the
+// attachment itself when its content is compressed already.
+func (a *MessageAttachment) Gzip() *MessageAttachment {
+	if a.isCompressed() {
+		return a
+	}
+
+	header := cloneHeader(a.Header)
+	header.Del("Content-Disposition")
+	// the encoding of the original content does not fit the gzipped one,
+	// which is written as base64
+	header.Del("Content-Transfer-Encoding")
+	header.Set("Content-Type", "application/gzip")
+	return &MessageAttachment{
+		Name:   a.Name + ".gz",
+		Header: header,
+		Source: func() (io.ReadCloser, error) {
+			r, err := a.Open()
+			if err != nil {
+				return nil, err
+			}
+
+			pr, pw := io.Pipe()
+			go func() {
+				defer r.Close()
+				gw := gzip.NewWriter(pw)
+				if _, err := io.Copy(gw, r); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+
+				pw.CloseWithError(gw.Close())
+			}()
+
+			return pr, nil
+		},
+	}
+}
+
+// CompressAttachments gzips every attachment of the message which is not
+// compressed already.
+func (m *Message) CompressAttachments() {
+	for i, att := range m.Attachments {
+		m.Attachments[i] = att.Gzip()
+	}
+}
+
+// withAttachments returns a copy of the message sharing its header and
+// body but carrying only the given attachments.
+func (m *Message) withAttachments(atts []*MessageAttachment) *Message {
+	result := NewMessage()
+	for k, v := range m.Header {
+		result.Header[k] = append([]string(nil), v...)
+	}
+
+	result.Body = m.Body
+	result.BodyType = m.BodyType
+	result.Alternatives = m.Alternatives
+	result.Attachments = atts
+	result.SMIME = m.SMIME
+	result.PGP = m.PGP
+	return result
+}
+
+// SplitBySize spreads the attachments of the message over as many messages
+// as needed for each of them to stay within limit bytes. The messages keep
+// the header and body of m, with the subject numbered as "subject (1/n)".
+// A single message is returned when m fits already. ErrCannotSplit or
+// ErrAttachmentTooLarge is returned, with the least limit of a split, when
+// a message would be over limit.
+func SplitBySize(m *Message, limit int64) ([]*Message, error) {
+	base, err := m.withAttachments(nil).Size()
+	if err != nil {
+		return nil, err
+	}
+
+	if base > limit {
+		return nil, fmt.Errorf("%w: cannot split below %d bytes", ErrCannotSplit, base)
+	}
+
+	var groups [][]*MessageAttachment
+	var current []*MessageAttachment
+	size := base
+	for _, att := range m.Attachments {
+		attSize, err := att.EncodedSize()
+		if err != nil {
+			return nil, err
+		}
+
+		attSize += partOverhead
+		if base+attSize > limit {
+			return nil, fmt.Errorf("%w: %s, cannot split below %d bytes", ErrAttachmentTooLarge, att.Name, base+attSize)
+		}
+
+		if len(current) > 0 && size+attSize > limit {
+			groups = append(groups, current)
+			current = nil
+			size = base
+		}
+
+		current = append(current, att)
+		size += attSize
+	}
+
+	groups = append(groups, current)
+	if len(groups) == 1 {
+		return []*Message{m}, nil
+	}
+
+	subject := m.GetHeader("subject")
+	result := make([]*Message, 0, len(groups))
+	for i, atts := range groups {
+		part := m.withAttachments(atts)
+		part.SetHeader("subject", strings.TrimSpace(fmt.Sprintf("%s (%d/%d)", subject, i+1, len(groups))))
+		result = append(result, part)
+	}
+
+	return result, nil
+}
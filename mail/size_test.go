@@ -0,0 +1,195 @@
+package mail
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGzipDropsTransferEncoding(t *testing.T) {
+	m := NewMessage()
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	content := strings.Repeat("some text\n", 100)
+	m.AttachContent("notes.txt", []byte(content), header)
+
+	gz := m.Attachments[0].Gzip()
+	if got := gz.Header.Get("Content-Transfer-Encoding"); got != "" {
+		t.Errorf("Content-Transfer-Encoding = %q, want none", got)
+	}
+
+	if got := gz.Header.Get("Content-Type"); got != "application/gzip" {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	r, err := gz.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, []byte(content)) {
+		t.Error("gunzipped content differs")
+	}
+}
+
+// countingSource returns a source of content counting the bytes read.
+func countingSource(content []byte, read *int) AttachmentSource {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(&countingReader{r: bytes.NewReader(content), n: read}), nil
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	*cr.n += n
+	return n, err
+}
+
+func TestSize(t *testing.T) {
+	dir := t.TempDir()
+	var sources int
+	newMessage := func() *Message {
+		m := NewMessage()
+		m.SetHeader("From", "me@example.com")
+		m.SetHeader("Subject", "sizes")
+		m.Body = "hello\n"
+		return m
+	}
+
+	m := newMessage()
+	for _, n := range []int{0, 1, 2, 3, 56, 57, 58, 59, 1000, 100000} {
+		content := bytes.Repeat([]byte{0xfe, 'a', '\n'}, n)[:n]
+		name := filepath.Join(dir, fmt.Sprintf("file%d.bin", n))
+		if err := os.WriteFile(name, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		m.AttachContent(fmt.Sprintf("content%d.bin", n), content, nil)
+		if err := m.AttachFile(name, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	qp := textproto.MIMEHeader{}
+	qp.Set("Content-Transfer-Encoding", "quoted-printable")
+	m.AttachContent("notes.txt", []byte(strings.Repeat("some = text\n", 100)), qp)
+	m.Attachments.Append(&MessageAttachment{Name: "source.txt", Source: countingSource([]byte(strings.Repeat("x", 10000)), &sources)})
+	m.Attachments.Append(m.Attachments[len(m.Attachments)-1].Gzip())
+	alternatives := newMessage()
+	alternatives.Alternatives = []MessageBody{{Content: "hello", ContentType: "text/plain"}}
+	alternatives.Body = "<p>hello</p>"
+	alternatives.BodyType = "text/html"
+	for _, m := range []*Message{m, newMessage(), alternatives} {
+		data, err := m.ToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			size, err := m.Size()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if size != int64(len(data)) {
+				t.Errorf("Size = %d, want %d", size, len(data))
+			}
+		}
+	}
+
+	// measured once, only the head sniffed afterwards
+	m = newMessage()
+	m.Attachments.Append(&MessageAttachment{Name: "source.txt", Source: countingSource([]byte(strings.Repeat("x", 10000)), &sources)})
+	for i := 0; i < 2; i++ {
+		sources = 0
+		if _, err := m.Size(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if sources > 2*sniffLen {
+		t.Errorf("%d bytes read by Size", sources)
+	}
+}
+
+func TestBase64Size(t *testing.T) {
+	for n := 0; n < 500; n++ {
+		var buf bytes.Buffer
+		w := newBase64Writer(&buf)
+		w.Write(make([]byte, n))
+		w.Close()
+		if got := base64Size(int64(n)); got != int64(buf.Len()) {
+			t.Fatalf("base64Size(%d) = %d, want %d", n, got, buf.Len())
+		}
+	}
+}
+
+func TestSplitBySize(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "me@example.com")
+	m.SetHeader("Subject", "report")
+	m.Body = "hello\n"
+	base, err := m.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no attachment
+	if _, err = SplitBySize(m, base-1); !errors.Is(err, ErrCannotSplit) || !strings.Contains(err.Error(), fmt.Sprintf("cannot split below %d bytes", base)) {
+		t.Errorf("err = %v, want ErrCannotSplit", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		m.AttachContent(fmt.Sprintf("part%d.bin", i), bytes.Repeat([]byte{0xff}, 3000), nil)
+	}
+
+	parts, err := SplitBySize(m, base+2*(4200+partOverhead))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parts) != 2 || len(parts[0].Attachments) != 2 || len(parts[1].Attachments) != 1 {
+		t.Fatalf("%d parts", len(parts))
+	}
+
+	if got := parts[1].GetHeader("Subject"); got != "report (2/2)" {
+		t.Errorf("Subject = %q", got)
+	}
+
+	for _, part := range parts {
+		if size, err := part.Size(); err != nil || size > base+2*(4200+partOverhead) {
+			t.Errorf("part size = %d, %v", size, err)
+		}
+	}
+
+	if parts, err = SplitBySize(m, 1<<20); err != nil || len(parts) != 1 || parts[0] != m {
+		t.Errorf("message fitting split: %d parts, %v", len(parts), err)
+	}
+
+	if _, err = SplitBySize(m, base+1000); !errors.Is(err, ErrAttachmentTooLarge) || !strings.Contains(err.Error(), "part0.bin, cannot split below") {
+		t.Errorf("err = %v, want ErrAttachmentTooLarge", err)
+	}
+}
@@ -0,0 +1,226 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strings"
+)
+
+// SMIMESigner signs messages with a certificate.
+type SMIMESigner struct {
+	Cert *x509.Certificate
+	// Key is the RSA or ECDSA private key of Cert.
+	Key crypto.Signer
+	// Chain are intermediate certificates sent along the signature.
+	Chain []*x509.Certificate
+}
+
+// SMIME signs and encrypts a message (RFC 8551) once built.
+type SMIME struct {
+	// Signer signs the message as multipart/signed when set.
+	Signer *SMIMESigner
+	// Recipients encrypt the message, as application/pkcs7-mime, to
+	// these certificates when not empty.
+	Recipients []*x509.Certificate
+}
+
+// readEntity reads the header of the built message read from r, and
+// separates the fields describing its content (Content-*) from the
+// others. The content fields followed by the body, read as it is, form
+// the MIME entity to protect.
+func readEntity(r io.Reader) (header []byte, entity io.Reader, err error) {
+	br := bufio.NewReader(r)
+	fields, err := readRawHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var h, e bytes.Buffer
+	for _, f := range fields {
+		switch name := strings.ToLower(f.name); {
+		case name == "mime-version":
+		case strings.HasPrefix(name, "content-"):
+			fmt.Fprintf(&e, "%s: %s\r\n", f.name, f.value)
+		default:
+			fmt.Fprintf(&h, "%s: %s\r\n", f.name, f.value)
+		}
+	}
+
+	e.WriteString("\r\n")
+	return h.Bytes(), io.MultiReader(&e, br), nil
+}
+
+// crlfWriter ends every line written with CRLF, which is the form that
+// is signed and which relays must not change.
+type crlfWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func (cw *crlfWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			m, err := cw.w.Write(p)
+			cw.cr = m > 0 && p[m-1] == '\r'
+			return n + m, err
+		}
+
+		line := p[:i]
+		if _, err := cw.w.Write(line); err != nil {
+			return n, err
+		}
+
+		if i > 0 {
+			cw.cr = line[i-1] == '\r'
+		}
+
+		eol := "\r\n"
+		if cw.cr {
+			eol = "\n"
+		}
+
+		if _, err := io.WriteString(cw.w, eol); err != nil {
+			return n, err
+		}
+
+		cw.cr = false
+		n += i + 1
+		p = p[i+1:]
+	}
+
+	return n, nil
+}
+
+// canonicalCRLF ends every line of b with CRLF, see crlfWriter.
+func canonicalCRLF(b []byte) []byte {
+	var buf bytes.Buffer
+	cw := crlfWriter{w: &buf}
+	cw.Write(b)
+	return buf.Bytes()
+}
+
+func writeBase64(w io.Writer, data []byte) error {
+	bw := newBase64Writer(w)
+	if _, err := bw.Write(data); err != nil {
+		return err
+	}
+
+	if err := bw.Close(); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// writeSigned writes entity to w as a multipart/signed entity, its
+// signature being computed as it is written.
+func (s *SMIMESigner) writeSigned(w io.Writer, entity io.Reader) error {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256;\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+	bw.WriteString("This is an S/MIME signed message\r\n")
+
+	// the signed entity is written as is, the CRLF before a delimiter
+	// belongs to the delimiter
+	fmt.Fprintf(bw, "\r\n--%s\r\n", boundary)
+	h := sha256.New()
+	if _, err := io.Copy(&crlfWriter{w: io.MultiWriter(bw, h)}, entity); err != nil {
+		return err
+	}
+
+	sig, err := signDetached(h.Sum(nil), s.Cert, s.Key, s.Chain)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(bw, "\r\n--%s\r\n", boundary)
+	bw.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
+	bw.WriteString("Content-Transfer-Encoding: base64\r\n")
+	bw.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n")
+	if err = writeBase64(bw, sig); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(bw, "\r\n--%s--\r\n", boundary)
+	return bw.Flush()
+}
+
+// writeEncrypted writes entity to w as an application/pkcs7-mime entity.
+// The entity is held in memory, as the length of the encrypted content
+// is encoded before it, and encrypted in place.
+func writeEncrypted(w io.Writer, entity []byte, recipients []*x509.Certificate) error {
+	prefix, encrypted, err := encryptEnveloped(entity, recipients)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\r\n")
+	bw.WriteString("Content-Transfer-Encoding: base64\r\n")
+	bw.WriteString("Content-Disposition: attachment; filename=\"smime.p7m\"\r\n\r\n")
+	b64 := newBase64Writer(bw)
+	if _, err = b64.Write(prefix); err != nil {
+		return err
+	}
+
+	if _, err = b64.Write(encrypted); err != nil {
+		return err
+	}
+
+	if err = b64.Close(); err != nil {
+		return err
+	}
+
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// Protect writes the built message read from r to w, signed then
+// encrypted as configured. A signed message is streamed, while an
+// encrypted one is held in memory once, see writeEncrypted.
+func (s *SMIME) Protect(w io.Writer, r io.Reader) error {
+	if s.Signer == nil && len(s.Recipients) == 0 {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	header, entity, err := readEntity(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(append(header, "MIME-Version: 1.0\r\n"...)); err != nil {
+		return err
+	}
+
+	if len(s.Recipients) == 0 {
+		return s.Signer.writeSigned(w, entity)
+	}
+
+	var buf bytes.Buffer
+	if s.Signer != nil {
+		err = s.Signer.writeSigned(&buf, entity)
+	} else {
+		_, err = io.Copy(&crlfWriter{w: &buf}, entity)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return writeEncrypted(w, buf.Bytes(), s.Recipients)
+}
+
+// ErrNoRecipientCertificate is returned when a recipient of an encrypted
+// message has no known certificate.
+var ErrNoRecipientCertificate = errors.New("smime: no certificate for recipient")
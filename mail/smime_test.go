@@ -0,0 +1,144 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCRLFWriter(t *testing.T) {
+	input := "a\nb\r\nc\rd\n\n"
+	want := "a\r\nb\r\nc\rd\r\n\r\n"
+	// every split of the input, a CR and its LF may come in two writes
+	for i := 0; i <= len(input); i++ {
+		var buf bytes.Buffer
+		cw := crlfWriter{w: &buf}
+		for _, chunk := range []string{input[:i], input[i:]} {
+			n, err := cw.Write([]byte(chunk))
+			if err != nil || n != len(chunk) {
+				t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+			}
+		}
+
+		if buf.String() != want {
+			t.Errorf("split at %d: got %q, want %q", i, buf.String(), want)
+		}
+	}
+}
+
+// writePEM writes the PEM block of der to a file of dir, returning its
+// path.
+func writePEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	t.Helper()
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+// openssl runs openssl with args, failing with its output on error.
+func openssl(t *testing.T, args ...string) {
+	t.Helper()
+	out, err := exec.Command("openssl", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("openssl %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+// The messages are verified and decrypted by openssl.
+func TestSMIMEOpenSSL(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not found")
+	}
+
+	rsaKey := newRSAKey(t)
+	rsaCert := newTestCert(t, rsaKey, 1)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecCert := newTestCert(t, ecKey, 2)
+	tests := []struct {
+		name    string
+		signer  *SMIMESigner
+		encrypt bool
+	}{
+		{"signed rsa", &SMIMESigner{Cert: rsaCert, Key: rsaKey}, false},
+		{"signed ecdsa", &SMIMESigner{Cert: ecCert, Key: ecKey}, false},
+		{"encrypted", nil, true},
+		{"signed and encrypted", &SMIMESigner{Cert: ecCert, Key: ecKey}, true},
+	}
+
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := writePEM(t, dir, "key.pem", "PRIVATE KEY", keyDER)
+	certFile := writePEM(t, dir, "cert.pem", "CERTIFICATE", rsaCert.Raw)
+	// both certificates are trusted roots
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rsaCert.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ecCert.Raw})...)
+	if err = os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMessage()
+			m.SetHeader("From", "me@example.com")
+			m.SetHeader("To", "you@example.com")
+			m.SetHeader("Subject", "hello")
+			m.Body = "hello\nworld\n"
+			m.AttachContent("notes.txt", []byte("some notes\n"), nil)
+			m.SMIME = &SMIME{Signer: tt.signer}
+			if tt.encrypt {
+				m.SMIME.Recipients = []*x509.Certificate{rsaCert}
+			}
+
+			data, err := m.ToBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			in := filepath.Join(t.TempDir(), "message.eml")
+			if err = os.WriteFile(in, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.encrypt {
+				out := in + ".decrypted"
+				openssl(t, "cms", "-decrypt", "-in", in, "-recip", certFile, "-inkey", keyFile, "-out", out)
+				in = out
+			}
+
+			if tt.signer != nil {
+				out := in + ".verified"
+				openssl(t, "cms", "-verify", "-in", in, "-CAfile", caFile, "-out", out)
+				in = out
+			}
+
+			content, err := os.ReadFile(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Contains(content, []byte("hello\r\nworld\r\n")) || !bytes.Contains(content, []byte("notes.txt")) {
+				t.Errorf("content:\n%s", content)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+// Package queue implements a disk backed queue of rendered messages
+// waiting to be delivered.
+//
+// Every item is a directory holding the message (message.eml) and its
+// metadata (item.json). Items move between the pending, sending and failed
+// state directories by renaming, so a crash leaves every item in exactly
+// one state.
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Item states, which are also the names of the state directories.
+const (
+	StatePending = "pending"
+	StateSending = "sending"
+	StateFailed  = "failed"
+)
+
+const (
+	tmpDir      = "tmp"
+	messageFile = "message.eml"
+	itemFile    = "item.json"
+)
+
+var states = []string{StatePending, StateSending, StateFailed}
+
+// ErrNotFound is returned for an unknown item id.
+var ErrNotFound = errors.New("queue: item not found")
+
+// Item is the metadata of a queued message.
+type Item struct {
+	ID      string   `json:"id"`
+	Account string   `json:"account"`
+	From    string   `json:"from"`
+	To      []string `json:"to"`
+	Subject string   `json:"subject,omitempty"`
+	// MessageID, MessageFile, Mail and Key are recorded in the send
+	// journal once the item is delivered, see journal.Entry.
+	MessageID   string `json:"messageId,omitempty"`
+	MessageFile string `json:"messageFile,omitempty"`
+	Mail        string `json:"mail,omitempty"`
+	Key         string `json:"key,omitempty"`
+
+	CreatedAt   time.Time `json:"createdAt"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+	// ClaimedAt is set while a runner is delivering the item.
+	ClaimedAt time.Time `json:"claimedAt,omitempty"`
+	// HeartbeatAt is refreshed by the runner delivering the item, which
+	// is considered crashed once it stops, see Recover.
+	HeartbeatAt time.Time `json:"heartbeatAt,omitempty"`
+	// DeliveredAt is set once the item is delivered, before it is
+	// removed, so that it is never delivered again.
+	DeliveredAt time.Time `json:"deliveredAt,omitempty"`
+
+	// State is given by the directory holding the item.
+	State string `json:"-"`
+}
+
+// Queue is a spool directory of messages.
+type Queue struct {
+	dir string
+}
+
+// Open opens the queue stored in dir, creating it if needed.
+func Open(dir string) (*Queue, error) {
+	for _, d := range append([]string{tmpDir}, states...) {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Queue{dir: dir}, nil
+}
+
+// Dir returns the spool directory of the queue.
+func (q *Queue) Dir() string {
+	return q.dir
+}
+
+func (q *Queue) itemDir(state string, id string) string {
+	return filepath.Join(q.dir, state, id)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return time.Now().UTC().Format("20060102T150405.000000") + "-" + hex.EncodeToString(b), nil
+}
+
+// writeFileAtomic writes data to a temporary file renamed to path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func writeItem(dir string, item *Item) error {
+	b, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(dir, itemFile), b)
+}
+
+// Enqueue adds the message written by msg to the queue, item gets its id,
+// creation time and state set.
+func (q *Queue) Enqueue(item *Item, msg io.WriterTo) error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+
+	// the item is prepared aside and renamed into pending once complete
+	dir := filepath.Join(q.dir, tmpDir, id)
+	if err = os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(dir)
+	f, err := os.OpenFile(filepath.Join(dir, messageFile), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = msg.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	item.ID = id
+	item.CreatedAt = time.Now()
+	item.NextAttempt = item.CreatedAt
+	if err = writeItem(dir, item); err != nil {
+		return err
+	}
+
+	if err = os.Rename(dir, q.itemDir(StatePending, id)); err != nil {
+		return err
+	}
+
+	item.State = StatePending
+	return nil
+}
+
+func (q *Queue) readItem(state string, id string) (*Item, error) {
+	b, err := os.ReadFile(filepath.Join(q.itemDir(state, id), itemFile))
+	if err != nil {
+		return nil, err
+	}
+
+	item := Item{}
+	if err = json.Unmarshal(b, &item); err != nil {
+		return nil, fmt.Errorf("queue: item %s: %w", id, err)
+	}
+
+	item.ID = id
+	item.State = state
+	return &item, nil
+}
+
+// List returns the items in the given states, all states if none given,
+// ordered by id, which is by creation time.
+func (q *Queue) List(only ...string) ([]*Item, error) {
+	var result []*Item
+	for _, state := range states {
+		if len(only) > 0 && !slices.Contains(only, state) {
+			continue
+		}
+
+		entries, err := os.ReadDir(filepath.Join(q.dir, state))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+
+			item, err := q.readItem(state, e.Name())
+			if errors.Is(err, fs.ErrNotExist) {
+				// moved by a concurrent runner
+				continue
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, item)
+		}
+	}
+
+	slices.SortFunc(result, func(a, b *Item) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return result, nil
+}
+
+// Get returns the item with the given id, whatever its state.
+func (q *Queue) Get(id string) (*Item, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return nil, ErrNotFound
+	}
+
+	for _, state := range states {
+		item, err := q.readItem(state, id)
+		if err == nil {
+			return item, nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// OpenMessage opens the rendered message of item.
+func (q *Queue) OpenMessage(item *Item) (*os.File, error) {
+	return os.Open(filepath.Join(q.itemDir(item.State, item.ID), messageFile))
+}
+
+// move renames item into state, saving its metadata first.
+func (q *Queue) move(item *Item, state string) error {
+	if err := writeItem(q.itemDir(item.State, item.ID), item); err != nil {
+		return err
+	}
+
+	if state == item.State {
+		return nil
+	}
+
+	if err := os.Rename(q.itemDir(item.State, item.ID), q.itemDir(state, item.ID)); err != nil {
+		return err
+	}
+
+	item.State = state
+	return nil
+}
+
+// Claim moves a pending item to sending, failing if another runner
+// claimed it first.
+func (q *Queue) Claim(item *Item) error {
+	if item.State != StatePending {
+		return fmt.Errorf("queue: item %s is %s", item.ID, item.State)
+	}
+
+	// the rename is the lock, metadata is only updated once it succeeded
+	if err := os.Rename(q.itemDir(StatePending, item.ID), q.itemDir(StateSending, item.ID)); err != nil {
+		return err
+	}
+
+	item.State = StateSending
+	item.ClaimedAt = time.Now()
+	item.HeartbeatAt = item.ClaimedAt
+	return writeItem(q.itemDir(item.State, item.ID), item)
+}
+
+// Heartbeat tells that the runner which claimed item is still delivering
+// it.
+func (q *Queue) Heartbeat(item *Item) error {
+	item.HeartbeatAt = time.Now()
+	return writeItem(q.itemDir(item.State, item.ID), item)
+}
+
+// Complete records that item was delivered then removes it. An item
+// recorded as delivered is removed by Recover if this fails midway.
+func (q *Queue) Complete(item *Item) error {
+	item.DeliveredAt = time.Now()
+	if err := writeItem(q.itemDir(item.State, item.ID), item); err != nil {
+		return err
+	}
+
+	return q.remove(item)
+}
+
+// Retry records a failed attempt and moves item back to pending,
+// to be delivered again after the given delay.
+func (q *Queue) Retry(item *Item, cause error, delay time.Duration) error {
+	item.Attempts++
+	item.LastError = cause.Error()
+	item.NextAttempt = time.Now().Add(delay)
+	item.ClaimedAt = time.Time{}
+	item.HeartbeatAt = time.Time{}
+	return q.move(item, StatePending)
+}
+
+// Fail records a failed attempt and moves item to failed, where it stays
+// until dropped or requeued.
+func (q *Queue) Fail(item *Item, cause error) error {
+	item.Attempts++
+	item.LastError = cause.Error()
+	item.ClaimedAt = time.Time{}
+	item.HeartbeatAt = time.Time{}
+	return q.move(item, StateFailed)
+}
+
+// Requeue moves a failed item back to pending for immediate delivery.
+func (q *Queue) Requeue(item *Item) error {
+	item.NextAttempt = time.Now()
+	item.ClaimedAt = time.Time{}
+	return q.move(item, StatePending)
+}
+
+// Drop removes an item whatever its state.
+func (q *Queue) Drop(item *Item) error {
+	return q.remove(item)
+}
+
+func (q *Queue) remove(item *Item) error {
+	// renamed out of its state first, so that it never appears half removed
+	trash := filepath.Join(q.dir, tmpDir, item.ID+".removed")
+	if err := os.Rename(q.itemDir(item.State, item.ID), trash); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(trash)
+}
+
+// Recover moves back to pending the items whose runner stopped sending
+// heartbeats for staleAfter, left in sending by a runner which crashed.
+// The items recorded as delivered are removed instead.
+func (q *Queue) Recover(staleAfter time.Duration) (int, error) {
+	items, err := q.List(StateSending)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, item := range items {
+		if !item.DeliveredAt.IsZero() {
+			if err = q.remove(item); err != nil {
+				return n, err
+			}
+
+			continue
+		}
+
+		// the runner was last seen at its latest heartbeat, or when it
+		// claimed the item until it sends one
+		lastSeen := item.ClaimedAt
+		if item.HeartbeatAt.After(lastSeen) {
+			lastSeen = item.HeartbeatAt
+		}
+
+		if time.Since(lastSeen) < staleAfter {
+			continue
+		}
+
+		item.ClaimedAt = time.Time{}
+		item.HeartbeatAt = time.Time{}
+		if err = q.move(item, StatePending); err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, nil
+}
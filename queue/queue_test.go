@@ -0,0 +1,207 @@
+package queue
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stringMessage string
+
+func (s stringMessage) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, string(s))
+	return int64(n), err
+}
+
+func openTestQueue(t *testing.T) *Queue {
+	t.Helper()
+	q, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+func enqueue(t *testing.T, q *Queue, account string) *Item {
+	t.Helper()
+	item := &Item{Account: account, From: "me@example.com", To: []string{"you@example.com"}}
+	if err := q.Enqueue(item, stringMessage("Subject: test\r\n\r\nhello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	return item
+}
+
+func itemStates(t *testing.T, q *Queue) map[string]string {
+	t.Helper()
+	items, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(map[string]string)
+	for _, item := range items {
+		result[item.ID] = item.State
+	}
+
+	return result
+}
+
+func TestEnqueue(t *testing.T) {
+	q := openTestQueue(t)
+	item := enqueue(t, q, "a")
+	if item.ID == "" || item.State != StatePending {
+		t.Fatalf("item = %+v", item)
+	}
+
+	got, err := q.Get(item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Account != "a" || got.State != StatePending {
+		t.Errorf("Get = %+v", got)
+	}
+
+	f, err := q.OpenMessage(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	b, _ := io.ReadAll(f)
+	if !strings.Contains(string(b), "hello") {
+		t.Errorf("message = %q", b)
+	}
+
+	// nothing is left in tmp
+	entries, _ := os.ReadDir(filepath.Join(q.Dir(), tmpDir))
+	if len(entries) != 0 {
+		t.Errorf("%d entries left in tmp", len(entries))
+	}
+}
+
+func TestGetRejectsPaths(t *testing.T) {
+	q := openTestQueue(t)
+	for _, id := range []string{"", ".", "..", "../x", `a\b`} {
+		if _, err := q.Get(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) = %v, want ErrNotFound", id, err)
+		}
+	}
+}
+
+func TestStateTransitions(t *testing.T) {
+	q := openTestQueue(t)
+	item := enqueue(t, q, "a")
+	if err := q.Claim(item); err != nil {
+		t.Fatal(err)
+	}
+
+	if item.State != StateSending || item.ClaimedAt.IsZero() {
+		t.Fatalf("claimed item = %+v", item)
+	}
+
+	// a second claim of the pending item fails
+	stale := *item
+	stale.State = StatePending
+	if err := q.Claim(&stale); err == nil {
+		t.Error("claimed twice")
+	}
+
+	if err := q.Retry(item, errors.New("busy"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := q.Get(item.ID)
+	if got.State != StatePending || got.Attempts != 1 || got.LastError != "busy" || !got.ClaimedAt.IsZero() {
+		t.Errorf("retried item = %+v", got)
+	}
+
+	if got.NextAttempt.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("next attempt = %s", got.NextAttempt)
+	}
+
+	if err := q.Claim(item); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Fail(item, errors.New("rejected")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ = q.Get(item.ID); got.State != StateFailed || got.Attempts != 2 {
+		t.Errorf("failed item = %+v", got)
+	}
+
+	if err := q.Requeue(item); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ = q.Get(item.ID); got.State != StatePending || got.NextAttempt.After(time.Now()) {
+		t.Errorf("requeued item = %+v", got)
+	}
+
+	if err := q.Claim(item); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Complete(item); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := q.Get(item.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("completed item still queued: %v", err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	q := openTestQueue(t)
+	abandoned := enqueue(t, q, "a")
+	alive := enqueue(t, q, "a")
+	delivered := enqueue(t, q, "a")
+	for _, item := range []*Item{abandoned, alive, delivered} {
+		if err := q.Claim(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// claimed long ago, but the runner of alive still sends heartbeats
+	old := time.Now().Add(-time.Hour)
+	for _, item := range []*Item{abandoned, alive, delivered} {
+		item.ClaimedAt = old
+		item.HeartbeatAt = old
+		if err := writeItem(q.itemDir(item.State, item.ID), item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := q.Heartbeat(alive); err != nil {
+		t.Fatal(err)
+	}
+
+	// delivered, but the runner crashed before removing it
+	delivered.DeliveredAt = time.Now()
+	if err := writeItem(q.itemDir(delivered.State, delivered.ID), delivered); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := q.Recover(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Errorf("recovered %d items, want 1", n)
+	}
+
+	got := itemStates(t, q)
+	want := map[string]string{abandoned.ID: StatePending, alive.ID: StateSending}
+	if len(got) != len(want) || got[abandoned.ID] != want[abandoned.ID] || got[alive.ID] != want[alive.ID] {
+		t.Errorf("states = %v, want %v", got, want)
+	}
+}
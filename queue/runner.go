@@ -0,0 +1,239 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// Default retry settings of a Runner.
+const (
+	DefaultMaxAttempts = 10
+	DefaultMinBackoff  = time.Minute
+	DefaultMaxBackoff  = 4 * time.Hour
+	DefaultStaleAfter  = 5 * time.Minute
+)
+
+// heartbeats are sent several times within StaleAfter, a late one does
+// not get the item recovered
+const heartbeatsPerStale = 5
+
+// Deliverer sends the message of item, read from msg.
+type Deliverer func(item *Item, msg io.WriterTo) error
+
+// Stats counts the outcome of a run.
+type Stats struct {
+	Delivered int
+	Deferred  int
+	Failed    int
+}
+
+// Runner delivers the items of a queue.
+type Runner struct {
+	Queue   *Queue
+	Deliver Deliverer
+	// Concurrency returns how many items of an account may be delivered
+	// at once, 1 when nil or not positive.
+	Concurrency func(account string) int
+	// Force delivers every pending item, ignoring their backoff.
+	Force       bool
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	// StaleAfter is how long a claimed item may stay in sending without
+	// heartbeat from its runner before being considered abandoned by a
+	// crashed runner.
+	StaleAfter time.Duration
+	Logger     *log.Logger
+}
+
+func (r *Runner) logf(format string, args ...any) {
+	if r.Logger != nil {
+		r.Logger.Printf(format, args...)
+	}
+}
+
+// backoff returns the delay before the next attempt of an item which
+// failed attempts times, doubling from MinBackoff up to MaxBackoff.
+func (r *Runner) backoff(attempts int) time.Duration {
+	minBackoff, maxBackoff := r.MinBackoff, r.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultMinBackoff
+	}
+
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	d := minBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+
+	return min(d, maxBackoff)
+}
+
+// isPermanent reports whether err is a permanent smtp failure (5xx),
+// which retrying would not fix.
+func isPermanent(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr) && tpErr.Code >= 500
+}
+
+func (r *Runner) staleAfter() time.Duration {
+	if r.StaleAfter <= 0 {
+		return DefaultStaleAfter
+	}
+
+	return r.StaleAfter
+}
+
+// Run delivers the due items once, then returns. Items of different
+// accounts are delivered in parallel, each account by its own workers
+// within its concurrency, so that a busy account does not hold back the
+// others. When ctx is cancelled no more item is started but those in
+// flight are finished.
+func (r *Runner) Run(ctx context.Context) (Stats, error) {
+	stats := Stats{}
+	if n, err := r.Queue.Recover(r.staleAfter()); err != nil {
+		return stats, err
+	} else if n > 0 {
+		r.logf("queue: recovered %d abandoned items", n)
+	}
+
+	items, err := r.Queue.List(StatePending)
+	if err != nil {
+		return stats, err
+	}
+
+	var accounts []string
+	due := make(map[string][]*Item)
+	now := time.Now()
+	for _, item := range items {
+		if !r.Force && item.NextAttempt.After(now) {
+			continue
+		}
+
+		if _, ok := due[item.Account]; !ok {
+			accounts = append(accounts, item.Account)
+		}
+
+		due[item.Account] = append(due[item.Account], item)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, account := range accounts {
+		pending := make(chan *Item, len(due[account]))
+		for _, item := range due[account] {
+			pending <- item
+		}
+
+		close(pending)
+		n := 1
+		if r.Concurrency != nil {
+			n = max(r.Concurrency(account), 1)
+		}
+
+		for i := 0; i < min(n, len(due[account])); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for item := range pending {
+					if ctx.Err() != nil {
+						return
+					}
+
+					outcome, err := r.deliver(item)
+					mu.Lock()
+					switch outcome {
+					case StatePending:
+						stats.Deferred++
+					case StateFailed:
+						stats.Failed++
+					case "":
+						stats.Delivered++
+					}
+
+					mu.Unlock()
+					if err != nil {
+						r.logf("queue: %s: %s", item.ID, err)
+					}
+				}
+			}()
+		}
+	}
+
+	wg.Wait()
+	return stats, ctx.Err()
+}
+
+// heartbeat refreshes the claim of item until the returned function is
+// called, which waits for the last refresh to be written. A copy of item
+// is written, the deliverer reads item meanwhile.
+func (r *Runner) heartbeat(item *Item) func() {
+	claim := *item
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(r.staleAfter() / heartbeatsPerStale)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := r.Queue.Heartbeat(&claim); err != nil {
+					r.logf("queue: %s: %s", item.ID, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// deliver claims and delivers item, returning the state it was left in,
+// empty when delivered.
+func (r *Runner) deliver(item *Item) (string, error) {
+	if err := r.Queue.Claim(item); err != nil {
+		// claimed or dropped by someone else meanwhile
+		return StateSending, err
+	}
+
+	stop := r.heartbeat(item)
+	f, err := r.Queue.OpenMessage(item)
+	if err == nil {
+		err = r.Deliver(item, f)
+		f.Close()
+	}
+
+	// the item is only written again once the heartbeat stopped
+	stop()
+	if err == nil {
+		r.logf("queue: %s delivered to %v", item.ID, item.To)
+		return "", r.Queue.Complete(item)
+	}
+
+	maxAttempts := r.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+
+	if isPermanent(err) || item.Attempts+1 >= maxAttempts {
+		r.logf("queue: %s failed: %s", item.ID, err)
+		return StateFailed, r.Queue.Fail(item, err)
+	}
+
+	delay := r.backoff(item.Attempts + 1)
+	r.logf("queue: %s deferred for %s: %s", item.ID, delay, err)
+	return StatePending, r.Queue.Retry(item, err, delay)
+}
@@ -0,0 +1,173 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunnerOutcomes(t *testing.T) {
+	q := openTestQueue(t)
+	ok := enqueue(t, q, "ok")
+	temporary := enqueue(t, q, "temporary")
+	permanent := enqueue(t, q, "permanent")
+	r := Runner{
+		Queue: q,
+		Deliver: func(item *Item, msg io.WriterTo) error {
+			switch item.Account {
+			case "temporary":
+				return &textproto.Error{Code: 451, Msg: "try later"}
+			case "permanent":
+				return &textproto.Error{Code: 550, Msg: "no such user"}
+			}
+
+			return nil
+		},
+	}
+
+	stats, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats != (Stats{Delivered: 1, Deferred: 1, Failed: 1}) {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	got := itemStates(t, q)
+	if _, found := got[ok.ID]; found {
+		t.Error("delivered item still queued")
+	}
+
+	if got[temporary.ID] != StatePending || got[permanent.ID] != StateFailed {
+		t.Errorf("states = %v", got)
+	}
+
+	// the deferred item is not due yet
+	if stats, _ = r.Run(context.Background()); stats != (Stats{}) {
+		t.Errorf("second run stats = %+v", stats)
+	}
+
+	r.Force = true
+	if stats, _ = r.Run(context.Background()); stats.Deferred != 1 {
+		t.Errorf("forced run stats = %+v", stats)
+	}
+}
+
+func TestRunnerMaxAttempts(t *testing.T) {
+	q := openTestQueue(t)
+	item := enqueue(t, q, "a")
+	r := Runner{
+		Queue:       q,
+		Force:       true,
+		MaxAttempts: 2,
+		Deliver: func(item *Item, msg io.WriterTo) error {
+			return errors.New("connection refused")
+		},
+	}
+
+	for range 2 {
+		if _, err := r.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, _ := q.Get(item.ID); got.State != StateFailed || got.Attempts != 2 {
+		t.Errorf("item = %+v", got)
+	}
+}
+
+func TestRunnerBackoff(t *testing.T) {
+	r := Runner{MinBackoff: time.Minute, MaxBackoff: 10 * time.Minute}
+	for attempts, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 5: 10 * time.Minute} {
+		if got := r.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+// An account busy delivering does not hold back the items of the others.
+func TestRunnerAccountsIndependent(t *testing.T) {
+	q := openTestQueue(t)
+	enqueue(t, q, "slow")
+	enqueue(t, q, "slow")
+	enqueue(t, q, "fast")
+	enqueue(t, q, "fast")
+
+	fastDone := make(chan struct{})
+	var mu sync.Mutex
+	fast := 0
+	r := Runner{
+		Queue: q,
+		Deliver: func(item *Item, msg io.WriterTo) error {
+			if item.Account == "slow" {
+				select {
+				case <-fastDone:
+				case <-time.After(5 * time.Second):
+					return errors.New("fast items held back")
+				}
+
+				return nil
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if fast++; fast == 2 {
+				close(fastDone)
+			}
+
+			return nil
+		},
+	}
+
+	stats, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Delivered != 4 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestRunnerHeartbeat(t *testing.T) {
+	q := openTestQueue(t)
+	item := enqueue(t, q, "a")
+	staleAfter := 50 * time.Millisecond
+	r := Runner{
+		Queue:      q,
+		StaleAfter: staleAfter,
+		Deliver: func(item *Item, msg io.WriterTo) error {
+			claimed := item.HeartbeatAt
+			time.Sleep(100 * time.Millisecond)
+			got, err := q.Get(item.ID)
+			if err != nil {
+				return err
+			}
+
+			if !got.HeartbeatAt.After(claimed) {
+				return errors.New("no heartbeat")
+			}
+
+			// a concurrent runner does not take the item over
+			if n, err := q.Recover(staleAfter); err != nil || n != 0 {
+				return errors.New("item recovered while delivered")
+			}
+
+			return nil
+		},
+	}
+
+	stats, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Delivered != 1 {
+		t.Errorf("stats = %+v, item %s", stats, item.ID)
+	}
+}
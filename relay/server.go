@@ -0,0 +1,613 @@
+// Package relay implements a minimal SMTP server accepting messages from
+// local clients and handing them over to be relayed.
+package relay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve after Close is called.
+var ErrServerClosed = errors.New("relay: server closed")
+
+const (
+	// DefaultMaxMessageSize is the size limit of messages when none is
+	// given.
+	DefaultMaxMessageSize = 25 << 20
+	// DefaultMaxRecipients is the limit of recipients of a message when
+	// none is given, the least a server must accept (RFC 5321).
+	DefaultMaxRecipients = 100
+)
+
+// Error is an SMTP reply returned by a Handler to control the code
+// reported to the client, any other error is reported as a temporary
+// failure (451).
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// Envelope is a message received by the server.
+type Envelope struct {
+	RemoteAddr net.Addr
+	// User is the authenticated user, empty without AUTH.
+	User string
+	From string
+	To   []string
+	Data []byte
+}
+
+// Handler delivers a received message.
+type Handler func(env *Envelope) error
+
+// Server is a SMTP server accepting messages for Handler.
+type Server struct {
+	// Addr is the address to listen on, such as "127.0.0.1:2525".
+	Addr string
+	// Hostname is announced in the greeting, os.Hostname by default.
+	Hostname string
+	// AllowNetworks restricts the clients allowed to connect,
+	// loopback addresses only when empty.
+	AllowNetworks []*net.IPNet
+	// Authenticate checks the credentials of AUTH PLAIN and AUTH LOGIN,
+	// when set clients must authenticate before sending. AUTH is only
+	// offered over TLS or to loopback clients, credentials never travel
+	// in the clear.
+	Authenticate func(user string, password string) bool
+	// TLSConfig enables STARTTLS when set.
+	TLSConfig *tls.Config
+	// MaxMessageSize limits the size of messages, DefaultMaxMessageSize
+	// when 0.
+	MaxMessageSize int64
+	// MaxRecipients limits the recipients of a message,
+	// DefaultMaxRecipients when 0.
+	MaxRecipients int
+	// Timeout closes connections idle for longer, 5 minutes by default.
+	Timeout time.Duration
+	Handler Handler
+	// ErrorLog logs connection errors, log.Default() if nil.
+	ErrorLog *log.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// ParseNetworks parses CIDR networks or single ip addresses.
+func ParseNetworks(networks []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, n := range networks {
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return nil, fmt.Errorf("relay: invalid network: %s", n)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("relay: invalid network: %s", n)
+		}
+
+		result = append(result, ipnet)
+	}
+
+	return result, nil
+}
+
+// ListenAndServe listens on Addr and serves connections until Close.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+
+	s.listener = l
+	s.mu.Unlock()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+
+			return err
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(c)
+		}()
+	}
+}
+
+// Close stops accepting connections and waits for the running sessions.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	l := s.listener
+	s.mu.Unlock()
+	var err error
+	if l != nil {
+		err = l.Close()
+	}
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (s *Server) allowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	if len(s.AllowNetworks) == 0 {
+		return tcpAddr.IP.IsLoopback()
+	}
+
+	for _, n := range s.AllowNetworks {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) maxMessageSize() int64 {
+	if s.MaxMessageSize > 0 {
+		return s.MaxMessageSize
+	}
+
+	return DefaultMaxMessageSize
+}
+
+func (s *Server) maxRecipients() int {
+	if s.MaxRecipients > 0 {
+		return s.MaxRecipients
+	}
+
+	return DefaultMaxRecipients
+}
+
+func (s *Server) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+
+	return "localhost"
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+	sess := session{
+		srv:  s,
+		conn: c,
+		text: textproto.NewConn(c),
+	}
+
+	if !s.allowed(c.RemoteAddr()) {
+		sess.reply(554, "5.7.1 Access denied")
+		return
+	}
+
+	sess.reply(220, s.hostname()+" ESMTP she relay")
+	for {
+		sess.touch()
+		line, err := sess.text.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				s.logf("relay: %s: %s", c.RemoteAddr(), err)
+			}
+
+			return
+		}
+
+		if quit := sess.handle(line); quit {
+			return
+		}
+	}
+}
+
+type session struct {
+	srv  *Server
+	conn net.Conn
+	text *textproto.Conn
+
+	helo string
+	user string
+	from string
+	to   []string
+	// a MAIL command was accepted
+	inTransaction bool
+	// the connection was upgraded with STARTTLS
+	tls bool
+}
+
+// secure tells whether credentials may be sent on the connection: over
+// TLS, or from the host itself.
+func (sess *session) secure() bool {
+	if sess.tls {
+		return true
+	}
+
+	tcpAddr, ok := sess.conn.RemoteAddr().(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
+
+func (sess *session) touch() {
+	timeout := sess.srv.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+
+	sess.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+func (sess *session) reply(code int, lines ...string) {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+
+		sess.text.PrintfLine("%d%s%s", code, sep, line)
+	}
+}
+
+func (sess *session) reset() {
+	sess.from = ""
+	sess.to = nil
+	sess.inTransaction = false
+}
+
+// handle runs a command line, it returns true when the session is over.
+func (sess *session) handle(line string) bool {
+	verb, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch strings.ToUpper(verb) {
+	case "HELO":
+		sess.reset()
+		sess.helo = arg
+		sess.reply(250, sess.srv.hostname())
+	case "EHLO":
+		sess.reset()
+		sess.helo = arg
+		lines := []string{sess.srv.hostname(), "PIPELINING", "8BITMIME", fmt.Sprintf("SIZE %d", sess.srv.maxMessageSize())}
+		if sess.srv.TLSConfig != nil && !sess.tls {
+			lines = append(lines, "STARTTLS")
+		}
+
+		if sess.srv.Authenticate != nil && sess.secure() {
+			lines = append(lines, "AUTH PLAIN LOGIN")
+		}
+
+		sess.reply(250, lines...)
+	case "STARTTLS":
+		sess.handleStartTLS()
+	case "AUTH":
+		sess.handleAuth(arg)
+	case "MAIL":
+		sess.handleMail(arg)
+	case "RCPT":
+		sess.handleRcpt(arg)
+	case "DATA":
+		sess.handleData()
+	case "RSET":
+		sess.reset()
+		sess.reply(250, "2.0.0 OK")
+	case "NOOP":
+		sess.reply(250, "2.0.0 OK")
+	case "VRFY":
+		sess.reply(252, "2.5.2 Cannot VRFY user")
+	case "QUIT":
+		sess.reply(221, "2.0.0 Bye")
+		return true
+	default:
+		sess.reply(500, "5.5.2 Command not recognized")
+	}
+
+	return false
+}
+
+// handleStartTLS upgrades the connection, the session starts over as
+// required by RFC 3207.
+func (sess *session) handleStartTLS() {
+	if sess.srv.TLSConfig == nil || sess.tls {
+		sess.reply(502, "5.5.1 STARTTLS not available")
+		return
+	}
+
+	sess.reply(220, "2.0.0 Ready to start TLS")
+	tlsConn := tls.Server(sess.conn, sess.srv.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		sess.srv.logf("relay: %s: %s", sess.conn.RemoteAddr(), err)
+		sess.conn.Close()
+		return
+	}
+
+	sess.conn = tlsConn
+	sess.text = textproto.NewConn(tlsConn)
+	sess.tls = true
+	sess.helo = ""
+	sess.user = ""
+	sess.reset()
+}
+
+func (sess *session) handleAuth(arg string) {
+	if sess.srv.Authenticate == nil {
+		sess.reply(502, "5.5.1 AUTH not supported")
+		return
+	}
+
+	if !sess.secure() {
+		sess.reply(538, "5.7.11 Encryption required for requested authentication mechanism")
+		return
+	}
+
+	if sess.user != "" {
+		sess.reply(503, "5.5.1 Already authenticated")
+		return
+	}
+
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	var user, password string
+	var err error
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			if initial, err = sess.challenge(""); err != nil {
+				break
+			}
+		}
+
+		var b []byte
+		if b, err = base64.StdEncoding.DecodeString(initial); err != nil {
+			break
+		}
+
+		// authorization identity, user and password separated by NUL
+		parts := bytes.Split(b, []byte{0})
+		if len(parts) != 3 {
+			err = errors.New("invalid PLAIN response")
+			break
+		}
+
+		user, password = string(parts[1]), string(parts[2])
+	case "LOGIN":
+		if user, err = sess.challengeDecoded("Username:", initial); err != nil {
+			break
+		}
+
+		password, err = sess.challengeDecoded("Password:", "")
+	default:
+		sess.reply(504, "5.5.4 Unrecognized authentication type")
+		return
+	}
+
+	if err != nil {
+		sess.reply(501, "5.5.2 Cannot decode response")
+		return
+	}
+
+	if !sess.srv.Authenticate(user, password) {
+		sess.reply(535, "5.7.8 Authentication credentials invalid")
+		return
+	}
+
+	sess.user = user
+	sess.reply(235, "2.7.0 Authentication successful")
+}
+
+// challenge sends a 334 challenge and returns the response line.
+func (sess *session) challenge(prompt string) (string, error) {
+	sess.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt)))
+	line, err := sess.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+
+	if line == "*" {
+		return "", errors.New("authentication cancelled")
+	}
+
+	return line, nil
+}
+
+func (sess *session) challengeDecoded(prompt string, initial string) (string, error) {
+	resp := initial
+	if resp == "" {
+		var err error
+		if resp, err = sess.challenge(prompt); err != nil {
+			return "", err
+		}
+	}
+
+	b, err := base64.StdEncoding.DecodeString(resp)
+	return string(b), err
+}
+
+// pathArg parses "FROM:<addr> params" or "TO:<addr> params".
+func pathArg(arg string, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	path := strings.TrimSpace(arg[len(prefix):])
+	if params := strings.IndexByte(path, '>'); params >= 0 {
+		path = path[:params+1]
+	}
+
+	if !strings.HasPrefix(path, "<") || !strings.HasSuffix(path, ">") {
+		return "", false
+	}
+
+	return path[1 : len(path)-1], true
+}
+
+func (sess *session) handleMail(arg string) {
+	if sess.helo == "" {
+		sess.reply(503, "5.5.1 Send HELO/EHLO first")
+		return
+	}
+
+	if sess.srv.Authenticate != nil && sess.user == "" {
+		sess.reply(530, "5.7.0 Authentication required")
+		return
+	}
+
+	if sess.inTransaction {
+		sess.reply(503, "5.5.1 Nested MAIL command")
+		return
+	}
+
+	from, ok := pathArg(arg, "FROM:")
+	if !ok {
+		sess.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+
+	if from != "" {
+		if _, err := mail.ParseAddress(from); err != nil {
+			sess.reply(553, "5.1.7 Invalid sender address")
+			return
+		}
+	}
+
+	sess.from = from
+	sess.inTransaction = true
+	sess.reply(250, "2.1.0 OK")
+}
+
+func (sess *session) handleRcpt(arg string) {
+	if !sess.inTransaction {
+		sess.reply(503, "5.5.1 Send MAIL first")
+		return
+	}
+
+	to, ok := pathArg(arg, "TO:")
+	if !ok {
+		sess.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+
+	if _, err := mail.ParseAddress(to); err != nil {
+		sess.reply(553, "5.1.3 Invalid recipient address")
+		return
+	}
+
+	if len(sess.to) >= sess.srv.maxRecipients() {
+		sess.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+
+	sess.to = append(sess.to, to)
+	sess.reply(250, "2.1.5 OK")
+}
+
+func (sess *session) handleData() {
+	if !sess.inTransaction || len(sess.to) == 0 {
+		sess.reply(503, "5.5.1 Send RCPT first")
+		return
+	}
+
+	sess.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+	dr := sess.text.DotReader()
+	limit := sess.srv.maxMessageSize()
+	data, err := io.ReadAll(io.LimitReader(dr, limit+1))
+	if err != nil {
+		sess.srv.logf("relay: %s: %s", sess.conn.RemoteAddr(), err)
+		sess.reset()
+		return
+	}
+
+	if int64(len(data)) > limit {
+		// drain the rest of the message before replying
+		io.Copy(io.Discard, dr)
+		sess.reply(552, "5.3.4 Message size exceeds fixed limit")
+		sess.reset()
+		return
+	}
+
+	env := Envelope{
+		RemoteAddr: sess.conn.RemoteAddr(),
+		User:       sess.user,
+		From:       sess.from,
+		To:         sess.to,
+		Data:       data,
+	}
+
+	sess.reset()
+	// relaying may take longer than a client command
+	sess.conn.SetDeadline(time.Time{})
+	err = sess.srv.Handler(&env)
+	var replyErr *Error
+	switch {
+	case err == nil:
+		sess.reply(250, "2.0.0 OK: relayed")
+	case errors.As(err, &replyErr):
+		sess.reply(replyErr.Code, replyErr.Message)
+	default:
+		sess.srv.logf("relay: %s: %s", sess.conn.RemoteAddr(), err)
+		sess.reply(451, "4.3.0 "+firstLine(err.Error()))
+	}
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -0,0 +1,454 @@
+package relay
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// remoteListener accepts connections which seem to come from remote.
+type remoteListener struct {
+	net.Listener
+	remote net.Addr
+}
+
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (l remoteListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return remoteConn{c, l.remote}, nil
+}
+
+// otherHost is a client address out of loopback.
+var otherHost = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+
+// startServer serves srv on a loopback listener until the end of the test,
+// connections seem to come from remote when not nil. The messages received
+// are sent to the returned channel unless srv has a handler.
+func startServer(t *testing.T, srv *Server, remote net.Addr) (string, <-chan *Envelope) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+	if remote != nil {
+		l = remoteListener{l, remote}
+	}
+
+	received := make(chan *Envelope, 10)
+	if srv.Handler == nil {
+		srv.Handler = func(env *Envelope) error {
+			received <- env
+			return nil
+		}
+	}
+
+	srv.Hostname = "relay.test"
+	srv.Timeout = 10 * time.Second
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return addr, received
+}
+
+type client struct {
+	t *testing.T
+	*textproto.Conn
+}
+
+// dial connects to addr, expecting the greeting code.
+func dial(t *testing.T, addr string, code int) *client {
+	t.Helper()
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+	c := &client{t, conn}
+	if got, msg := c.response(); got != code {
+		t.Fatalf("greeting = %d %s, want %d", got, msg, code)
+	}
+
+	return c
+}
+
+func (c *client) response() (int, string) {
+	c.t.Helper()
+	code, msg, err := c.ReadResponse(0)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return code, msg
+}
+
+// cmd sends line, expecting the reply code, and returns the reply message.
+func (c *client) cmd(code int, line string) string {
+	c.t.Helper()
+	if err := c.PrintfLine("%s", line); err != nil {
+		c.t.Fatal(err)
+	}
+
+	got, msg := c.response()
+	if got != code {
+		c.t.Fatalf("%s: got %d %s, want %d", line, got, msg, code)
+	}
+
+	return msg
+}
+
+// data sends the lines of a message as they are, expecting the reply code.
+func (c *client) data(code int, lines ...string) string {
+	c.t.Helper()
+	c.cmd(354, "DATA")
+	for _, line := range append(lines, ".") {
+		if err := c.PrintfLine("%s", line); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+
+	got, msg := c.response()
+	if got != code {
+		c.t.Fatalf("end of data: got %d %s, want %d", got, msg, code)
+	}
+
+	return msg
+}
+
+func plain(user string, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + password))
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestSession(t *testing.T) {
+	addr, received := startServer(t, &Server{}, nil)
+	c := dial(t, addr, 220)
+	c.cmd(503, "MAIL FROM:<me@example.com>")
+	if msg := c.cmd(250, "HELO client.test"); msg != "relay.test" {
+		t.Errorf("HELO = %q", msg)
+	}
+
+	msg := c.cmd(250, "EHLO client.test")
+	want := fmt.Sprintf("relay.test\nPIPELINING\n8BITMIME\nSIZE %d", DefaultMaxMessageSize)
+	if msg != want {
+		t.Errorf("EHLO = %q, want %q", msg, want)
+	}
+
+	c.cmd(503, "RCPT TO:<you@example.com>")
+	c.cmd(501, "MAIL me@example.com")
+	c.cmd(553, "MAIL FROM:<not an address>")
+	c.cmd(250, "MAIL FROM:<me@example.com> BODY=8BITMIME")
+	c.cmd(503, "MAIL FROM:<me@example.com>")
+	c.cmd(503, "DATA")
+	c.cmd(553, "RCPT TO:<you@>")
+	c.cmd(250, "RCPT TO:<you@example.com>")
+	c.cmd(250, "rcpt to:<other@example.com>")
+	c.data(250, "Subject: hello", "", "..leading dot", "...", "last line")
+	env := <-received
+	if env.From != "me@example.com" || strings.Join(env.To, ",") != "you@example.com,other@example.com" || env.User != "" {
+		t.Errorf("envelope = %+v", env)
+	}
+
+	if got := string(env.Data); got != "Subject: hello\n\n.leading dot\n..\nlast line\n" {
+		t.Errorf("data = %q", got)
+	}
+
+	// the transaction is over
+	c.cmd(503, "DATA")
+	c.cmd(250, "MAIL FROM:<>")
+	c.cmd(250, "RCPT TO:<you@example.com>")
+	c.cmd(250, "RSET")
+	c.cmd(503, "RCPT TO:<you@example.com>")
+	c.cmd(502, "AUTH PLAIN")
+	c.cmd(502, "STARTTLS")
+	c.cmd(500, "ETRN")
+	c.cmd(221, "QUIT")
+}
+
+func TestSessionHandlerError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+		msg  string
+	}{
+		{"reply", &Error{Code: 550, Message: "5.7.1 No account"}, 550, "5.7.1 No account"},
+		{"other", errors.New("connection refused\nmore details"), 451, "4.3.0 connection refused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Server{Handler: func(env *Envelope) error { return tt.err }}
+			srv.ErrorLog = log.New(io.Discard, "", 0)
+			addr, _ := startServer(t, srv, nil)
+			c := dial(t, addr, 220)
+			c.cmd(250, "EHLO client.test")
+			c.cmd(250, "MAIL FROM:<me@example.com>")
+			c.cmd(250, "RCPT TO:<you@example.com>")
+			if msg := c.data(tt.code, "Subject: hello", "", "hello"); msg != tt.msg {
+				t.Errorf("reply = %q, want %q", msg, tt.msg)
+			}
+		})
+	}
+}
+
+func TestSessionAuth(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		codes []int
+		user  string
+	}{
+		{"plain", []string{"AUTH PLAIN " + plain("u", "p")}, []int{235}, "u"},
+		{"plain challenge", []string{"AUTH PLAIN", plain("u", "p")}, []int{334, 235}, "u"},
+		{"plain invalid password", []string{"AUTH PLAIN " + plain("u", "wrong")}, []int{535}, ""},
+		{"plain invalid response", []string{"AUTH PLAIN " + b64("u\x00p")}, []int{501}, ""},
+		{"plain cancelled", []string{"AUTH PLAIN", "*"}, []int{334, 501}, ""},
+		{"login", []string{"AUTH LOGIN", b64("u"), b64("p")}, []int{334, 334, 235}, "u"},
+		{"login initial", []string{"AUTH LOGIN " + b64("u"), b64("p")}, []int{334, 235}, "u"},
+		{"login invalid user", []string{"AUTH LOGIN", b64("other"), b64("p")}, []int{334, 334, 535}, ""},
+		{"login not base64", []string{"AUTH LOGIN", "u"}, []int{334, 501}, ""},
+		{"unknown mechanism", []string{"AUTH CRAM-MD5"}, []int{504}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Server{Authenticate: func(user string, password string) bool {
+				return user == "u" && password == "p"
+			}}
+
+			addr, received := startServer(t, srv, nil)
+			c := dial(t, addr, 220)
+			if msg := c.cmd(250, "EHLO client.test"); !strings.HasSuffix(msg, "\nAUTH PLAIN LOGIN") {
+				t.Errorf("EHLO = %q", msg)
+			}
+
+			for i, line := range tt.lines {
+				code := tt.codes[i]
+				if err := c.PrintfLine("%s", line); err != nil {
+					t.Fatal(err)
+				}
+
+				if got, msg := c.response(); got != code {
+					t.Fatalf("%s: got %d %s, want %d", line, got, msg, code)
+				}
+			}
+
+			if tt.user == "" {
+				c.cmd(530, "MAIL FROM:<me@example.com>")
+				return
+			}
+
+			c.cmd(503, "AUTH PLAIN "+plain("u", "p"))
+			c.cmd(250, "MAIL FROM:<me@example.com>")
+			c.cmd(250, "RCPT TO:<you@example.com>")
+			c.data(250, "hello")
+			if env := <-received; env.User != tt.user {
+				t.Errorf("user = %q, want %q", env.User, tt.user)
+			}
+		})
+	}
+}
+
+// selfSignedConfig returns a server config with a certificate of
+// relay.test.
+func selfSignedConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "relay.test"},
+		DNSNames:     []string{"relay.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// Credentials of other hosts only travel over TLS.
+func TestSessionAuthRequiresTLS(t *testing.T) {
+	networks, err := ParseNetworks([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{
+		AllowNetworks: networks,
+		Authenticate: func(user string, password string) bool {
+			return user == "u" && password == "p"
+		},
+	}
+
+	addr, _ := startServer(t, srv, otherHost)
+	c := dial(t, addr, 220)
+	if msg := c.cmd(250, "EHLO client.test"); strings.Contains(msg, "AUTH") || strings.Contains(msg, "STARTTLS") {
+		t.Errorf("EHLO = %q", msg)
+	}
+
+	c.cmd(538, "AUTH PLAIN "+plain("u", "p"))
+	c.cmd(530, "MAIL FROM:<me@example.com>")
+
+	srv = &Server{
+		AllowNetworks: networks,
+		Authenticate:  srv.Authenticate,
+		TLSConfig:     selfSignedConfig(t),
+	}
+
+	addr, received := startServer(t, srv, otherHost)
+	c = dial(t, addr, 220)
+	if msg := c.cmd(250, "EHLO client.test"); !strings.HasSuffix(msg, "\nSTARTTLS") {
+		t.Errorf("EHLO = %q", msg)
+	}
+
+	c.cmd(538, "AUTH PLAIN "+plain("u", "p"))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc, err := smtp.NewClient(conn, "relay.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sc.Close()
+	if err = sc.StartTLS(&tls.Config{ServerName: "relay.test", InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := sc.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS offered over TLS")
+	}
+
+	if ok, mechanisms := sc.Extension("AUTH"); !ok || mechanisms != "PLAIN LOGIN" {
+		t.Errorf("AUTH = %v %q", ok, mechanisms)
+	}
+
+	if err = sc.Auth(smtp.PlainAuth("", "u", "p", "relay.test")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sc.Mail("me@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sc.Rcpt("you@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := sc.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprint(w, "Subject: hello\r\n\r\nhello\r\n")
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if env := <-received; env.User != "u" || env.RemoteAddr.String() != otherHost.String() {
+		t.Errorf("envelope = %+v", env)
+	}
+}
+
+func TestAllowNetworks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"192.0.2.1", "198.51.100.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		networks []*net.IPNet
+		remote   net.Addr
+		code     int
+	}{
+		{"loopback by default", nil, nil, 220},
+		{"other host by default", nil, otherHost, 554},
+		{"allowed host", networks, otherHost, 220},
+		{"allowed network", networks, &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40000}, 220},
+		{"loopback not allowed", networks, nil, 554},
+		{"other network", networks, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 40000}, 554},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := startServer(t, &Server{AllowNetworks: tt.networks}, tt.remote)
+			dial(t, addr, tt.code)
+		})
+	}
+
+	if _, err = ParseNetworks([]string{"192.0.2.300"}); err == nil {
+		t.Error("invalid network parsed")
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	addr, received := startServer(t, &Server{MaxMessageSize: 64, MaxRecipients: 2}, nil)
+	c := dial(t, addr, 220)
+	if msg := c.cmd(250, "EHLO client.test"); !strings.Contains(msg, "\nSIZE 64") {
+		t.Errorf("EHLO = %q", msg)
+	}
+
+	c.cmd(250, "MAIL FROM:<me@example.com>")
+	c.cmd(250, "RCPT TO:<a@example.com>")
+	c.cmd(250, "RCPT TO:<b@example.com>")
+	c.cmd(452, "RCPT TO:<c@example.com>")
+	c.data(552, "Subject: too long", "", strings.Repeat("x", 64))
+	select {
+	case env := <-received:
+		t.Fatalf("message over the limit received: %+v", env)
+	default:
+	}
+
+	// the session goes on
+	c.cmd(250, "MAIL FROM:<me@example.com>")
+	c.cmd(250, "RCPT TO:<c@example.com>")
+	c.data(250, "Subject: short", "", "hello")
+	if env := <-received; len(env.Data) > 64 || strings.Join(env.To, ",") != "c@example.com" {
+		t.Errorf("envelope = %+v", env)
+	}
+}
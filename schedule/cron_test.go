@@ -0,0 +1,56 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// a wednesday
+	from := time.Date(2024, 5, 1, 10, 0, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", from, time.Date(2024, 5, 1, 10, 1, 0, 0, time.UTC)},
+		{"*/15 * * * *", from, time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)},
+		{"5/15 * * * *", from, time.Date(2024, 5, 1, 10, 5, 0, 0, time.UTC)},
+		{"0 10 * * *", from, time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)},
+		{"30 9-17 * * mon-fri", from, time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)},
+		{"0 9 * * 1", from, time.Date(2024, 5, 6, 9, 0, 0, 0, time.UTC)},
+		// 7 is sunday as well as 0
+		{"0 9 * * 7", from, time.Date(2024, 5, 5, 9, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", from, time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC), time.Date(2024, 7, 31, 0, 0, 0, 0, time.UTC)},
+		// either day field matches when both are restricted
+		{"0 0 13 * fri", from, time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", from, time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", from, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", from, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan,jul *", from, time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)},
+		// never
+		{"0 0 30 2 *", from, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			c, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := c.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded", expr)
+		}
+	}
+}
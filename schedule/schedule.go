@@ -0,0 +1,324 @@
+// Package schedule keeps track of mails to be sent later, once at a given
+// time or repeatedly following a cron expression.
+package schedule
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned for an unknown job id.
+var ErrNotFound = errors.New("schedule: job not found")
+
+// timeLayouts are the accepted layouts of absolute times, in local time
+// unless a zone is given.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ParseTime parses an absolute time such as "2024-05-01 08:30", or a time
+// of day such as "08:30" meaning its next occurrence after now.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+			if !t.After(now) {
+				t = t.AddDate(0, 0, 1)
+			}
+
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("schedule: invalid time: %s", s)
+}
+
+// Job is a mail to be rendered and sent later, templates are executed
+// when the job runs so that their data is current.
+type Job struct {
+	ID      string `json:"id"`
+	Account string `json:"account"`
+	// MessageFile is the absolute path of the message file
+	MessageFile string `json:"messageFile"`
+	Mail        string `json:"mail"`
+	// WorkDir is the working directory the job was scheduled from,
+	// relative paths of the message file resolve from it.
+	WorkDir string `json:"workDir"`
+	// ConfigFiles are the absolute paths of the config files loaded when
+	// the job was scheduled, loaded again when it runs.
+	ConfigFiles []string `json:"configFiles,omitempty"`
+	// Cron repeats the job, a job without it runs once.
+	Cron string `json:"cron,omitempty"`
+
+	NextRun   time.Time `json:"nextRun"`
+	LastRun   time.Time `json:"lastRun,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// NewJob returns a job for the given mail scheduled by spec, which is
+// either an absolute time (see ParseTime) or a cron expression.
+func NewJob(account string, messageFile string, mail string, spec string, now time.Time) (*Job, error) {
+	job := Job{Account: account, Mail: mail}
+	if t, err := ParseTime(spec, now); err == nil {
+		job.NextRun = t
+	} else {
+		c, err := ParseCron(spec)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: neither a time nor a cron expression: %s", spec)
+		}
+
+		job.Cron = spec
+		job.NextRun = c.Next(now)
+	}
+
+	var err error
+	if job.MessageFile, err = filepath.Abs(messageFile); err != nil {
+		return nil, err
+	}
+
+	if job.WorkDir, err = os.Getwd(); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// key identifies a recurring job, scheduling the same mail again
+// replaces the previous job instead of adding another one.
+func (j *Job) key() string {
+	return strings.Join(append([]string{j.Account, j.MessageFile, j.Mail, j.WorkDir}, j.ConfigFiles...), "\x00")
+}
+
+// Done records a run of the job at t, computing the next run of a
+// recurring job. It returns false when the job will not run again.
+func (j *Job) Done(t time.Time, runErr error) bool {
+	j.LastRun = t
+	j.LastError = ""
+	if runErr != nil {
+		j.LastError = runErr.Error()
+	}
+
+	if j.Cron == "" {
+		return false
+	}
+
+	c, err := ParseCron(j.Cron)
+	if err != nil {
+		return false
+	}
+
+	// runs missed while the daemon was down are not caught up one by one
+	j.NextRun = c.Next(t)
+	return !j.NextRun.IsZero()
+}
+
+// Store is the file holding the scheduled jobs.
+type Store struct {
+	path string
+	Jobs []*Job `json:"jobs"`
+}
+
+// Load reads the jobs stored at path, an empty store if it does not exist.
+func Load(path string) (*Store, error) {
+	s := Store{path: path}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &s, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("schedule: %s: %w", path, err)
+	}
+
+	return &s, nil
+}
+
+// Save writes the jobs atomically, so that a crash leaves either the
+// previous or the new state.
+func (s *Store) Save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// Add adds job to the store, a recurring job replaces the one scheduled
+// for the same mail if any.
+func (s *Store) Add(job *Job) error {
+	if job.Cron != "" {
+		for i, j := range s.Jobs {
+			if j.Cron != "" && j.key() == job.key() {
+				job.ID = j.ID
+				s.Jobs[i] = job
+				return nil
+			}
+		}
+	}
+
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	job.ID = hex.EncodeToString(b)
+	s.Jobs = append(s.Jobs, job)
+	return nil
+}
+
+// Get returns the job with the given id.
+func (s *Store) Get(id string) (*Job, error) {
+	for _, j := range s.Jobs {
+		if j.ID == id {
+			return j, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// Remove removes the job with the given id.
+func (s *Store) Remove(id string) error {
+	i := slices.IndexFunc(s.Jobs, func(j *Job) bool { return j.ID == id })
+	if i < 0 {
+		return ErrNotFound
+	}
+
+	s.Jobs = slices.Delete(s.Jobs, i, i+1)
+	return nil
+}
+
+// Due returns the jobs to run at t, earliest first.
+func (s *Store) Due(t time.Time) []*Job {
+	var result []*Job
+	for _, j := range s.Jobs {
+		if !j.NextRun.After(t) {
+			result = append(result, j)
+		}
+	}
+
+	slices.SortFunc(result, func(a, b *Job) int {
+		return a.NextRun.Compare(b.NextRun)
+	})
+
+	return result
+}
+
+// Take returns copies of the jobs due at t, earliest first, and records
+// their run: recurring jobs move to their next run and the others are
+// removed. Saved before the jobs run, the store does not run them again
+// after a crash in between.
+func (s *Store) Take(t time.Time) []Job {
+	var result []Job
+	for _, j := range s.Due(t) {
+		result = append(result, *j)
+		if !j.Done(t, nil) {
+			s.Remove(j.ID)
+		}
+	}
+
+	return result
+}
+
+// NextRun returns the earliest next run of the jobs, zero without job.
+func (s *Store) NextRun() time.Time {
+	var result time.Time
+	for _, j := range s.Jobs {
+		if result.IsZero() || j.NextRun.Before(result) {
+			result = j.NextRun
+		}
+	}
+
+	return result
+}
+
+// lockTimeout is how long Update waits for the store lock, a lock older
+// than that is considered left by a crashed process.
+const lockTimeout = 30 * time.Second
+
+func lock(path string) (func(), error) {
+	lockPath := path + ".lock"
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+
+		if fi, err := os.Stat(lockPath); err == nil && time.Since(fi.ModTime()) > lockTimeout {
+			os.Remove(lockPath)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("schedule: %s is locked", path)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Update loads the store at path, applies fn and saves the result while
+// holding a lock, so that concurrent updates are not lost.
+func Update(path string, fn func(s *Store) error) error {
+	unlock, err := lock(path)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+	s, err := Load(path)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(s); err != nil {
+		return err
+	}
+
+	return s.Save()
+}
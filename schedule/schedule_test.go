@@ -0,0 +1,92 @@
+package schedule
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreTake(t *testing.T) {
+	now := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	s := &Store{path: filepath.Join(t.TempDir(), "schedule.json")}
+	jobs := []*Job{
+		{Mail: "once", NextRun: now.Add(-time.Minute)},
+		{Mail: "daily", Cron: "0 8 * * *", NextRun: now},
+		{Mail: "later", NextRun: now.Add(time.Hour)},
+	}
+
+	for _, j := range jobs {
+		if err := s.Add(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	taken := s.Take(now)
+	if len(taken) != 2 || taken[0].Mail != "once" || taken[1].Mail != "daily" {
+		t.Fatalf("taken = %+v", taken)
+	}
+
+	// the copies keep the run they were taken for
+	if !taken[1].NextRun.Equal(now) {
+		t.Errorf("taken next run = %s", taken[1].NextRun)
+	}
+
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Load(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(jobs[0].ID); err != ErrNotFound {
+		t.Errorf("job run once still stored: %v", err)
+	}
+
+	daily, err := s.Get(jobs[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := now.AddDate(0, 0, 1); !daily.NextRun.Equal(want) || !daily.LastRun.Equal(now) {
+		t.Errorf("daily job = %+v, want next run %s", daily, want)
+	}
+
+	if taken := s.Take(now); len(taken) != 0 {
+		t.Errorf("taken twice: %+v", taken)
+	}
+}
+
+// Scheduling a recurring mail again replaces its job, unless it is with
+// other config files.
+func TestStoreAddRecurring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	s := &Store{path: path}
+	newJob := func(configFiles ...string) *Job {
+		return &Job{Mail: "weekly", MessageFile: "/m.yaml", Cron: "0 9 * * 1", ConfigFiles: configFiles}
+	}
+
+	for _, job := range []*Job{newJob("/a.yaml"), newJob("/a.yaml"), newJob("/a.yaml", "/b.yaml")} {
+		if err := s.Add(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(s.Jobs) != 2 {
+		t.Fatalf("%d jobs, want 2", len(s.Jobs))
+	}
+
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.Jobs[1].ConfigFiles; len(got) != 2 || got[1] != "/b.yaml" {
+		t.Errorf("config files = %q", got)
+	}
+}